@@ -3,7 +3,20 @@ import { createPinia } from 'pinia'
 import './assets/css/fonts.css'
 import './assets/css/style.css'
 import App from './App.vue'
+import { useAuthStore } from './stores/auth'
 
 const app = createApp(App)
-app.use(createPinia())
+const pinia = createPinia()
+app.use(pinia)
+
+// Show the login screen whenever the API reports that authentication is required.
+const originalFetch = window.fetch.bind(window)
+window.fetch = async (...args) => {
+    const response = await originalFetch(...args)
+    if (response.status === 401) {
+        useAuthStore(pinia).loginRequired = true
+    }
+    return response
+}
+
 app.mount('#app')
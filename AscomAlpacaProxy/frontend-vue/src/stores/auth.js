@@ -0,0 +1,53 @@
+import { defineStore } from 'pinia'
+import { ref } from 'vue'
+
+export const useAuthStore = defineStore('auth', () => {
+    const enabled = ref(false)
+    const authenticated = ref(true)
+    const scope = ref('admin')
+    const loginRequired = ref(false)
+
+    async function checkStatus() {
+        try {
+            const response = await fetch('/api/v1/auth/status')
+            if (response.ok) {
+                const data = await response.json()
+                enabled.value = data.enabled
+                authenticated.value = data.authenticated
+                scope.value = data.scope
+                loginRequired.value = data.enabled && !data.authenticated
+            }
+        } catch (e) {
+            console.error("Failed to fetch auth status", e)
+        }
+    }
+
+    async function login(password) {
+        const response = await fetch('/api/v1/auth/login', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ password })
+        })
+        if (!response.ok) {
+            throw new Error(await response.text())
+        }
+        loginRequired.value = false
+        authenticated.value = true
+    }
+
+    async function logout() {
+        await fetch('/api/v1/auth/logout', { method: 'POST' })
+        authenticated.value = false
+        loginRequired.value = enabled.value
+    }
+
+    return {
+        enabled,
+        authenticated,
+        scope,
+        loginRequired,
+        checkStatus,
+        login,
+        logout
+    }
+})
@@ -8,6 +8,7 @@ export const useDeviceStore = defineStore('device', () => {
     const connectionStatus = ref('Disconnected')
     const proxyVersion = ref('')
     const isPaused = ref(false)
+    const connectionState = ref({}) // Detailed connection state (see /api/v1/connection)
     const liveStatus = ref({
         v: 0, i: 0, p: 0,
         t_amb: 0, h_amb: 0, d: 0,
@@ -17,6 +18,7 @@ export const useDeviceStore = defineStore('device', () => {
     const telemetryHistory = ref([]) // For charts
     const availableDates = ref([]) // For CSV history selection
     const availableIps = ref([])
+    const serialPorts = ref([]) // Serial ports of the system (see /api/v1/serial/ports)
     const activeSwitches = ref({})
     const switchNames = ref({})
     const powerStatus = ref({})
@@ -150,6 +152,49 @@ export const useDeviceStore = defineStore('device', () => {
         }
     }
 
+    // Sends a maintenance command (reboot, factory-reset, dry-sensor) to the device.
+    // Destructive commands are answered with a confirmation token first (HTTP 428),
+    // which is sent back to execute the command. Callers ask the user beforehand.
+    async function sendDeviceCommand(action) {
+        const post = (body) => fetch(`/api/v1/device/${action}`, {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify(body)
+        });
+        let response = await post({});
+        if (response.status === 428) {
+            const { confirmation_token } = await response.json();
+            response = await post({ confirm: confirmation_token });
+        }
+        if (!response.ok) throw new Error(await response.text() || response.statusText);
+        return response.json();
+    }
+
+    async function fetchSerialPorts() {
+        try {
+            const response = await fetch('/api/v1/serial/ports');
+            if (response.ok) {
+                serialPorts.value = await response.json();
+            }
+        } catch (e) {
+            console.error("Failed to fetch serial ports", e);
+        }
+    }
+
+    // Probes a serial port and connects to it if an SV241 answers.
+    async function probeSerialPort(port) {
+        const response = await fetch('/api/v1/serial/ports/probe', {
+            method: 'POST',
+            headers: { 'Content-Type': 'application/json' },
+            body: JSON.stringify({ port })
+        });
+        if (!response.ok) throw new Error(await response.text() || response.statusText);
+        const result = await response.json();
+        await fetchSerialPorts();
+        if (!result.success) throw new Error(result.error);
+        return result;
+    }
+
     async function fetchLiveStatus() {
         try {
             const response = await fetch('/api/v1/status');
@@ -216,8 +261,42 @@ export const useDeviceStore = defineStore('device', () => {
             }
 
             isPaused.value = settings.reconnect_paused === true;
+            const conn = settings.connection;
 
-            if (proxyConf && proxyConf.serialPortName) {
+            if (conn && conn.state) {
+                connectionState.value = conn;
+                const port = conn.port || (proxyConf && proxyConf.serialPortName) || '';
+                isConnected.value = conn.state === 'connected' || conn.state === 'syncing' || conn.state === 'unresponsive';
+                switch (conn.state) {
+                    case 'connected':
+                        connectionStatus.value = "Connected";
+                        comPort.value = port;
+                        break;
+                    case 'syncing':
+                        connectionStatus.value = "Syncing...";
+                        comPort.value = `${port} (Syncing configuration...)`;
+                        break;
+                    case 'unresponsive':
+                        connectionStatus.value = "Unresponsive";
+                        comPort.value = `${port} (Not responding)`;
+                        break;
+                    case 'released':
+                        connectionStatus.value = "Paused";
+                        comPort.value = port ? `${port} (Paused)` : "Released (Paused)";
+                        break;
+                    case 'probing':
+                        connectionStatus.value = "Auto-detecting...";
+                        comPort.value = "Probing serial ports...";
+                        break;
+                    case 'opening':
+                        connectionStatus.value = "Connecting...";
+                        comPort.value = `Opening ${port}...`;
+                        break;
+                    default:
+                        connectionStatus.value = "Disconnected";
+                        comPort.value = port ? `Connecting to ${port}...` : "Auto-detecting...";
+                }
+            } else if (proxyConf && proxyConf.serialPortName) {
                 if (isPaused.value) {
                     isConnected.value = false;
                     connectionStatus.value = "Paused";
@@ -245,19 +324,62 @@ export const useDeviceStore = defineStore('device', () => {
         }
     }
 
+    // State stream: pushes power status and sensor changes, so they don't have to be polled.
+    let stateSocket = null;
+    const stateStreamActive = ref(false)
+
+    function applyStateMessage(target, msg) {
+        if (msg.type === 'snapshot') {
+            target.value = msg.data;
+            return;
+        }
+        const next = { ...target.value, ...msg.data };
+        (msg.removed || []).forEach(key => delete next[key]);
+        target.value = next;
+    }
+
+    function connectStateStream() {
+        const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+        stateSocket = new WebSocket(`${protocol}//${window.location.host}/ws/state?topics=status,conditions`);
+
+        stateSocket.onopen = () => {
+            stateStreamActive.value = true;
+        };
+        stateSocket.onmessage = (event) => {
+            try {
+                const msg = JSON.parse(event.data);
+                if (msg.topic === 'status') {
+                    applyStateMessage(powerStatus, msg);
+                } else if (msg.topic === 'conditions') {
+                    applyStateMessage(liveStatus, msg);
+                }
+            } catch (e) {
+                console.error("Failed to parse state message", e);
+            }
+        };
+        stateSocket.onclose = () => {
+            // Fall back to polling until the stream is back.
+            stateStreamActive.value = false;
+            setTimeout(connectStateStream, 5000);
+        };
+    }
+
     // Polling
     function startPolling() {
         fetchProxyVersion();
         fetchFirmwareVersion();
         checkConnection();
+        connectStateStream();
 
         setInterval(() => {
             checkConnection();
             // Firmware version usually doesn't change often, but we can poll it less frequently or same
             if (isConnected.value) {
                 fetchFirmwareVersion();
-                fetchLiveStatus();
-                fetchPowerStatus();
+                if (!stateStreamActive.value) {
+                    fetchLiveStatus();
+                    fetchPowerStatus();
+                }
                 if (Object.keys(config.value).length === 0) fetchConfig();
             }
         }, 2000);
@@ -314,6 +436,7 @@ export const useDeviceStore = defineStore('device', () => {
         comPort,
         isConnected,
         connectionStatus,
+        connectionState,
         proxyVersion,
         liveStatus,
         activeSwitches,
@@ -324,6 +447,7 @@ export const useDeviceStore = defineStore('device', () => {
         telemetryHistory,
         availableDates,
         availableIps,
+        serialPorts,
         fetchConfig,
         saveConfig,
         fetchProxySettings,
@@ -331,6 +455,9 @@ export const useDeviceStore = defineStore('device', () => {
         setSwitch,
         setSwitchValue,
         setAllPower,
+        sendDeviceCommand,
+        fetchSerialPorts,
+        probeSerialPort,
         startPolling: () => {
             startPolling();
             // Initial history fetch (default 12h)
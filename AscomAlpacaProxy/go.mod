@@ -5,6 +5,7 @@ go 1.24.0
 require (
 	fyne.io/systray v1.11.0
 	github.com/go-toast/toast v0.0.0-20190211030409-01e6764cf0a4
+	github.com/google/uuid v1.6.0
 	github.com/gorilla/websocket v1.5.3
 	go.bug.st/serial v1.6.0
 	golang.org/x/sys v0.36.0
@@ -15,7 +16,6 @@ require (
 	github.com/creack/goselect v0.1.2 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/godbus/dbus/v5 v5.1.0 // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/ncruces/go-strftime v0.1.9 // indirect
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
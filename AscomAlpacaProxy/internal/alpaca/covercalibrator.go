@@ -0,0 +1,300 @@
+package alpaca
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+)
+
+// CalibratorStatus values as defined by the ASCOM CoverCalibrator interface.
+const (
+	calibratorNotPresent = 0
+	calibratorOff        = 1
+	calibratorReady      = 3
+	calibratorUnknown    = 4
+)
+
+// coverStateNotPresent is reported for CoverState, as the SV241 has no cover motor.
+const coverStateNotPresent = 0
+
+var (
+	calibratorBrightness int // Last brightness set via CalibratorOn (0 = off)
+	// The heater switched to manual mode for the panel and its previous mode, restored by
+	// CalibratorOff (index -1 = none), so the auto dew control does not fight the panel duty.
+	calibratorHeaterIndex = -1
+	calibratorHeaterMode  int
+	calibratorMutex       sync.Mutex
+)
+
+// coverCalibratorConfig returns the calibrator settings, falling back to the defaults.
+func coverCalibratorConfig() *config.CoverCalibratorConfig {
+	if cc := config.Get().CoverCalibrator; cc != nil {
+		return cc
+	}
+	return config.DefaultCoverCalibratorConfig()
+}
+
+// CalibratorOutputValue maps an Alpaca brightness onto the output value (duty % or volts)
+// using the configured curve. Brightness 0 always maps to 0 (output off).
+func CalibratorOutputValue(cc *config.CoverCalibratorConfig, brightness int) float64 {
+	if brightness <= 0 || cc.MaxBrightness <= 0 {
+		return 0
+	}
+	if brightness > cc.MaxBrightness {
+		brightness = cc.MaxBrightness
+	}
+	fraction := float64(brightness) / float64(cc.MaxBrightness)
+
+	var value float64
+	if len(cc.Curve) >= 2 {
+		// Linear interpolation between evenly spaced curve points (first = brightness 0).
+		pos := fraction * float64(len(cc.Curve)-1)
+		idx := int(math.Floor(pos))
+		if idx >= len(cc.Curve)-1 {
+			value = cc.Curve[len(cc.Curve)-1]
+		} else {
+			value = cc.Curve[idx] + (cc.Curve[idx+1]-cc.Curve[idx])*(pos-float64(idx))
+		}
+	} else {
+		gamma := cc.Gamma
+		if gamma <= 0 {
+			gamma = 1
+		}
+		// Brightness 1 maps to MinOutput, MaxBrightness to MaxOutput.
+		scaled := 0.0
+		if cc.MaxBrightness > 1 {
+			scaled = float64(brightness-1) / float64(cc.MaxBrightness-1)
+		}
+		value = cc.MinOutput + (cc.MaxOutput-cc.MinOutput)*math.Pow(scaled, gamma)
+	}
+
+	return math.Max(0, math.Min(value, config.CoverCalibratorOutputLimit(cc.Output)))
+}
+
+// calibratorOutputIsOn reads the current state of the calibrator output from the status cache.
+func calibratorOutputIsOn(output string) (isOn bool, known bool) {
+	shortKey := config.ShortSwitchIDMap[output]
+	val, ok := serial.Status.Load().Data.Output(shortKey)
+	if !ok {
+		return false, false
+	}
+	if floatVal, isFloat := val.Float(); isFloat {
+		return floatVal > 0, true
+	}
+	return val.Bool, true
+}
+
+// setCalibratorOutput sends the command for the given brightness to the configured output.
+// A heater output in an automatic mode is switched to manual mode while the panel is on.
+// It MUST be called with calibratorMutex held.
+func setCalibratorOutput(src audit.Source, cc *config.CoverCalibratorConfig, brightness int) error {
+	shortKey := config.ShortSwitchIDMap[cc.Output]
+	value := CalibratorOutputValue(cc, brightness)
+
+	if heaterIdx := heaterIndex(cc.Output); value > 0 && heaterIdx >= 0 && calibratorHeaterIndex < 0 {
+		mode, found := serial.Status.Load().Data.HeaterMode(heaterIdx)
+		if found && mode != serial.HeaterModeManual && mode != serial.HeaterModeDisabled {
+			logger.Info("CoverCalibrator: Switching %s from mode %d to manual mode for the flat panel.", cc.Output, mode)
+			if err := setHeaterMode(src, heaterIdx, serial.HeaterModeManual); err != nil {
+				return fmt.Errorf("failed to switch %s to manual mode: %w", cc.Output, err)
+			}
+			calibratorHeaterIndex, calibratorHeaterMode = heaterIdx, mode
+		}
+	}
+
+	var command string
+	if value <= 0 {
+		// Use "false" to avoid ambiguity with "1"=1V in firmware
+		command = fmt.Sprintf(`{"set":{"%s":false}}`, shortKey)
+	} else if cc.Output == "adj_conv" {
+		command = fmt.Sprintf(`{"set":{"%s":%.2f}}`, shortKey, value)
+	} else {
+		command = fmt.Sprintf(`{"set":{"%s":%.0f}}`, shortKey, value)
+	}
+
+	if _, err := serial.SendAuditedCommand(src, "covercalibrator:"+cc.Output, command, 0); err != nil {
+		return err
+	}
+	if cc.Output == "adj_conv" && value > 0 {
+		serial.VoltageMutex.Lock()
+		serial.ActiveVoltageTarget = value
+		serial.VoltageMutex.Unlock()
+	}
+	logger.Info("CoverCalibrator: Brightness set to %d/%d (%s = %.2f).", brightness, cc.MaxBrightness, cc.Output, value)
+
+	if value <= 0 && calibratorHeaterIndex >= 0 {
+		logger.Info("CoverCalibrator: Restoring mode %d of heater %d.", calibratorHeaterMode, calibratorHeaterIndex+1)
+		if err := setHeaterMode(src, calibratorHeaterIndex, calibratorHeaterMode); err != nil {
+			return fmt.Errorf("failed to restore the heater mode: %w", err)
+		}
+		calibratorHeaterIndex = -1
+	}
+	return nil
+}
+
+// heaterIndex returns the dew heater (0-based) driving a PWM output, or -1.
+func heaterIndex(output string) int {
+	switch output {
+	case "pwm1":
+		return 0
+	case "pwm2":
+		return 1
+	}
+	return -1
+}
+
+// setHeaterMode writes the mode of a dew heater to the firmware configuration.
+func setHeaterMode(src audit.Source, heaterIdx, mode int) error {
+	configJSON, _, err := serial.GetFirmwareConfigJSON()
+	if err != nil {
+		return err
+	}
+	// Keep all other fields as the device sent them.
+	var fullConfig map[string]interface{}
+	if err := json.Unmarshal([]byte(configJSON), &fullConfig); err != nil {
+		return err
+	}
+	dhArray, _ := fullConfig["dh"].([]interface{})
+	if heaterIdx >= len(dhArray) {
+		return fmt.Errorf("heater %d not found in the firmware configuration", heaterIdx+1)
+	}
+	heaterMap, ok := dhArray[heaterIdx].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("heater %d not found in the firmware configuration", heaterIdx+1)
+	}
+	heaterMap["m"] = mode
+
+	updatedConfigBytes, err := json.Marshal(fullConfig)
+	if err != nil {
+		return err
+	}
+	command := fmt.Sprintf(`{"sc":%s}`, string(updatedConfigBytes))
+	if _, err := serial.SendAuditedCommand(src, fmt.Sprintf("covercalibrator:heater_mode:%d", heaterIdx+1), command, 0); err != nil {
+		return err
+	}
+	events.Publish(events.ConfigChanged{Scope: events.ConfigScopeFirmware, Source: src.String()})
+	return nil
+}
+
+// --- CoverCalibrator Handlers ---
+
+func (a *API) HandleCoverCalibratorBrightness(w http.ResponseWriter, r *http.Request) {
+	if isOn, known := calibratorOutputIsOn(coverCalibratorConfig().Output); known && !isOn {
+		// Output was switched off elsewhere (e.g. Switch device or Master Power).
+		IntResponse(w, r, 0)
+		return
+	}
+	calibratorMutex.Lock()
+	defer calibratorMutex.Unlock()
+	IntResponse(w, r, calibratorBrightness)
+}
+
+func (a *API) HandleCoverCalibratorMaxBrightness(w http.ResponseWriter, r *http.Request) {
+	IntResponse(w, r, coverCalibratorConfig().MaxBrightness)
+}
+
+func (a *API) HandleCoverCalibratorCalibratorState(w http.ResponseWriter, r *http.Request) {
+	cc := coverCalibratorConfig()
+	if !cc.Enabled {
+		IntResponse(w, r, calibratorNotPresent)
+		return
+	}
+	isOn, known := calibratorOutputIsOn(cc.Output)
+	if !serial.IsConnected() || !known {
+		IntResponse(w, r, calibratorUnknown)
+		return
+	}
+
+	calibratorMutex.Lock()
+	brightness := calibratorBrightness
+	calibratorMutex.Unlock()
+
+	switch {
+	case !isOn:
+		IntResponse(w, r, calibratorOff)
+	case brightness > 0:
+		IntResponse(w, r, calibratorReady)
+	default:
+		// Output is on, but was not switched on by the calibrator.
+		IntResponse(w, r, calibratorUnknown)
+	}
+}
+
+func (a *API) HandleCoverCalibratorCoverState(w http.ResponseWriter, r *http.Request) {
+	IntResponse(w, r, coverStateNotPresent)
+}
+
+func (a *API) HandleCoverCalibratorCalibratorOn(w http.ResponseWriter, r *http.Request) {
+	cc := coverCalibratorConfig()
+	if !cc.Enabled {
+		ErrorResponse(w, r, http.StatusOK, 0x400, "CoverCalibrator is disabled in the proxy settings.")
+		return
+	}
+	if !config.IsCoverCalibratorOutput(cc.Output) {
+		ErrorResponse(w, r, http.StatusOK, 0x500, fmt.Sprintf("Invalid CoverCalibrator output '%s'. Use pwm1, pwm2 or adj_conv.", cc.Output))
+		return
+	}
+
+	brightnessStr, ok := GetFormValueIgnoreCase(r, "Brightness")
+	if !ok {
+		ErrorResponse(w, r, http.StatusOK, 0x400, "Missing required parameter 'Brightness'.")
+		return
+	}
+	brightness, err := strconv.Atoi(brightnessStr)
+	if err != nil || brightness < 0 || brightness > cc.MaxBrightness {
+		ErrorResponse(w, r, http.StatusOK, 0x401, fmt.Sprintf("Invalid value '%s' for Brightness (0-%d).", brightnessStr, cc.MaxBrightness))
+		return
+	}
+
+	calibratorMutex.Lock()
+	defer calibratorMutex.Unlock()
+	if err := setCalibratorOutput(audit.FromRequest(r), cc, brightness); err != nil {
+		ErrorResponse(w, r, http.StatusInternalServerError, http.StatusInternalServerError, fmt.Sprintf("Failed to send command: %v", err))
+		return
+	}
+	calibratorBrightness = brightness
+	EmptyResponse(w, r)
+}
+
+func (a *API) HandleCoverCalibratorCalibratorOff(w http.ResponseWriter, r *http.Request) {
+	cc := coverCalibratorConfig()
+	if !cc.Enabled {
+		ErrorResponse(w, r, http.StatusOK, 0x400, "CoverCalibrator is disabled in the proxy settings.")
+		return
+	}
+	if !config.IsCoverCalibratorOutput(cc.Output) {
+		ErrorResponse(w, r, http.StatusOK, 0x500, fmt.Sprintf("Invalid CoverCalibrator output '%s'. Use pwm1, pwm2 or adj_conv.", cc.Output))
+		return
+	}
+
+	calibratorMutex.Lock()
+	defer calibratorMutex.Unlock()
+	if err := setCalibratorOutput(audit.FromRequest(r), cc, 0); err != nil {
+		ErrorResponse(w, r, http.StatusInternalServerError, http.StatusInternalServerError, fmt.Sprintf("Failed to send command: %v", err))
+		return
+	}
+	calibratorBrightness = 0
+	EmptyResponse(w, r)
+}
+
+// HandleCoverCalibratorCoverNotImplemented rejects OpenCover/CloseCover/HaltCover.
+func (a *API) HandleCoverCalibratorCoverNotImplemented(w http.ResponseWriter, r *http.Request) {
+	ErrorResponse(w, r, http.StatusOK, 0x400, "This device has no cover.")
+}
+
+func (a *API) HandleCoverCalibratorSupportedActions(w http.ResponseWriter, r *http.Request) {
+	StringListResponse(w, r, []string{})
+}
+
+func (a *API) HandleCoverCalibratorAction(w http.ResponseWriter, r *http.Request) {
+	action, _ := GetFormValueIgnoreCase(r, "Action")
+	ErrorResponse(w, r, http.StatusOK, 0x400, fmt.Sprintf("Action '%s' is not supported.", action))
+}
@@ -0,0 +1,50 @@
+package alpaca
+
+import (
+	"math"
+	"sv241pro-alpaca-proxy/internal/config"
+	"testing"
+)
+
+func TestCalibratorOutputValue(t *testing.T) {
+	pwmLinear := &config.CoverCalibratorConfig{Output: "pwm1", MaxBrightness: 100, MinOutput: 1, MaxOutput: 100, Gamma: 1}
+	pwmGamma := &config.CoverCalibratorConfig{Output: "pwm2", MaxBrightness: 11, MinOutput: 0, MaxOutput: 100, Gamma: 2}
+	pwmCurve := &config.CoverCalibratorConfig{Output: "pwm1", MaxBrightness: 4, Curve: []float64{0, 50, 100}}
+	adjLinear := &config.CoverCalibratorConfig{Output: "adj_conv", MaxBrightness: 8, MinOutput: 5, MaxOutput: 12}
+	adjCurve := &config.CoverCalibratorConfig{Output: "adj_conv", MaxBrightness: 2, Curve: []float64{3, 9, 20}}
+	single := &config.CoverCalibratorConfig{Output: "adj_conv", MaxBrightness: 1, MinOutput: 6, MaxOutput: 12, Gamma: 1}
+	noSteps := &config.CoverCalibratorConfig{Output: "pwm1", MaxBrightness: 0, MinOutput: 1, MaxOutput: 100}
+
+	tests := []struct {
+		name       string
+		cc         *config.CoverCalibratorConfig
+		brightness int
+		want       float64
+	}{
+		{"pwm off", pwmLinear, 0, 0},
+		{"pwm negative", pwmLinear, -5, 0},
+		{"pwm minimum", pwmLinear, 1, 1},
+		{"pwm middle", pwmLinear, 50, 50},
+		{"pwm maximum", pwmLinear, 100, 100},
+		{"pwm above maximum", pwmLinear, 200, 100},
+		{"pwm gamma", pwmGamma, 6, 25},
+		{"pwm curve point", pwmCurve, 2, 50},
+		{"pwm curve between points", pwmCurve, 3, 75},
+		{"pwm curve end", pwmCurve, 4, 100},
+		{"pwm no brightness steps", noSteps, 1, 0},
+		{"adj off", adjLinear, 0, 0},
+		{"adj minimum", adjLinear, 1, 5},
+		{"adj between", adjLinear, 4, 8},
+		{"adj maximum", adjLinear, 8, 12},
+		{"adj curve", adjCurve, 1, 9},
+		{"adj curve clamped to 15 V", adjCurve, 2, 15},
+		{"single brightness step", single, 1, 6},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CalibratorOutputValue(tt.cc, tt.brightness); math.Abs(got-tt.want) > 1e-9 {
+				t.Errorf("CalibratorOutputValue(%d) = %g, want %g", tt.brightness, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,54 +3,350 @@ package alpaca
 import (
 	"fmt"
 	"net"
+	"sv241pro-alpaca-proxy/internal/auth"
 	"sv241pro-alpaca-proxy/internal/config"
 	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// DiscoveryPort is the UDP port defined by the Alpaca discovery protocol.
+	DiscoveryPort = 32227
+	// discoveryMessage is the request payload sent by Alpaca clients.
+	discoveryMessage = "alpacadiscovery1"
+	// discoveryIPv6Group is the IPv6 multicast group defined by the Alpaca discovery protocol.
+	discoveryIPv6Group = "ff12::a1:9aca"
+	// interfaceRescanInterval controls how often new network interfaces are picked up.
+	interfaceRescanInterval = 60 * time.Second
 )
 
 // RespondToDiscovery listens for Alpaca discovery packets on UDP port 32227
 // and responds with the server's listening port.
+//
+// IPv4 uses one socket per interface address where the system delivers broadcasts to them
+// (Windows), and a single wildcard socket elsewhere. IPv6 uses a single socket that joins
+// the multicast group on every interface, so each request is received (and answered) once.
+// If the HTTP server is bound to a single address (or a host name), requests are only
+// answered when the client can actually reach that address.
 func RespondToDiscovery() {
 	listenAddr := config.Get().ListenAddress
-	udpAddress := fmt.Sprintf("%s:32227", listenAddr)
-
-	addr, err := net.ResolveUDPAddr("udp4", udpAddress)
+	listenIPs, wildcard, err := resolveListenAddress(listenAddr)
 	if err != nil {
-		logger.Error("Discovery: Could not resolve UDP address '%s': %v", udpAddress, err)
+		logger.Error("Discovery: Could not resolve listen address '%s': %v. Discovery disabled.", listenAddr, err)
 		return
 	}
 
+	hasIPv4, hasIPv6 := false, false
+	for _, ip := range listenIPs {
+		if ip.To4() != nil {
+			hasIPv4 = true
+		} else {
+			hasIPv6 = true
+		}
+	}
+
+	var wg sync.WaitGroup
+	if wildcard || hasIPv4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ipv4PerInterface {
+				manageDiscoveryIPv4(listenIPs, wildcard)
+			} else {
+				serveDiscoveryIPv4(listenIPs, wildcard)
+			}
+		}()
+	}
+	if wildcard || hasIPv6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			manageDiscoveryIPv6(listenIPs, wildcard)
+		}()
+	}
+	wg.Wait()
+}
+
+// resolveListenAddress returns the addresses the HTTP server is bound to. Only an empty
+// address, 0.0.0.0 and :: mean all interfaces; a host name is resolved.
+func resolveListenAddress(listenAddr string) ([]net.IP, bool, error) {
+	if listenAddr == "" {
+		return nil, true, nil
+	}
+	if ip := net.ParseIP(listenAddr); ip != nil {
+		return []net.IP{ip}, ip.IsUnspecified(), nil
+	}
+	ips, err := net.LookupIP(listenAddr)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(ips) == 0 {
+		return nil, false, fmt.Errorf("no addresses found")
+	}
+	return ips, false, nil
+}
+
+// serveDiscoveryIPv4 answers IPv4 discovery requests on a single wildcard socket.
+func serveDiscoveryIPv4(listenIPs []net.IP, wildcard bool) {
+	addr := &net.UDPAddr{IP: net.IPv4zero, Port: DiscoveryPort}
 	conn, err := net.ListenUDP("udp4", addr)
 	if err != nil {
-		logger.Error("Discovery: Could not listen on UDP address '%s': %v", udpAddress, err)
+		logger.Error("Discovery: Could not listen on UDP address '%s': %v", addr, err)
 		logger.Info("HINT: This may be caused by another Alpaca application running, or a permissions issue.")
 		return
 	}
 	defer conn.Close()
-	logger.Info("Alpaca discovery responder started on UDP address '%s'.", udpAddress)
+	if wildcard {
+		logger.Info("Alpaca discovery responder started on UDP address '%s' (all interfaces).", addr)
+	} else {
+		logger.Info("Alpaca discovery responder started on UDP address '%s' (answering clients that can reach %v).", addr, listenIPs)
+	}
+	serveDiscovery(conn, conn, listenIPs, wildcard)
+}
+
+// manageDiscoveryIPv4 starts an IPv4 listener on every interface address and periodically
+// checks for addresses that came up after startup (e.g. Wi-Fi, VPN). Answers are sent
+// from the address the request was received on.
+func manageDiscoveryIPv4(listenIPs []net.IP, wildcard bool) {
+	started := make(map[string]bool)
+	var mu sync.Mutex
+
+	for {
+		for _, ip := range discoveryIPv4Addresses() {
+			key := ip.String()
+			mu.Lock()
+			running := started[key]
+			mu.Unlock()
+			if running {
+				continue
+			}
+
+			addr := &net.UDPAddr{IP: ip, Port: DiscoveryPort}
+			conn, err := net.ListenUDP("udp4", addr)
+			if err != nil {
+				logger.Warn("Discovery: Could not listen on UDP address '%s': %v", addr, err)
+				continue
+			}
+			mu.Lock()
+			started[key] = true
+			mu.Unlock()
+			logger.Info("Alpaca discovery responder started on UDP address '%s'.", addr)
+
+			go func() {
+				defer conn.Close()
+				serveDiscovery(conn, conn, listenIPs, wildcard)
+				// serveDiscovery only returns on a fatal read error, e.g. the address went away.
+				mu.Lock()
+				delete(started, key)
+				mu.Unlock()
+				logger.Info("Alpaca discovery responder on UDP address '%s' stopped.", addr)
+			}()
+		}
+		time.Sleep(interfaceRescanInterval)
+	}
+}
+
+// manageDiscoveryIPv6 joins the IPv6 multicast group on every suitable interface and
+// periodically checks for interfaces that came up after startup (e.g. Wi-Fi, VPN).
+// All interfaces share one socket: sockets bound to the same group and port each receive
+// every datagram of the group, which would answer a request once per interface.
+func manageDiscoveryIPv6(listenIPs []net.IP, wildcard bool) {
+	// Responses are sent from a separate unicast socket; sockets bound to a multicast
+	// group cannot reliably be used as a source address.
+	replyConn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		logger.Warn("Discovery: IPv6 is not available, IPv6 discovery disabled: %v", err)
+		return
+	}
+	defer replyConn.Close()
+
+	group := net.ParseIP(discoveryIPv6Group)
+	conn, err := net.ListenMulticastUDP("udp6", nil, &net.UDPAddr{IP: group, Port: DiscoveryPort})
+	if err != nil {
+		logger.Warn("Discovery: Could not listen on IPv6 group [%s]:%d, IPv6 discovery disabled: %v", discoveryIPv6Group, DiscoveryPort, err)
+		return
+	}
+	defer conn.Close()
+	logger.Info("Alpaca IPv6 discovery responder started on group [%s]:%d.", discoveryIPv6Group, DiscoveryPort)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveDiscovery(conn, replyConn, listenIPs, wildcard)
+		logger.Warn("Alpaca IPv6 discovery responder stopped.")
+	}()
+
+	joined := make(map[int]bool)
+	for {
+		current := make(map[int]bool)
+		for _, ifi := range discoveryInterfaces() {
+			current[ifi.Index] = true
+			if joined[ifi.Index] {
+				continue
+			}
+			// Fails for the interface the socket already joined when it was opened.
+			if err := joinIPv6Group(conn, ifi, group); err != nil {
+				logger.Debug("Discovery: Could not join IPv6 group on interface '%s': %v", ifi.Name, err)
+				continue
+			}
+			joined[ifi.Index] = true
+			logger.Info("Alpaca IPv6 discovery responder joined the group on interface '%s'.", ifi.Name)
+		}
+		// Interfaces that went away lose their membership; join again when they come back.
+		for index := range joined {
+			if !current[index] {
+				delete(joined, index)
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(interfaceRescanInterval):
+		}
+	}
+}
+
+// ipv6Mreq returns the membership request for the group on an interface.
+func ipv6Mreq(ifi net.Interface, group net.IP) *syscall.IPv6Mreq {
+	mreq := &syscall.IPv6Mreq{Interface: uint32(ifi.Index)}
+	copy(mreq.Multiaddr[:], group.To16())
+	return mreq
+}
 
-	discoveryMsg := []byte("alpacadiscovery1")
+// serveDiscovery reads discovery requests from conn and answers them via replyConn.
+func serveDiscovery(conn, replyConn *net.UDPConn, listenIPs []net.IP, wildcard bool) {
 	buffer := make([]byte, 1024)
+	consecutiveErrors := 0
 
 	for {
 		n, remoteAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			logger.Warn("Discovery: Error reading from UDP: %v", err)
+			consecutiveErrors++
+			if consecutiveErrors >= 10 {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
 			continue
 		}
+		consecutiveErrors = 0
 
-		if string(buffer[:n]) == string(discoveryMsg) {
-			logger.Debug("Discovery: Request received from %s", remoteAddr)
+		if string(buffer[:n]) != discoveryMessage {
+			continue
+		}
+		logger.Debug("Discovery: Request received from %s", remoteAddr)
 
-			// Get the current network port from the config
-			port := config.Get().NetworkPort
-			response := fmt.Sprintf(`{"AlpacaPort": %d}`, port)
+		if !wildcard && !canReachAny(remoteAddr.IP, listenIPs) {
+			logger.Debug("Discovery: Ignoring request from %s, which cannot reach listen address %v.", remoteAddr, listenIPs)
+			continue
+		}
+		if !auth.IsAlpacaClientAllowed(remoteAddr.IP) {
+			logger.Debug("Discovery: Ignoring request from %s (not in IP allowlist).", remoteAddr)
+			continue
+		}
 
-			_, err := conn.WriteToUDP([]byte(response), remoteAddr)
-			if err != nil {
-				logger.Error("Discovery: Failed to send response to %s: %v", remoteAddr, err)
-			} else {
-				logger.Debug("Discovery: Sent response '%s' to %s", response, remoteAddr)
+		// Get the current network port from the config
+		port := config.Get().NetworkPort
+		response := fmt.Sprintf(`{"AlpacaPort": %d}`, port)
+
+		if _, err := replyConn.WriteToUDP([]byte(response), remoteAddr); err != nil {
+			logger.Error("Discovery: Failed to send response to %s: %v", remoteAddr, err)
+		} else {
+			logger.Debug("Discovery: Sent response '%s' to %s", response, remoteAddr)
+		}
+	}
+}
+
+// discoveryIPv4Addresses returns the IPv4 addresses of all interfaces that are up.
+func discoveryIPv4Addresses() []net.IP {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logger.Warn("Discovery: Could not list network interfaces: %v", err)
+		return nil
+	}
+	var result []net.IP
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				result = append(result, ipnet.IP.To4())
 			}
 		}
 	}
+	return result
+}
+
+// discoveryInterfaces returns all interfaces that are up and support multicast.
+func discoveryInterfaces() []net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		logger.Warn("Discovery: Could not list network interfaces: %v", err)
+		return nil
+	}
+	var result []net.Interface
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		result = append(result, ifi)
+	}
+	return result
+}
+
+// canReachAny reports whether a client can reach one of the listen addresses.
+func canReachAny(clientIP net.IP, listenIPs []net.IP) bool {
+	for _, listenIP := range listenIPs {
+		if canReach(clientIP, listenIP) {
+			return true
+		}
+	}
+	return false
+}
+
+// canReach reports whether a client at clientIP can reach the HTTP server bound to listenIP.
+// Clients on this computer can always reach it; other clients must share the subnet of
+// the listen address (and never reach a loopback-only server).
+func canReach(clientIP, listenIP net.IP) bool {
+	if isLocalAddress(clientIP) {
+		return true
+	}
+	if listenIP.IsLoopback() {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(listenIP) {
+			return ipnet.Contains(clientIP)
+		}
+	}
+	return false
+}
+
+// isLocalAddress reports whether ip belongs to this computer.
+func isLocalAddress(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
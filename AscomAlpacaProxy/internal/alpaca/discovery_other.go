@@ -0,0 +1,27 @@
+//go:build !windows
+
+package alpaca
+
+import (
+	"net"
+	"syscall"
+)
+
+// Other systems only deliver broadcasts to sockets bound to the wildcard address, so IPv4
+// discovery uses a single wildcard socket.
+const ipv4PerInterface = false
+
+// joinIPv6Group joins the multicast group on an interface of an existing socket.
+func joinIPv6Group(conn *net.UDPConn, ifi net.Interface, group net.IP) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var joinErr error
+	if err := rc.Control(func(fd uintptr) {
+		joinErr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, ipv6Mreq(ifi, group))
+	}); err != nil {
+		return err
+	}
+	return joinErr
+}
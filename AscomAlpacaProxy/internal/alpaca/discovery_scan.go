@@ -0,0 +1,284 @@
+package alpaca
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+// DiscoveredServer describes an Alpaca server that answered a discovery scan.
+type DiscoveredServer struct {
+	Address             string                   `json:"address"`
+	AlpacaPort          int                      `json:"alpacaPort"`
+	Protocol            string                   `json:"protocol"` // "ipv4" or "ipv6"
+	ServerName          string                   `json:"serverName,omitempty"`
+	Manufacturer        string                   `json:"manufacturer,omitempty"`
+	ManufacturerVersion string                   `json:"manufacturerVersion,omitempty"`
+	Location            string                   `json:"location,omitempty"`
+	Devices             []AlpacaConfiguredDevice `json:"devices,omitempty"`
+	IsLocal             bool                     `json:"isLocal"`      // Server runs on this computer
+	IsSelf              bool                     `json:"isSelf"`       // Server is this proxy
+	PortConflict        bool                     `json:"portConflict"` // Another local server uses this proxy's port
+	Error               string                   `json:"error,omitempty"`
+
+	ip net.IP // Source address of the response
+}
+
+const (
+	defaultScanTimeout = 2 * time.Second
+	maxScanTimeout     = 10 * time.Second
+	// detailsTimeout caps the time spent querying the management API of all responders.
+	detailsTimeout = 3 * time.Second
+	// maxQueriedServers limits the responders whose management API is queried, so a
+	// flood of spoofed responses cannot turn the scan into a port scan.
+	maxQueriedServers = 32
+	// maxDetailsSize limits a management API response.
+	maxDetailsSize = 64 * 1024
+	// maxScanResults limits the responders a scan keeps.
+	maxScanResults = 256
+)
+
+// HandleDiscoveryScan runs an Alpaca discovery scan and returns all servers that answered.
+// The optional "timeout" query parameter sets the listen window in milliseconds.
+func HandleDiscoveryScan(w http.ResponseWriter, r *http.Request) {
+	timeout := defaultScanTimeout
+	if ms, err := strconv.Atoi(r.URL.Query().Get("timeout")); err == nil && ms > 0 {
+		timeout = time.Duration(ms) * time.Millisecond
+		if timeout > maxScanTimeout {
+			timeout = maxScanTimeout
+		}
+	}
+
+	servers := ScanForServers(timeout)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(servers)
+}
+
+// ScanForServers broadcasts an Alpaca discovery request over IPv4 and IPv6, collects
+// the responses for the given duration and queries each server's management API.
+func ScanForServers(timeout time.Duration) []DiscoveredServer {
+	logger.Info("Discovery scan: Searching for Alpaca servers (%v)...", timeout)
+
+	var mu sync.Mutex
+	found := make(map[string]*DiscoveredServer)
+	record := func(protocol string, addr *net.UDPAddr, payload []byte) {
+		var reply struct {
+			AlpacaPort int `json:"AlpacaPort"`
+		}
+		if err := json.Unmarshal(payload, &reply); err != nil || reply.AlpacaPort <= 0 {
+			logger.Debug("Discovery scan: Ignoring invalid response from %s: %s", addr, string(payload))
+			return
+		}
+		host := addr.IP.String()
+		if addr.Zone != "" {
+			host += "%" + addr.Zone
+		}
+		key := net.JoinHostPort(host, strconv.Itoa(reply.AlpacaPort))
+		mu.Lock()
+		defer mu.Unlock()
+		if _, exists := found[key]; !exists && len(found) < maxScanResults {
+			found[key] = &DiscoveredServer{
+				Address:    host,
+				AlpacaPort: reply.AlpacaPort,
+				Protocol:   protocol,
+				IsLocal:    isLocalAddress(addr.IP),
+				ip:         addr.IP,
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		scanIPv4(timeout, record)
+	}()
+	go func() {
+		defer wg.Done()
+		scanIPv6(timeout, record)
+	}()
+	wg.Wait()
+
+	servers := make([]DiscoveredServer, 0, len(found))
+	ctx, cancel := context.WithTimeout(context.Background(), detailsTimeout)
+	defer cancel()
+	var queryWg sync.WaitGroup
+	queried := 0
+	for _, server := range found {
+		// Only the responder itself is queried, and only on a local network: the address
+		// and port come from an unauthenticated UDP packet.
+		if !isLocalNetworkAddress(server.ip) {
+			server.Error = "not queried: the responder is not on a local network"
+			continue
+		}
+		if queried >= maxQueriedServers {
+			server.Error = "not queried: too many responders"
+			continue
+		}
+		queried++
+		queryWg.Add(1)
+		go func(s *DiscoveredServer) {
+			defer queryWg.Done()
+			queryServerDetails(ctx, s)
+		}(server)
+	}
+	queryWg.Wait()
+
+	ownPort := config.Get().NetworkPort
+	ownSwitchID := config.GetAlpacaUniqueID(config.DeviceTypeSwitch)
+	for _, server := range found {
+		for _, device := range server.Devices {
+			if device.UniqueID == ownSwitchID {
+				server.IsSelf = true
+				break
+			}
+		}
+		// Only flag a conflict if the server answered, otherwise it may just be this proxy
+		// answering discovery on an address its HTTP server isn't bound to.
+		server.PortConflict = server.IsLocal && !server.IsSelf && server.Error == "" && server.AlpacaPort == ownPort
+		servers = append(servers, *server)
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		if servers[i].Address != servers[j].Address {
+			return servers[i].Address < servers[j].Address
+		}
+		return servers[i].AlpacaPort < servers[j].AlpacaPort
+	})
+
+	logger.Info("Discovery scan: Found %d Alpaca server(s).", len(servers))
+	return servers
+}
+
+// scanIPv4 sends the discovery request to the limited broadcast address, every
+// interface's directed broadcast address and the loopback address.
+func scanIPv4(timeout time.Duration, record func(string, *net.UDPAddr, []byte)) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		logger.Warn("Discovery scan: Could not open IPv4 socket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	targets := []net.IP{net.IPv4bcast, net.IPv4(127, 0, 0, 1)}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() {
+				continue
+			}
+			ip4 := ipnet.IP.To4()
+			mask := ipnet.Mask
+			if ip4 == nil || len(mask) != net.IPv4len {
+				continue
+			}
+			bcast := make(net.IP, net.IPv4len)
+			for i := range ip4 {
+				bcast[i] = ip4[i] | ^mask[i]
+			}
+			targets = append(targets, bcast)
+		}
+	}
+
+	for _, target := range targets {
+		dst := &net.UDPAddr{IP: target, Port: DiscoveryPort}
+		if _, err := conn.WriteToUDP([]byte(discoveryMessage), dst); err != nil {
+			logger.Debug("Discovery scan: Failed to send IPv4 request to %s: %v", dst, err)
+		}
+	}
+	collectResponses(conn, "ipv4", timeout, record)
+}
+
+// scanIPv6 sends the discovery request to the Alpaca multicast group on every interface.
+func scanIPv6(timeout time.Duration, record func(string, *net.UDPAddr, []byte)) {
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	if err != nil {
+		logger.Debug("Discovery scan: IPv6 not available: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	group := net.ParseIP(discoveryIPv6Group)
+	for _, ifi := range discoveryInterfaces() {
+		dst := &net.UDPAddr{IP: group, Port: DiscoveryPort, Zone: ifi.Name}
+		if _, err := conn.WriteToUDP([]byte(discoveryMessage), dst); err != nil {
+			logger.Debug("Discovery scan: Failed to send IPv6 request on interface '%s': %v", ifi.Name, err)
+		}
+	}
+	collectResponses(conn, "ipv6", timeout, record)
+}
+
+func collectResponses(conn *net.UDPConn, protocol string, timeout time.Duration, record func(string, *net.UDPAddr, []byte)) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buffer := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return // Deadline reached
+		}
+		record(protocol, addr, buffer[:n])
+	}
+}
+
+// isLocalNetworkAddress reports whether ip is on this computer or a private or link-local network.
+func isLocalNetworkAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
+
+// queryServerDetails fills in the management description and configured devices of a server.
+func queryServerDetails(ctx context.Context, s *DiscoveredServer) {
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+		// A redirect could point anywhere, so only the responder itself is queried.
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	baseURL := fmt.Sprintf("http://%s", net.JoinHostPort(strings.ReplaceAll(s.Address, "%", "%25"), strconv.Itoa(s.AlpacaPort)))
+
+	var description struct {
+		Value AlpacaDescription `json:"Value"`
+	}
+	if err := getJSON(ctx, client, baseURL+"/management/v1/description", &description); err != nil {
+		s.Error = err.Error()
+		return
+	}
+	s.ServerName = description.Value.ServerName
+	s.Manufacturer = description.Value.Manufacturer
+	s.ManufacturerVersion = description.Value.ManufacturerVersion
+	s.Location = description.Value.Location
+
+	var devices struct {
+		Value []AlpacaConfiguredDevice `json:"Value"`
+	}
+	if err := getJSON(ctx, client, baseURL+"/management/v1/configureddevices", &devices); err != nil {
+		s.Error = err.Error()
+		return
+	}
+	s.Devices = devices.Value
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned HTTP %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxDetailsSize)).Decode(target)
+}
@@ -0,0 +1,25 @@
+package alpaca
+
+import (
+	"net"
+	"syscall"
+)
+
+// Windows delivers broadcasts to sockets bound to the address of the receiving interface,
+// so IPv4 discovery listens on every interface address.
+const ipv4PerInterface = true
+
+// joinIPv6Group joins the multicast group on an interface of an existing socket.
+func joinIPv6Group(conn *net.UDPConn, ifi net.Interface, group net.IP) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var joinErr error
+	if err := rc.Control(func(fd uintptr) {
+		joinErr = syscall.SetsockoptIPv6Mreq(syscall.Handle(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, ipv6Mreq(ifi, group))
+	}); err != nil {
+		return err
+	}
+	return joinErr
+}
@@ -7,7 +7,9 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sv241pro-alpaca-proxy/internal/audit"
 	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sv241pro-alpaca-proxy/internal/serial"
 )
@@ -43,31 +45,48 @@ func NewAPI(appVersion string) *API {
 }
 
 func (a *API) HandleManagementDescription(w http.ResponseWriter, r *http.Request) {
+	conf := config.Get()
 	description := AlpacaDescription{
-		ServerName:          "SV241 Alpaca Proxy",
+		ServerName:          conf.AlpacaServerName,
 		Manufacturer:        "User-Made",
 		ManufacturerVersion: a.appVersion,
-		Location:            "My Observatory",
+		Location:            conf.AlpacaLocation,
 	}
 	ManagementValueResponse(w, r, description)
 }
 
 // HandleManagementConfiguredDevices is static and doesn't need the API struct receiver.
+// UniqueIDs are generated per installation and persisted in the proxy config.
 func HandleManagementConfiguredDevices(w http.ResponseWriter, r *http.Request) {
 	devices := []AlpacaConfiguredDevice{
 		{
-			DeviceName:   "SV241 Power Switch",
+			DeviceName:   config.GetAlpacaDeviceName(config.DeviceTypeSwitch),
 			DeviceType:   "Switch",
 			DeviceNumber: 0,
-			UniqueID:     "a7f5a59c-f5d3-47f5-a59c-f5d347f5a59c", // Static GUID
+			UniqueID:     config.GetAlpacaUniqueID(config.DeviceTypeSwitch),
 		},
 		{
-			DeviceName:   "SV241 Environment",
+			DeviceName:   config.GetAlpacaDeviceName(config.DeviceTypeObservingConditions),
 			DeviceType:   "ObservingConditions",
 			DeviceNumber: 0,
-			UniqueID:     "b8g6b69d-g6e4-58g6-b69d-g6e458g6b69d", // Static GUID
+			UniqueID:     config.GetAlpacaUniqueID(config.DeviceTypeObservingConditions),
+		},
+		{
+			DeviceName:   config.GetAlpacaDeviceName(config.DeviceTypeSafetyMonitor),
+			DeviceType:   "SafetyMonitor",
+			DeviceNumber: 0,
+			UniqueID:     config.GetAlpacaUniqueID(config.DeviceTypeSafetyMonitor),
 		},
 	}
+	// The CoverCalibrator is optional, as it takes over one of the power outputs.
+	if cc := config.Get().CoverCalibrator; cc != nil && cc.Enabled {
+		devices = append(devices, AlpacaConfiguredDevice{
+			DeviceName:   config.GetAlpacaDeviceName(config.DeviceTypeCoverCalibrator),
+			DeviceType:   "CoverCalibrator",
+			DeviceNumber: 0,
+			UniqueID:     config.GetAlpacaUniqueID(config.DeviceTypeCoverCalibrator),
+		})
+	}
 	ManagementValueResponse(w, r, devices)
 }
 
@@ -102,7 +121,7 @@ func (a *API) HandleDriverVersion(w http.ResponseWriter, r *http.Request) {
 }
 
 func (a *API) HandleInterfaceVersion(w http.ResponseWriter, r *http.Request) {
-	IntResponse(w, r, 1) // Switch and ObsCond are both Interface Version 1
+	IntResponse(w, r, 1) // Switch, ObsCond, SafetyMonitor and CoverCalibrator are all Interface Version 1
 }
 
 func (a *API) HandleConnected(w http.ResponseWriter, r *http.Request) {
@@ -118,8 +137,12 @@ func (a *API) HandleConnected(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// When client tries to connect, verify hardware is available
-		if connected && !serial.IsConnected() {
-			ErrorResponse(w, r, http.StatusOK, 0x400, "SV241 device not connected. Please check the USB connection.")
+		if conn := serial.GetConnectionInfo(); connected && !conn.Connected() {
+			msg := fmt.Sprintf("SV241 device not connected (state: %s). Please check the USB connection.", conn.State)
+			if conn.LastError != "" {
+				msg = fmt.Sprintf("SV241 device not connected (state: %s, last error: %s). Please check the USB connection.", conn.State, conn.LastError)
+			}
+			ErrorResponse(w, r, http.StatusOK, 0x400, msg)
 			return
 		}
 		// The connection is managed automatically, so we just acknowledge.
@@ -127,12 +150,13 @@ func (a *API) HandleConnected(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	// For GET, report the actual connection status.
-	BoolResponse(w, r, serial.IsConnected())
+	BoolResponse(w, r, serial.GetConnectionInfo().Connected())
 }
 
-func (a *API) HandleDeviceName(name string) http.HandlerFunc {
+// HandleDeviceName returns the configured DeviceName for the given Alpaca device type.
+func (a *API) HandleDeviceName(deviceType string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		StringResponse(w, r, name)
+		StringResponse(w, r, config.GetAlpacaDeviceName(deviceType))
 	}
 }
 
@@ -148,9 +172,7 @@ func (a *API) HandleObsCondAction(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if strings.ToLower(action) == "getlenstemperature" {
-		serial.Conditions.RLock()
-		defer serial.Conditions.RUnlock()
-		if val, ok := serial.Conditions.Data["t_lens"]; ok && val != nil {
+		if val, ok := serial.Conditions.Load().Data.Value("t_lens"); ok {
 			StringResponse(w, r, fmt.Sprintf("%v", val))
 		} else {
 			ErrorResponse(w, r, http.StatusOK, 0x401, "Sensor not available or failed to read.")
@@ -191,14 +213,14 @@ func (a *API) HandleSwitchGetSwitchName(w http.ResponseWriter, r *http.Request)
 			}
 			return
 		case config.SensorPWM1Key:
-			if name := config.Get().SwitchNames["pwm1"]; name != "" {
+			if name := config.GetSwitchName("pwm1"); name != "" {
 				StringResponse(w, r, name)
 			} else {
 				StringResponse(w, r, "Dew Heater 1")
 			}
 			return
 		case config.SensorPWM2Key:
-			if name := config.Get().SwitchNames["pwm2"]; name != "" {
+			if name := config.GetSwitchName("pwm2"); name != "" {
 				StringResponse(w, r, name)
 			} else {
 				StringResponse(w, r, "Dew Heater 2")
@@ -206,7 +228,7 @@ func (a *API) HandleSwitchGetSwitchName(w http.ResponseWriter, r *http.Request)
 			return
 		}
 
-		customName := config.Get().SwitchNames[internalName]
+		customName := config.GetSwitchName(internalName)
 		if customName != "" {
 			StringResponse(w, r, customName)
 		} else {
@@ -251,17 +273,32 @@ func (a *API) HandleSwitchGetSwitch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	key := config.SwitchIDMap[id]
+	isOn, ok := GetSwitchState(id)
+	if !ok {
+		ErrorResponse(w, r, http.StatusOK, 0x400, "Could not read switch status from cache")
+		return
+	}
+	BoolResponse(w, r, isOn)
+}
+
+// GetSwitchState returns whether the switch with the given ID is on, based on the status cache.
+// The second return value is false if the state is not known (yet).
+func GetSwitchState(id int) (bool, bool) {
+	config.SwitchMapMutex.RLock()
+	defer config.SwitchMapMutex.RUnlock()
+
+	key, exists := config.SwitchIDMap[id]
+	if !exists {
+		return false, false
+	}
 
 	// Sensors always return true (they are "on" when device is connected)
 	if config.IsSensorSwitch(key) {
-		BoolResponse(w, r, true)
-		return
+		return true, true
 	}
 
 	shortKey := config.ShortSwitchKeyByID[id]
-	serial.Status.RLock()
-	defer serial.Status.RUnlock()
+	status := serial.Status.Load().Data
 
 	if shortKey == "all" {
 		allOn := true
@@ -274,20 +311,8 @@ func (a *API) HandleSwitchGetSwitch(w http.ResponseWriter, r *http.Request) {
 			if config.IsSensorSwitch(key) {
 				continue
 			}
-			if val, ok := serial.Status.Data[key]; ok {
-				// Handle both float64 (active value) and bool (false=off)
-				isOn := false
-				if boolVal, isBool := val.(bool); isBool {
-					if boolVal {
-						isOn = true
-					}
-				} else if floatVal, isFloat := val.(float64); isFloat {
-					if floatVal >= 1.0 {
-						isOn = true
-					}
-				}
-
-				if !isOn {
+			if val, ok := status.Output(key); ok {
+				if !val.IsOn() {
 					allOn = false
 					break
 				}
@@ -297,22 +322,13 @@ func (a *API) HandleSwitchGetSwitch(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 		}
-		BoolResponse(w, r, allOn)
-		return
+		return allOn, true
 	}
 
-	if val, ok := serial.Status.Data[shortKey]; ok {
-		// Safe type assertion - handle both float64 and bool
-		isOn := false
-		if floatVal, isFloat := val.(float64); isFloat {
-			isOn = floatVal >= 1.0
-		} else if boolVal, isBool := val.(bool); isBool {
-			isOn = boolVal
-		}
-		BoolResponse(w, r, isOn)
-	} else {
-		ErrorResponse(w, r, http.StatusOK, 0x400, "Could not read switch status from cache")
+	if val, ok := status.Output(shortKey); ok {
+		return val.IsOn(), true
 	}
+	return false, false
 }
 
 func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request) {
@@ -328,8 +344,7 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 	if config.IsSensorSwitch(key) {
 		// All sensors (Voltage, Current, Power, LensTemp, PWM) live in Conditions cache (Telemetry)
 		// PWM in Status (e.g. "pwm1": false) is just the enabled state, not the duty cycle.
-		serial.Conditions.RLock()
-		defer serial.Conditions.RUnlock()
+		conditions := serial.Conditions.Load().Data
 
 		var dataKey string
 		switch key {
@@ -349,36 +364,31 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 
 		// Handle Lens Temp specifically to inject fallback check
 		if key == config.SensorLensTempKey {
-			if val, found := serial.Conditions.Data["t_lens"]; found && val != nil {
-				if floatVal, isFloat := val.(float64); isFloat {
-					FloatResponse(w, r, floatVal)
-					return
-				}
+			if floatVal, found := conditions.Value("t_lens"); found {
+				FloatResponse(w, r, floatVal)
+				return
 			}
 			// Sensor Missing/Error
 			FloatResponse(w, r, -273.15)
 			return
 		}
 
-		if val, found := serial.Conditions.Data[dataKey]; found && val != nil {
-			if floatVal, isFloat := val.(float64); isFloat {
-				// Current is in mA, convert to A
-				if key == config.SensorCurrentKey {
-					floatVal = floatVal / 1000.0
-				}
-				// Round to 2 decimal places for consistency with WebUI
-				floatVal = math.Round(floatVal*100) / 100
-				FloatResponse(w, r, floatVal)
-				return
+		if floatVal, found := conditions.Value(dataKey); found {
+			// Current is in mA, convert to A
+			if key == config.SensorCurrentKey {
+				floatVal = floatVal / 1000.0
 			}
+			// Round to 2 decimal places for consistency with WebUI
+			floatVal = math.Round(floatVal*100) / 100
+			FloatResponse(w, r, floatVal)
+			return
 		}
 		FloatResponse(w, r, 0.0)
 		return
 	}
 
 	shortKey := config.ShortSwitchKeyByID[id]
-	serial.Status.RLock()
-	defer serial.Status.RUnlock()
+	status := serial.Status.Load().Data
 
 	if shortKey == "all" {
 		allOn := true
@@ -390,20 +400,8 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 			if config.IsSensorSwitch(key) {
 				continue
 			}
-			if val, ok := serial.Status.Data[key]; ok {
-				// Handle both float64 (active value) and bool (false=off)
-				isOn := false
-				if boolVal, isBool := val.(bool); isBool {
-					if boolVal {
-						isOn = true
-					}
-				} else if floatVal, isFloat := val.(float64); isFloat {
-					if floatVal >= 1.0 {
-						isOn = true
-					}
-				}
-
-				if !isOn {
+			if val, ok := status.Output(key); ok {
+				if !val.IsOn() {
 					allOn = false
 					break
 				}
@@ -420,13 +418,13 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if val, ok := serial.Status.Data[shortKey]; ok {
+	if val, ok := status.Output(shortKey); ok {
 		var switchValue float64
 		// Special handling for Adjustable Voltage if enabled
 		if shortKey == "adj" && config.Get().EnableAlpacaVoltageControl {
 			// Check if the device reports the output is actually OFF (boolean false)
 			// Firmware reports boolean 'false' for OFF, and float voltage for ON.
-			if boolVal, isBool := val.(bool); isBool && !boolVal {
+			if val.IsBool && !val.Bool {
 				switchValue = 0.0 // Device is OFF
 			} else {
 				// Device is ON. Return cached target to reflect intended voltage.
@@ -438,7 +436,7 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 					switchValue = target
 				} else {
 					// Fallback: trust the reported status value if target is unknown
-					if v, ok := val.(float64); ok {
+					if v, ok := val.Float(); ok {
 						switchValue = v
 					} else {
 						switchValue = 0.0
@@ -455,22 +453,14 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 					heaterIdx = 1
 				}
 
-				// Note: We're already inside serial.Status.RLock() from line 239,
-				// so we can access Data directly without another lock
-				dmVal, found := serial.Status.Data["dm"]
-
-				if found {
-					if dmArray, ok := dmVal.([]interface{}); ok && heaterIdx < len(dmArray) {
-						modeFloat, isFloat := dmArray[heaterIdx].(float64)
-						if isFloat && int(modeFloat) == 0 {
-							isManualPWM = true
-						}
-					}
+				// Use the same status snapshot as above
+				if mode, found := status.HeaterMode(heaterIdx); found && mode == serial.HeaterModeManual {
+					isManualPWM = true
 				}
 			}
 
 			// Handle potential Boolean or Float values
-			if v, isFloat := val.(float64); isFloat {
+			if v, isFloat := val.Float(); isFloat {
 				if isManualPWM {
 					switchValue = v // Return full value (e.g. 75.0)
 				} else {
@@ -478,7 +468,7 @@ func (a *API) HandleSwitchGetSwitchValue(w http.ResponseWriter, r *http.Request)
 						switchValue = 1.0 // Clamp to binary for Auto/Standard
 					}
 				}
-			} else if b, isBool := val.(bool); isBool && b {
+			} else if val.Bool {
 				switchValue = 1.0
 			}
 		}
@@ -501,7 +491,7 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	var state bool
+	var cmd SwitchCommand
 	var err error
 	if valueStr, ok := GetFormValueIgnoreCase(r, "Value"); ok {
 		// Normalize: allows usage of "12,5" instead of "12.5"
@@ -511,9 +501,9 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 			ErrorResponse(w, r, http.StatusOK, 400, "Invalid Value parameter")
 			return
 		}
-		state = (value >= 1.0)
+		cmd = SwitchCommand{State: value >= 1.0, Value: value, HasValue: true}
 	} else if stateStr, ok := GetFormValueIgnoreCase(r, "State"); ok {
-		state, err = strconv.ParseBool(stateStr)
+		cmd.State, err = strconv.ParseBool(stateStr)
 		if err != nil {
 			ErrorResponse(w, r, http.StatusOK, 400, "Invalid State parameter")
 			return
@@ -523,8 +513,47 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	longKey := config.SwitchIDMap[id]
+	cmd.Source = audit.FromRequest(r)
+	if err := SetSwitch(id, cmd); err != nil {
+		ErrorResponse(w, r, http.StatusInternalServerError, http.StatusInternalServerError, fmt.Sprintf("Failed to send command: %v", err))
+		return
+	}
+
+	if key == "master_power" && cmd.State {
+		// Respond success immediately (the commands are queued)
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"status":"Master Power ON sequence initiated"}`)
+		return
+	}
+
+	// We don't send the raw firmware response to the client.
+	// Alpaca expects a standard envelope.
+	EmptyResponse(w, r)
+}
+
+// SwitchCommand describes a requested change of a switch.
+// Value is only used if HasValue is set (e.g. a PWM duty cycle or a voltage).
+type SwitchCommand struct {
+	State    bool
+	Value    float64
+	HasValue bool
+	Source   audit.Source // Who requested the change (for the audit log)
+}
+
+// SetSwitch sends the command for the switch with the given ID to the SV241. It applies the
+// same heater mode, adjustable voltage and Master Power logic for every protocol (Alpaca,
+// INDI, ...), so all clients behave the same.
+func SetSwitch(id int, cmd SwitchCommand) error {
+	longKey, ok := config.GetSwitchIDMapEntry(id)
+	if !ok {
+		return fmt.Errorf("switch ID %d does not exist", id)
+	}
+	if config.IsSensorSwitch(longKey) {
+		return fmt.Errorf("sensor switches are read-only and cannot be set")
+	}
 	shortKey := config.ShortSwitchIDMap[longKey]
+	state := cmd.State
 
 	// Special handling for Adjustable Voltage (ID 7) if enabled
 	var command string
@@ -545,19 +574,10 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 
 		// Check Mode from Status Cache
 		isAuto := false
-		serial.Status.RLock()
-		dmVal, found := serial.Status.Data["dm"]
-		serial.Status.RUnlock()
-
-		if found {
-			if dmArray, ok := dmVal.([]interface{}); ok && heaterIdx < len(dmArray) {
-				modeFloat, isFloat := dmArray[heaterIdx].(float64)
-				if isFloat {
-					if int(modeFloat) != 0 {
-						isAuto = true
-					}
-				}
-			}
+		mode, found := serial.Status.Load().Data.HeaterMode(heaterIdx)
+
+		if found && mode != serial.HeaterModeManual {
+			isAuto = true
 		}
 
 		// Use Manual PWM Command Logic if:
@@ -565,22 +585,12 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 		//    BUT: Value=0 should NOT be treated as explicit - it means "turn off"!
 		// 2. State Toggle AND we are NOT in Auto Mode.
 		// note: Turning OFF (!state) in Auto Mode should fall through to standard "false" command.
-		forceManualValue, _ := GetFormValueIgnoreCase(r, "Value")
-		hasExplicitValue := false
-		if forceManualValue != "" {
-			// Parse the value to check if it's > 0 (actual power setpoint)
-			valFloat, err := strconv.ParseFloat(strings.Replace(forceManualValue, ",", ".", -1), 64)
-			if err == nil && valFloat > 0 {
-				hasExplicitValue = true
-			}
-		}
+		hasExplicitValue := cmd.HasValue && cmd.Value > 0
 		useManualLogic := (heaterIdx >= 0) && (hasExplicitValue || !isAuto)
 
 		if useManualLogic {
-			if valueStr, ok := GetFormValueIgnoreCase(r, "Value"); ok {
-				valueStr = strings.Replace(valueStr, ",", ".", -1)
-				value, _ := strconv.ParseFloat(valueStr, 64)
-				command = fmt.Sprintf(`{"set":{"%s":%.0f}}`, shortKey, value)
+			if cmd.HasValue {
+				command = fmt.Sprintf(`{"set":{"%s":%.0f}}`, shortKey, cmd.Value)
 			} else {
 				// Restore-on-Toggle Logic for Manual Mode:
 				if state {
@@ -601,14 +611,11 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 	if !sendManualPWMCommand {
 		// Special handling for Adjustable Voltage
 		if longKey == "adj_conv" && config.Get().EnableAlpacaVoltageControl {
-			if valueStr, ok := GetFormValueIgnoreCase(r, "Value"); ok {
+			if cmd.HasValue {
 				// If Value is provided, set specific voltage
-				originalStr := valueStr
-				valueStr = strings.Replace(valueStr, ",", ".", -1)
-				logger.Debug("SetSwitchValue (AdjConv) - Received: '%s', Normalized: '%s'", originalStr, valueStr)
-				value, _ := strconv.ParseFloat(valueStr, 64)
-				command = fmt.Sprintf(`{"set":{"%s":%.2f}}`, shortKey, value)
-				newVoltageTarget = value
+				logger.Debug("SetSwitchValue (AdjConv) - Received: %.2f", cmd.Value)
+				command = fmt.Sprintf(`{"set":{"%s":%.2f}}`, shortKey, cmd.Value)
+				newVoltageTarget = cmd.Value
 			} else {
 				// Use "true"/"false" for bool to avoid ambiguity with "1"=1V in firmware
 				command = fmt.Sprintf(`{"set":{"%s":%t}}`, shortKey, state)
@@ -620,21 +627,16 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 				logger.Info("Master Power ON: Triggering Smart Restore for PWM heaters...")
 
 				// Global Enable first (synchronous)
-				serial.SendCommand(`{"set":{"all":1}}`, true, 0)
+				serial.SendAuditedCommand(cmd.Source, "master_power", `{"set":{"all":1}}`, 0)
 
 				// Now force-restore values for PWM heaters using smart restore logic
 				// We don't need to check errors here, we just fire and forget
 				cmd1 := restorePowerState("pwm1", 0, true)
-				serial.SendCommand(cmd1, true, 0)
+				serial.SendAuditedCommand(cmd.Source, "master_power", cmd1, 0)
 
 				cmd2 := restorePowerState("pwm2", 1, true)
-				serial.SendCommand(cmd2, true, 0)
-
-				// Respond success immediately (the commands are queued)
-				w.WriteHeader(http.StatusOK)
-				w.Header().Set("Content-Type", "application/json")
-				fmt.Fprint(w, `{"status":"Master Power ON sequence initiated"}`)
-				return
+				serial.SendAuditedCommand(cmd.Source, "master_power", cmd2, 0)
+				return nil
 			} else {
 				// Turning OFF -> Standard all:0
 				command = `{"set":{"all":0}}`
@@ -646,10 +648,12 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
-	_, err = serial.SendCommand(command, true, 0)
-	if err != nil {
-		ErrorResponse(w, r, http.StatusInternalServerError, http.StatusInternalServerError, fmt.Sprintf("Failed to send command: %v", err))
-		return
+	action := "switch:" + longKey
+	if longKey == "master_power" {
+		action = "master_power"
+	}
+	if _, err := serial.SendAuditedCommand(cmd.Source, action, command, 0); err != nil {
+		return err
 	}
 
 	// Update the Voltage Target Cache if this was a voltage change command
@@ -659,18 +663,9 @@ func (a *API) HandleSwitchSetSwitchValue(w http.ResponseWriter, r *http.Request)
 		serial.VoltageMutex.Unlock()
 	}
 
-	// Parse response which can contain mixed types ("status" object and "dm" array)
-	// This ensures we capture any immediate status updates from the command,
-	// particularly for the "Turbo" update mechanism in serial.go which might run before this.
-	// But we must NOT prevent standard polling from working.
-
-	// We don't send the raw firmware response to the client.
-	// Alpaca expects a standard envelope.
-	EmptyResponse(w, r)
-
 	// Handle auto-enable/disable logic in a goroutine
 	go handleHeaterInteractions(id, state)
-
+	return nil
 }
 
 // restorePowerState determines the best command to enable a heater with a valid (>0) value.
@@ -685,37 +680,21 @@ func restorePowerState(shortKey string, heaterIdx int, state bool) string {
 }
 
 func getSavedManualPower(heaterIdx int) float64 {
-	// Attempt to read the full config to find the 'mp' value for this heater.
-	// This is a blocking call, but necessary to ensure we restore the correct value.
-	configJSON, err := serial.SendCommand(`{"get":"config"}`, false, 0)
+	// Read the 'mp' value for this heater from the cached firmware config.
+	fwConfig, err := serial.GetFirmwareConfig()
 	if err != nil {
 		logger.Warn("RestoreToggle: Could not get firmware config: %v", err)
 		return 0
 	}
-
-	var fullConfig map[string]interface{}
-	if err := json.Unmarshal([]byte(configJSON), &fullConfig); err != nil {
-		logger.Warn("RestoreToggle: Could not parse firmware config: %v", err)
-		return 0
-	}
-
-	if dhRaw, ok := fullConfig["dh"]; ok {
-		if dhArray, ok := dhRaw.([]interface{}); ok && heaterIdx < len(dhArray) {
-			if heaterMap, ok := dhArray[heaterIdx].(map[string]interface{}); ok {
-				if mpVal, found := heaterMap["mp"]; found {
-					if mpFloat, isFloat := mpVal.(float64); isFloat {
-						return mpFloat
-					}
-				}
-			}
-		}
+	if heater, ok := fwConfig.Heater(heaterIdx); ok {
+		return float64(heater.ManualPower)
 	}
 	return 0
 }
 
 func updateHeaterPersistence(heaterIdx int, newValue float64) {
-	// 1. Fetch current config
-	configJSON, err := serial.SendCommand(`{"get":"config"}`, false, 0)
+	// 1. Take the cached config as the device sent it
+	configJSON, _, err := serial.GetFirmwareConfigJSON()
 	if err != nil {
 		logger.Warn("Persistence: Could not get firmware config: %v", err)
 		return
@@ -758,11 +737,12 @@ func updateHeaterPersistence(heaterIdx int, newValue float64) {
 	}
 
 	setConfigCommand := fmt.Sprintf(`{"sc":%s}`, string(updatedConfigBytes))
-	_, err = serial.SendCommand(setConfigCommand, true, 0)
+	_, err = serial.SendAuditedCommand(audit.Internal, "heater_persistence", setConfigCommand, 0)
 	if err != nil {
 		logger.Error("Persistence: Failed to write updated config to device: %v", err)
 	} else {
 		logger.Info("Persistence: Successfully saved manual power setting to firmware.")
+		events.Publish(events.ConfigChanged{Scope: events.ConfigScopeFirmware, Source: audit.Internal.String()})
 	}
 }
 
@@ -785,11 +765,12 @@ func (a *API) HandleSwitchSetSwitchName(w http.ResponseWriter, r *http.Request)
 		ErrorResponse(w, r, http.StatusBadRequest, http.StatusBadRequest, "Missing Name parameter")
 		return
 	}
-	conf := config.Get()
-	conf.SwitchNames[internalName] = newName
+	config.SetSwitchName(internalName, newName)
 	logger.Info("Set custom name for switch %d ('%s') to '%s'", id, internalName, newName)
 
-	if err := config.Save(); err != nil {
+	err := config.Save()
+	audit.Record(audit.FromRequest(r), "switch_name:"+internalName, newName, "", err)
+	if err != nil {
 		logger.Error("Failed to save proxy config after setting switch name: %v", err)
 		ErrorResponse(w, r, http.StatusInternalServerError, http.StatusInternalServerError, "Failed to save configuration")
 		return
@@ -849,19 +830,11 @@ func (a *API) HandleSwitchMaxSwitchValue(w http.ResponseWriter, r *http.Request)
 		}
 
 		if heaterIdx >= 0 {
-			serial.Status.RLock()
-			dmVal, found := serial.Status.Data["dm"]
-			serial.Status.RUnlock()
-
-			if found {
-				if dmArray, ok := dmVal.([]interface{}); ok && heaterIdx < len(dmArray) {
-					// JSON numbers come as float64 usually
-					modeFloat, isFloat := dmArray[heaterIdx].(float64)
-					if isFloat && int(modeFloat) == 0 { // 0 = Manual
-						FloatResponse(w, r, 100.0)
-						return
-					}
-				}
+			mode, found := serial.Status.Load().Data.HeaterMode(heaterIdx)
+
+			if found && mode == serial.HeaterModeManual {
+				FloatResponse(w, r, 100.0)
+				return
 			}
 		}
 
@@ -915,13 +888,14 @@ func (a *API) HandleSwitchAction(w http.ResponseWriter, r *http.Request) {
 		state := strings.ToLower(action) == "masterswitchon"
 		logger.Info("Executing ASCOM Action: %s", action)
 		StringResponse(w, r, "") // Respond immediately with empty string value per ASCOM spec
+		src := audit.FromRequest(r)
 		go func() {
 			stateInt := 0
 			if state {
 				stateInt = 1
 			}
 			command := fmt.Sprintf(`{"set":{"all":%d}}`, stateInt)
-			serial.SendCommand(command, true, 0)
+			serial.SendAuditedCommand(src, "action:"+strings.ToLower(action), command, 0)
 		}()
 		return
 	default:
@@ -933,42 +907,24 @@ func (a *API) HandleSwitchAction(w http.ResponseWriter, r *http.Request) {
 // --- ObservingConditions Handlers ---
 
 func (a *API) HandleObsCondTemperature(w http.ResponseWriter, r *http.Request) {
-	serial.Conditions.RLock()
-	defer serial.Conditions.RUnlock()
-	if val, ok := serial.Conditions.Data["t_amb"]; ok && val != nil {
-		if floatVal, isFloat := val.(float64); isFloat {
-			FloatResponse(w, r, floatVal)
-		} else {
-			ErrorResponse(w, r, http.StatusOK, 0x401, "Invalid data type for temperature in cache.")
-		}
+	if floatVal, ok := serial.Conditions.Load().Data.Value("t_amb"); ok {
+		FloatResponse(w, r, floatVal)
 	} else {
 		ErrorResponse(w, r, http.StatusOK, 0x401, "Sensor not available or failed to read.")
 	}
 }
 
 func (a *API) HandleObsCondHumidity(w http.ResponseWriter, r *http.Request) {
-	serial.Conditions.RLock()
-	defer serial.Conditions.RUnlock()
-	if val, ok := serial.Conditions.Data["h_amb"]; ok && val != nil {
-		if floatVal, isFloat := val.(float64); isFloat {
-			FloatResponse(w, r, floatVal)
-		} else {
-			ErrorResponse(w, r, http.StatusOK, 0x401, "Invalid data type for humidity in cache.")
-		}
+	if floatVal, ok := serial.Conditions.Load().Data.Value("h_amb"); ok {
+		FloatResponse(w, r, floatVal)
 	} else {
 		ErrorResponse(w, r, http.StatusOK, 0x401, "Sensor not available or failed to read.")
 	}
 }
 
 func (a *API) HandleObsCondDewPoint(w http.ResponseWriter, r *http.Request) {
-	serial.Conditions.RLock()
-	defer serial.Conditions.RUnlock()
-	if val, ok := serial.Conditions.Data["d"]; ok && val != nil {
-		if floatVal, isFloat := val.(float64); isFloat {
-			FloatResponse(w, r, floatVal)
-		} else {
-			ErrorResponse(w, r, http.StatusOK, 0x401, "Invalid data type for dew point in cache.")
-		}
+	if floatVal, ok := serial.Conditions.Load().Data.Value("d"); ok {
+		FloatResponse(w, r, floatVal)
 	} else {
 		ErrorResponse(w, r, http.StatusOK, 0x401, "Sensor not available or failed to read.")
 	}
@@ -1046,18 +1002,13 @@ func handleHeaterInteractions(id int, state bool) {
 		return // Not a heater
 	}
 
-	configJSON, err := serial.SendCommand(`{"get":"config"}`, false, 0)
+	fwConfig, err := serial.GetFirmwareConfig()
 	if err != nil {
 		logger.Warn("HeaterInteraction: Could not get firmware config: %v", err)
 		return
 	}
-	var fwConfig struct {
-		DH []struct {
-			M int `json:"m"` // Mode
-		} `json:"dh"`
-	}
-	if err := json.Unmarshal([]byte(configJSON), &fwConfig); err != nil {
-		logger.Warn("HeaterInteraction: Could not parse firmware config: %v", err)
+	if len(fwConfig.DH) < 2 {
+		logger.Warn("HeaterInteraction: Firmware config has %d heaters, expected 2.", len(fwConfig.DH))
 		return
 	}
 
@@ -1074,9 +1025,9 @@ func handleHeaterInteractions(id int, state bool) {
 		}
 
 		leaderHeaterIndex := 1 - followerHeaterIndex
-		isFollower := fwConfig.DH[followerHeaterIndex].M == 3 // 3 = PID-Sync (Follower)
-		leaderMode := fwConfig.DH[leaderHeaterIndex].M
-		isLeaderValid := leaderMode == 1 || leaderMode == 4 // 1 = PID, 4 = MinTemp
+		isFollower := fwConfig.DH[followerHeaterIndex].Mode == serial.HeaterModePIDSync // Follower
+		leaderMode := fwConfig.DH[leaderHeaterIndex].Mode
+		isLeaderValid := leaderMode == serial.HeaterModePID || leaderMode == serial.HeaterModeMinTemp
 		if isFollower && isLeaderValid {
 			// Determine Leader Key
 			leaderLongKey := "pwm1"
@@ -1087,26 +1038,13 @@ func handleHeaterInteractions(id int, state bool) {
 			logger.Info("Activating Leader (%s) for Follower (%s).", leaderLongKey, followerKey)
 			leaderShortKey := config.ShortSwitchIDMap[leaderLongKey]
 			leaderCommand := fmt.Sprintf(`{"set":{"%s":true}}`, leaderShortKey)
-			responseJSON, err := serial.SendCommand(leaderCommand, true, 0)
+			responseJSON, err := serial.SendAuditedCommand(audit.Internal, "heater_interaction:"+leaderLongKey, leaderCommand, 0)
 			if err != nil {
 				logger.Error("HeaterInteraction: Failed to send enable command to Leader (%s): %v", leaderLongKey, err)
 			} else {
-				// Update Cache
-				var rootData map[string]interface{}
-				if json.Unmarshal([]byte(responseJSON), &rootData) == nil {
-					if statusMap, ok := rootData["status"].(map[string]interface{}); ok {
-						serial.Status.Lock()
-						if dmVal, found := rootData["dm"]; found {
-							statusMap["dm"] = dmVal
-						} else {
-							if existingDM, exists := serial.Status.Data["dm"]; exists {
-								statusMap["dm"] = existingDM
-							}
-						}
-						serial.Status.Data = statusMap
-						serial.Status.Unlock()
-						logger.Info("HeaterInteraction: Successfully activated Leader (%s).", leaderLongKey)
-					}
+				// The command processor has already updated the status cache from the response.
+				if _, err := serial.ParseStatus(responseJSON); err == nil {
+					logger.Info("HeaterInteraction: Successfully activated Leader (%s).", leaderLongKey)
 				}
 			}
 		}
@@ -1121,9 +1059,9 @@ func handleHeaterInteractions(id int, state bool) {
 		leaderLongKey := key // The heater being turned off is potentially a leader
 
 		followerHeaterIndex := 1 - leaderHeaterIndex
-		leaderMode := fwConfig.DH[leaderHeaterIndex].M
-		isLeaderValid := leaderMode == 1 || leaderMode == 4 // 1 = PID, 4 = MinTemp
-		isFollower := fwConfig.DH[followerHeaterIndex].M == 3
+		leaderMode := fwConfig.DH[leaderHeaterIndex].Mode
+		isLeaderValid := leaderMode == serial.HeaterModePID || leaderMode == serial.HeaterModeMinTemp
+		isFollower := fwConfig.DH[followerHeaterIndex].Mode == serial.HeaterModePIDSync
 
 		if isLeaderValid && isFollower {
 			followerLongKey := "pwm1"
@@ -1134,27 +1072,13 @@ func handleHeaterInteractions(id int, state bool) {
 			logger.Info("Deactivating PID Follower (%s) because Leader (%s) was turned off.", followerLongKey, leaderLongKey)
 			followerShortKey := config.ShortSwitchIDMap[followerLongKey]
 			followerCommand := fmt.Sprintf(`{"set":{"%s":false}}`, followerShortKey)
-			responseJSON, err := serial.SendCommand(followerCommand, true, 0)
+			responseJSON, err := serial.SendAuditedCommand(audit.Internal, "heater_interaction:"+followerLongKey, followerCommand, 0)
 			if err != nil {
 				logger.Error("HeaterInteraction: Failed to send disable command to Follower (%s): %v", followerLongKey, err)
 			} else {
-				// Update Cache with response to ensure UI reflects the change immediately
-				var rootData map[string]interface{}
-				if json.Unmarshal([]byte(responseJSON), &rootData) == nil {
-					if statusMap, ok := rootData["status"].(map[string]interface{}); ok {
-						serial.Status.Lock()
-						if dmVal, found := rootData["dm"]; found {
-							statusMap["dm"] = dmVal
-						} else {
-							// Preserve existing DM
-							if existingDM, exists := serial.Status.Data["dm"]; exists {
-								statusMap["dm"] = existingDM
-							}
-						}
-						serial.Status.Data = statusMap
-						serial.Status.Unlock()
-						logger.Info("HeaterInteraction: Successfully deactivated Follower (%s).", followerLongKey)
-					}
+				// The command processor has already updated the status cache from the response.
+				if _, err := serial.ParseStatus(responseJSON); err == nil {
+					logger.Info("HeaterInteraction: Successfully deactivated Follower (%s).", followerLongKey)
 				}
 			}
 		}
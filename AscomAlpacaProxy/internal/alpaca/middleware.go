@@ -6,6 +6,7 @@ import (
 	"strings"
 	"sv241pro-alpaca-proxy/internal/config"
 	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
 	"sync/atomic"
 )
 
@@ -19,6 +20,7 @@ var (
 func Handler(fn http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		logger.Debug("HTTP Request: %s %s", r.Method, r.URL.Path)
+		serial.NoteClientActivity()
 		if err := r.ParseForm(); err != nil {
 			logger.Warn("Error parsing form for request %s %s: %v", r.Method, r.URL.Path, err)
 		}
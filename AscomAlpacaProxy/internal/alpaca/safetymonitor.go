@@ -0,0 +1,170 @@
+package alpaca
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync/atomic"
+	"time"
+)
+
+// SafetyStatus is the result of evaluating the SafetyMonitor criteria.
+type SafetyStatus struct {
+	IsSafe    bool                        `json:"isSafe"`
+	Reasons   []string                    `json:"reasons"` // Why the state is unsafe (empty when safe)
+	CheckedAt time.Time                   `json:"checkedAt"`
+	Criteria  *config.SafetyMonitorConfig `json:"criteria"`
+}
+
+// safetyCheckInterval is how often MonitorSafety evaluates the criteria to log transitions.
+const safetyCheckInterval = 5 * time.Second
+
+// safetyMonitorConnected is the Connected state the Alpaca client set. Unlike the other
+// devices, the SafetyMonitor can be connected while the SV241 is not: it then reports unsafe.
+var safetyMonitorConnected atomic.Bool
+
+// EvaluateSafety checks the configured SafetyMonitor criteria against the current proxy data.
+// It has no side effects, so every client (Alpaca, INDI, Modbus, API) may call it as often as it likes.
+func EvaluateSafety() SafetyStatus {
+	criteria := config.Get().SafetyMonitor
+	if criteria == nil {
+		criteria = config.DefaultSafetyMonitorConfig()
+	}
+	status := SafetyStatus{
+		Reasons:   []string{},
+		CheckedAt: time.Now(),
+		Criteria:  criteria,
+	}
+
+	if criteria.RequireSerialConnection && !serial.IsConnected() {
+		status.Reasons = append(status.Reasons, "SV241 is not connected")
+	}
+
+	snapshot := serial.Conditions.Load()
+	data := snapshot.Data
+	updatedAt := snapshot.UpdatedAt
+	voltage, hasVoltage := data.Value("v")
+	ambient, hasAmbient := data.Value("t_amb")
+	dewPoint, hasDewPoint := data.Value("d")
+	_, hasLensTemp := data.Value("t_lens")
+
+	if criteria.MaxDataAgeSeconds > 0 {
+		maxAge := time.Duration(criteria.MaxDataAgeSeconds) * time.Second
+		if updatedAt.IsZero() {
+			status.Reasons = append(status.Reasons, "No sensor data received yet")
+		} else if age := time.Since(updatedAt); age > maxAge {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("Sensor data is stale (%.0fs old, limit %ds)", age.Seconds(), criteria.MaxDataAgeSeconds))
+		}
+	}
+
+	if criteria.MinInputVoltage > 0 || criteria.MaxInputVoltage > 0 {
+		if !hasVoltage {
+			status.Reasons = append(status.Reasons, "Input voltage not available")
+		} else {
+			if criteria.MinInputVoltage > 0 && voltage < criteria.MinInputVoltage {
+				status.Reasons = append(status.Reasons, fmt.Sprintf("Input voltage %.2fV is below %.2fV", voltage, criteria.MinInputVoltage))
+			}
+			if criteria.MaxInputVoltage > 0 && voltage > criteria.MaxInputVoltage {
+				status.Reasons = append(status.Reasons, fmt.Sprintf("Input voltage %.2fV is above %.2fV", voltage, criteria.MaxInputVoltage))
+			}
+		}
+	}
+
+	if criteria.MinDewPointSpread > 0 {
+		if !hasAmbient || !hasDewPoint {
+			status.Reasons = append(status.Reasons, "Ambient temperature or dew point not available")
+		} else if spread := ambient - dewPoint; spread < criteria.MinDewPointSpread {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("Dew point spread %.1f°C is below %.1f°C", spread, criteria.MinDewPointSpread))
+		}
+	}
+
+	// The firmware reports null if the lens sensor is missing.
+	if criteria.RequireLensSensor && !hasLensTemp {
+		status.Reasons = append(status.Reasons, "Lens temperature sensor not present")
+	}
+
+	status.IsSafe = len(status.Reasons) == 0
+	return status
+}
+
+// MonitorSafety evaluates the criteria periodically and logs the state transitions, so users
+// can see in the log why a session was stopped, independent of which clients poll how often.
+func MonitorSafety() {
+	lastSafe := true
+	ticker := time.NewTicker(safetyCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		status := EvaluateSafety()
+		if status.IsSafe == lastSafe {
+			continue
+		}
+		if status.IsSafe {
+			logger.Info("SafetyMonitor: Conditions are SAFE again.")
+		} else {
+			logger.Warn("SafetyMonitor: Conditions became UNSAFE: %s", strings.Join(status.Reasons, "; "))
+		}
+		lastSafe = status.IsSafe
+	}
+}
+
+// --- SafetyMonitor Handlers ---
+
+// HandleSafetyMonitorConnected always accepts a connection, even while the SV241 is not
+// connected: that is exactly when IsSafe has to report unsafe to the client.
+func (a *API) HandleSafetyMonitorConnected(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		connectedStr, ok := GetFormValueIgnoreCase(r, "Connected")
+		if !ok {
+			ErrorResponse(w, r, http.StatusOK, 0x400, "Missing Connected parameter for PUT request")
+			return
+		}
+		connected, err := strconv.ParseBool(connectedStr)
+		if err != nil {
+			ErrorResponse(w, r, http.StatusOK, 0x400, fmt.Sprintf("Invalid value for Connected: '%s'", connectedStr))
+			return
+		}
+		if connected && !serial.IsConnected() {
+			logger.Warn("SafetyMonitor: Client connected while the SV241 is not connected; reporting unsafe.")
+		}
+		safetyMonitorConnected.Store(connected)
+		EmptyResponse(w, r)
+		return
+	}
+	BoolResponse(w, r, safetyMonitorConnected.Load())
+}
+
+func (a *API) HandleSafetyMonitorIsSafe(w http.ResponseWriter, r *http.Request) {
+	BoolResponse(w, r, EvaluateSafety().IsSafe)
+}
+
+func (a *API) HandleSafetyMonitorSupportedActions(w http.ResponseWriter, r *http.Request) {
+	StringListResponse(w, r, []string{"getunsafereasons"})
+}
+
+func (a *API) HandleSafetyMonitorAction(w http.ResponseWriter, r *http.Request) {
+	action, ok := GetFormValueIgnoreCase(r, "Action")
+	if !ok {
+		ErrorResponse(w, r, http.StatusOK, 0x400, "Missing Action parameter")
+		return
+	}
+
+	if strings.ToLower(action) == "getunsafereasons" {
+		// Return the reasons as a JSON array string, so clients can parse them easily.
+		reasons, _ := json.Marshal(EvaluateSafety().Reasons)
+		StringResponse(w, r, string(reasons))
+		return
+	}
+
+	ErrorResponse(w, r, http.StatusOK, 0x400, fmt.Sprintf("Action '%s' is not supported.", action))
+}
+
+// HandleGetSafetyStatus returns the current SafetyMonitor evaluation for the web UI and scripts.
+func HandleGetSafetyStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EvaluateSafety())
+}
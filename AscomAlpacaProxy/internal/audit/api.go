@@ -0,0 +1,103 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/database"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+const (
+	defaultQueryLimit = 500
+	maxQueryLimit     = 10000
+)
+
+// Entry is an audit log entry as returned by the API.
+type Entry struct {
+	ID        int64  `json:"id"`
+	Timestamp int64  `json:"timestamp"` // Unix milliseconds
+	Source    string `json:"source"`
+	Client    string `json:"client,omitempty"`
+	Action    string `json:"action"`
+	Command   string `json:"command,omitempty"`
+	Response  string `json:"response,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// HandleQuery returns audit log entries, newest first.
+// Filters: start/end (Unix seconds), source, action (prefix), q (text search), limit.
+// With format=csv the entries are returned as a CSV download.
+func HandleQuery(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := database.AuditFilter{
+		Source: q.Get("source"),
+		Action: q.Get("action"),
+		Search: q.Get("q"),
+		Limit:  defaultQueryLimit,
+	}
+
+	for _, p := range []struct {
+		name   string
+		target *int64
+	}{{"start", &filter.Start}, {"end", &filter.End}} {
+		if v := q.Get(p.name); v != "" {
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				http.Error(w, "Invalid timestamp", http.StatusBadRequest)
+				return
+			}
+			*p.target = ts * 1000
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		filter.Limit = min(limit, maxQueryLimit)
+	}
+	if q.Get("format") == "csv" && q.Get("limit") == "" {
+		filter.Limit = maxQueryLimit
+	}
+
+	records, err := database.QueryAudit(filter)
+	if err != nil {
+		logger.Error("Audit: Query failed: %v", err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if q.Get("format") == "csv" {
+		writeCSV(w, records)
+		return
+	}
+
+	result := make([]Entry, 0, len(records))
+	for _, rec := range records {
+		result = append(result, Entry(rec))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+func writeCSV(w http.ResponseWriter, records []database.AuditRecord) {
+	filename := fmt.Sprintf("audit_%s.csv", time.Now().Format("2006-01-02"))
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"timestamp", "source", "client", "action", "command", "response", "error"})
+	for _, rec := range records {
+		writer.Write([]string{
+			time.UnixMilli(rec.Timestamp).Format("2006-01-02T15:04:05.000Z07:00"),
+			rec.Source, rec.Client, rec.Action, rec.Command, rec.Response, rec.Error,
+		})
+	}
+	writer.Flush()
+}
@@ -0,0 +1,169 @@
+// Package audit records every state-changing action (switching outputs, configuration
+// writes, backup restores, serial port release, ...) in the SQLite database, together with
+// who requested it and how the device responded.
+package audit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/database"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// Source kinds.
+const (
+	KindAlpaca   = "alpaca"   // ASCOM Alpaca client
+	KindWeb      = "web"      // Web interface (browser)
+	KindAPI      = "api"      // REST API client (scripts, API tokens)
+	KindINDI     = "indi"     // INDI client
+	KindModbus   = "modbus"   // Modbus TCP client
+	KindInternal = "internal" // Automation inside the proxy (Master Power, heater interactions, ...)
+)
+
+// Source describes who requested an action.
+type Source struct {
+	Kind   string
+	Client string // Client address and Alpaca ClientID, if known
+}
+
+// Internal is the source of actions triggered by the proxy itself.
+var Internal = Source{Kind: KindInternal}
+
+// maxFieldLength limits the stored command and response, e.g. for full firmware configurations.
+const maxFieldLength = 4096
+
+var (
+	entries   = make(chan database.AuditRecord, 256)
+	startOnce sync.Once
+)
+
+// Start starts writing audit entries to the database and pruning old entries.
+// The database must be initialized first.
+func Start() {
+	startOnce.Do(func() {
+		go writer()
+	})
+}
+
+// FromRequest determines the source of an HTTP request.
+func FromRequest(r *http.Request) Source {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	// The Alpaca middleware has already parsed the form of Alpaca requests.
+	clientID := ""
+	for key, values := range r.Form {
+		if strings.EqualFold(key, "ClientID") && len(values) > 0 {
+			clientID = values[0]
+			break
+		}
+	}
+
+	switch {
+	case clientID != "":
+		return Source{Kind: KindAlpaca, Client: fmt.Sprintf("ClientID %s (%s)", clientID, ip)}
+	case r.Header.Get("Authorization") != "" || r.Header.Get("X-API-Token") != "":
+		return Source{Kind: KindAPI, Client: ip}
+	case r.Header.Get("Sec-Fetch-Site") != "" || r.Header.Get("Origin") != "":
+		return Source{Kind: KindWeb, Client: ip}
+	case isAlpacaPath(r.URL.Path):
+		return Source{Kind: KindAlpaca, Client: ip}
+	}
+	return Source{Kind: KindAPI, Client: ip}
+}
+
+// String describes the source for logs and events, e.g. "web (192.168.1.20)".
+func (s Source) String() string {
+	if s.Client == "" {
+		return s.Kind
+	}
+	return fmt.Sprintf("%s (%s)", s.Kind, s.Client)
+}
+
+// FromConn returns the source of a protocol client (INDI, Modbus) connected from addr.
+func FromConn(kind string, addr net.Addr) Source {
+	return Source{Kind: kind, Client: addr.String()}
+}
+
+func isAlpacaPath(path string) bool {
+	for _, prefix := range []string{"/api/v1/switch/", "/api/v1/observingconditions/", "/api/v1/safetymonitor/", "/api/v1/covercalibrator/"} {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record adds an entry to the audit log. The entry is written in the background,
+// so a slow database never delays device commands.
+func Record(src Source, action, command, response string, err error) {
+	entry := database.AuditRecord{
+		Timestamp: time.Now().UnixMilli(),
+		Source:    src.Kind,
+		Client:    src.Client,
+		Action:    action,
+		Command:   truncate(command),
+		Response:  truncate(strings.TrimSpace(response)),
+	}
+	if entry.Source == "" {
+		entry.Source = KindInternal
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	select {
+	case entries <- entry:
+	default:
+		logger.Warn("Audit: Queue is full, dropping entry for '%s'.", action)
+	}
+}
+
+func truncate(s string) string {
+	if len(s) > maxFieldLength {
+		return s[:maxFieldLength] + "...(truncated)"
+	}
+	return s
+}
+
+// writer stores queued entries and prunes old entries once a day.
+func writer() {
+	prune()
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case entry := <-entries:
+			if err := database.InsertAudit(entry); err != nil {
+				logger.Error("Audit: Failed to write entry for '%s': %v", entry.Action, err)
+			}
+		case <-ticker.C:
+			prune()
+		}
+	}
+}
+
+func prune() {
+	days := config.Get().AuditRetentionDays
+	if days <= 0 {
+		days = config.DefaultAuditRetentionDays
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).UnixMilli()
+	removed, err := database.PruneOldAudit(cutoff)
+	if err != nil {
+		logger.Error("Audit: %v", err)
+		return
+	}
+	if removed > 0 {
+		logger.Info("Audit: Pruned %d entries older than %d days.", removed, days)
+	}
+}
@@ -0,0 +1,436 @@
+// Package auth provides optional authentication for the management API (admin password
+// with session cookies, scoped API tokens) and an IP allowlist.
+//
+// Credentials are stored in auth.json next to proxy_config.json, so they are never sent
+// to the web UI with the proxy settings and are not part of configuration backups.
+package auth
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+// Scope defines what an authenticated client may do. Higher scopes include the lower ones.
+type Scope int
+
+const (
+	ScopeNone Scope = iota
+	ScopeRead
+	ScopeControl
+	ScopeAdmin
+)
+
+// String returns the name used in the API and in auth.json.
+func (s Scope) String() string {
+	switch s {
+	case ScopeRead:
+		return "read"
+	case ScopeControl:
+		return "control"
+	case ScopeAdmin:
+		return "admin"
+	}
+	return "none"
+}
+
+// ParseScope converts a scope name into a Scope.
+func ParseScope(name string) (Scope, bool) {
+	switch strings.ToLower(name) {
+	case "read":
+		return ScopeRead, true
+	case "control":
+		return ScopeControl, true
+	case "admin":
+		return ScopeAdmin, true
+	}
+	return ScopeNone, false
+}
+
+// APIToken is a token for scripts. Only a hash of the token is stored.
+type APIToken struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	Hash      string     `json:"hash"`
+	CreatedAt time.Time  `json:"createdAt"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+}
+
+// Settings is the content of auth.json.
+type Settings struct {
+	Enabled         bool       `json:"enabled"`         // Require authentication for the management API
+	PasswordHash    string     `json:"passwordHash"`    // PBKDF2 hash of the admin password
+	Tokens          []APIToken `json:"tokens"`          // API tokens for scripts
+	IPAllowlist     []string   `json:"ipAllowlist"`     // Allowed client IPs/CIDRs (empty = all)
+	AllowlistAlpaca bool       `json:"allowlistAlpaca"` // Also apply the allowlist to Alpaca, INDI and Modbus clients
+	AllowedOrigins  []string   `json:"allowedOrigins"`  // Cross-origin dashboards allowed to use the API
+}
+
+const (
+	settingsFileName  = "auth.json"
+	sessionCookieName = "sv241_session"
+	sessionLifetime   = 12 * time.Hour
+	pbkdf2Iterations  = 210000
+	tokenPrefix       = "sv241_"
+	// lastUsedSaveInterval is how often the last use of the tokens is written to auth.json.
+	lastUsedSaveInterval = time.Minute
+)
+
+var (
+	settings     Settings
+	settingsFile string
+	mu           sync.RWMutex
+
+	sessions   = make(map[string]time.Time) // Session ID -> expiry
+	sessionsMu sync.Mutex
+
+	// The last use of the tokens is kept apart from settings, so token lookups only need
+	// a read lock. FlushLastUsed copies it to settings and auth.json.
+	lastUsed   = make(map[string]time.Time) // Token ID -> last use not yet in settings
+	lastUsedMu sync.Mutex
+)
+
+// Load reads auth.json. A missing file means authentication is disabled.
+func Load() error {
+	settingsFile = filepath.Join(config.GetConfigDir(), settingsFileName)
+	data, err := os.ReadFile(settingsFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read auth settings: %w", err)
+	}
+
+	var loaded Settings
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to unmarshal auth settings: %w", err)
+	}
+	if loaded.Enabled && loaded.PasswordHash == "" {
+		logger.Warn("Authentication is enabled, but no admin password is set. Disabling authentication.")
+		loaded.Enabled = false
+	}
+
+	mu.Lock()
+	settings = loaded
+	mu.Unlock()
+	if loaded.Enabled {
+		logger.Info("Authentication is enabled for the management API (%d API token(s)).", len(loaded.Tokens))
+	}
+	if len(loaded.IPAllowlist) > 0 {
+		logger.Info("IP allowlist active: %s", strings.Join(loaded.IPAllowlist, ", "))
+	}
+	return nil
+}
+
+// save writes auth.json. MUST be called with mu held.
+func save() error {
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal auth settings: %w", err)
+	}
+	if err := os.WriteFile(settingsFile, data, 0600); err != nil {
+		return fmt.Errorf("failed to write auth settings: %w", err)
+	}
+	return nil
+}
+
+// IsEnabled reports whether authentication is required for the management API.
+func IsEnabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return settings.Enabled
+}
+
+// --- Passwords and Tokens ---
+
+// hashPassword returns "pbkdf2-sha256$<iterations>$<salt>$<hash>".
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, 32)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func verifyPassword(password, encoded string) bool {
+	var iterations int
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	if _, err := fmt.Sscanf(parts[1], "%d", &iterations); err != nil || iterations <= 0 {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	expected, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// hashToken hashes an API token. Tokens are long random values, so a plain SHA-256 is sufficient.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomString(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// --- Sessions ---
+
+func createSession() string {
+	id := randomString(32)
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	now := time.Now()
+	for sid, expiry := range sessions {
+		if now.After(expiry) {
+			delete(sessions, sid)
+		}
+	}
+	sessions[id] = now.Add(sessionLifetime)
+	return id
+}
+
+// validSession checks a session ID and extends its lifetime.
+func validSession(id string) bool {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	expiry, ok := sessions[id]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiry) {
+		delete(sessions, id)
+		return false
+	}
+	sessions[id] = time.Now().Add(sessionLifetime)
+	return true
+}
+
+func deleteSession(id string) {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	delete(sessions, id)
+}
+
+// clearSessions logs out all web UI sessions, e.g. after a password change.
+func clearSessions() {
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessions = make(map[string]time.Time)
+}
+
+// authenticate returns the scope granted to the request by its session cookie or API token.
+func authenticate(r *http.Request) Scope {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil && validSession(cookie.Value) {
+		return ScopeAdmin
+	}
+
+	token := r.Header.Get("X-API-Token")
+	if authHeader := r.Header.Get("Authorization"); strings.HasPrefix(authHeader, "Bearer ") {
+		token = strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	if token == "" {
+		return ScopeNone
+	}
+	hash := hashToken(strings.TrimSpace(token))
+
+	mu.RLock()
+	var id string
+	scope := ScopeNone
+	for _, t := range settings.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hash)) == 1 {
+			id = t.ID
+			scope, _ = ParseScope(t.Scope)
+			break
+		}
+	}
+	mu.RUnlock()
+
+	if id != "" {
+		lastUsedMu.Lock()
+		lastUsed[id] = time.Now()
+		lastUsedMu.Unlock()
+	}
+	return scope
+}
+
+// tokenLastUsed returns the last use of a token, including a use not yet written to settings.
+// MUST be called with mu held.
+func tokenLastUsed(t APIToken) *time.Time {
+	lastUsedMu.Lock()
+	defer lastUsedMu.Unlock()
+	if used, ok := lastUsed[t.ID]; ok {
+		return &used
+	}
+	return t.LastUsed
+}
+
+// FlushLastUsed periodically writes the last use of the tokens to auth.json, so it is
+// still known after a restart. It blocks, so it should be started as a goroutine.
+func FlushLastUsed() {
+	ticker := time.NewTicker(lastUsedSaveInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		flushLastUsed()
+	}
+}
+
+func flushLastUsed() {
+	lastUsedMu.Lock()
+	pending := lastUsed
+	lastUsed = make(map[string]time.Time)
+	lastUsedMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i := range settings.Tokens {
+		if used, ok := pending[settings.Tokens[i].ID]; ok {
+			settings.Tokens[i].LastUsed = &used
+		}
+	}
+	if err := save(); err != nil {
+		logger.Warn("Auth: Failed to save the last use of the API tokens: %v", err)
+	}
+}
+
+// --- IP Allowlist ---
+
+// clientIP returns the IP address of the remote end of the request.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// ipAllowed checks an IP against the allowlist. Loopback addresses are always allowed,
+// so a wrong allowlist can always be fixed on the computer running the proxy.
+func ipAllowed(ip net.IP) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return matchAllowlist(settings.IPAllowlist, ip)
+}
+
+func matchAllowlist(allowlist []string, ip net.IP) bool {
+	if len(allowlist) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, entry := range allowlist {
+		if strings.Contains(entry, "/") {
+			if _, ipnet, err := net.ParseCIDR(entry); err == nil && ipnet.Contains(ip) {
+				return true
+			}
+		} else if allowed := net.ParseIP(entry); allowed != nil && allowed.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAlpacaClientAllowed reports whether a device protocol client (Alpaca, discovery,
+// INDI, Modbus) may connect. The allowlist only applies if AllowlistAlpaca is set.
+func IsAlpacaClientAllowed(ip net.IP) bool {
+	mu.RLock()
+	applies := settings.AllowlistAlpaca
+	mu.RUnlock()
+	return !applies || ipAllowed(ip)
+}
+
+// --- Middleware ---
+
+// Require protects a management API handler. It enforces the IP allowlist and,
+// if authentication is enabled, a session or an API token with at least the given scope.
+func Require(scope Scope, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if !ipAllowed(ip) {
+			logger.Warn("Auth: Rejected request to %s from %s (not in IP allowlist).", r.URL.Path, ip)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if !IsEnabled() {
+			next(w, r)
+			return
+		}
+		granted := authenticate(r)
+		if granted == ScopeNone {
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		if granted < scope {
+			logger.Warn("Auth: Rejected request to %s from %s (requires '%s' scope, has '%s').", r.URL.Path, ip, scope, granted)
+			http.Error(w, "Insufficient permissions", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// AllowlistOnly enforces the IP allowlist for the static web UI files, which must be
+// reachable without a session so the login screen can be shown.
+func AllowlistOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ipAllowed(clientIP(r)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// AlpacaAllowlist enforces the IP allowlist for Alpaca routes if AllowlistAlpaca is set.
+// Alpaca clients cannot authenticate, so no credentials are checked.
+func AlpacaAllowlist(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ip := clientIP(r); !IsAlpacaClientAllowed(ip) {
+			logger.Warn("Auth: Rejected Alpaca request to %s from %s (not in IP allowlist).", r.URL.Path, ip)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,435 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+const (
+	minPasswordLength = 8
+	// Failed logins per IP before further attempts are rejected for loginLockout.
+	maxFailedLogins = 5
+	loginLockout    = 5 * time.Minute
+)
+
+type loginAttempts struct {
+	failures int
+	lastFail time.Time
+}
+
+var (
+	failedLogins   = make(map[string]*loginAttempts)
+	failedLoginsMu sync.Mutex
+)
+
+// StatusResponse defines the structure for the GET /api/v1/auth/status response.
+type StatusResponse struct {
+	Enabled       bool   `json:"enabled"`
+	PasswordSet   bool   `json:"password_set"`
+	Authenticated bool   `json:"authenticated"`
+	Scope         string `json:"scope"`
+}
+
+// SettingsResponse defines the structure for the GET /api/v1/auth/settings response.
+// It never contains the password hash or token hashes.
+type SettingsResponse struct {
+	Enabled         bool        `json:"enabled"`
+	PasswordSet     bool        `json:"password_set"`
+	IPAllowlist     []string    `json:"ip_allowlist"`
+	AllowlistAlpaca bool        `json:"allowlist_alpaca"`
+	AllowedOrigins  []string    `json:"allowed_origins"`
+	Tokens          []TokenInfo `json:"tokens"`
+}
+
+// TokenInfo describes an API token without its secret.
+type TokenInfo struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Scope     string     `json:"scope"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used,omitempty"`
+}
+
+// HandleStatus reports whether authentication is enabled and whether the caller is logged in.
+// It is always reachable, so the web UI can decide whether to show the login screen.
+func HandleStatus(w http.ResponseWriter, r *http.Request) {
+	mu.RLock()
+	response := StatusResponse{
+		Enabled:     settings.Enabled,
+		PasswordSet: settings.PasswordHash != "",
+	}
+	mu.RUnlock()
+
+	if response.Enabled {
+		scope := authenticate(r)
+		response.Authenticated = scope != ScopeNone
+		response.Scope = scope.String()
+	} else {
+		response.Authenticated = true
+		response.Scope = ScopeAdmin.String()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleLogin checks the admin password and creates a session cookie.
+func HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ip := clientIP(r)
+	if !ipAllowed(ip) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	ipKey := ip.String()
+	if isLockedOut(ipKey) {
+		http.Error(w, "Too many failed login attempts. Please try again later.", http.StatusTooManyRequests)
+		return
+	}
+
+	defer r.Body.Close()
+	var payload struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	mu.RLock()
+	hash := settings.PasswordHash
+	mu.RUnlock()
+	if hash == "" || !verifyPassword(payload.Password, hash) {
+		recordFailedLogin(ipKey)
+		logger.Warn("Auth: Failed login attempt from %s.", ipKey)
+		http.Error(w, "Invalid password", http.StatusUnauthorized)
+		return
+	}
+	clearFailedLogins(ipKey)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    createSession(),
+		Path:     "/",
+		MaxAge:   int(sessionLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	logger.Info("Auth: Web UI login from %s.", ipKey)
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleLogout ends the current session.
+func HandleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		deleteSession(cookie.Value)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleSetPassword sets or changes the admin password. All existing sessions are logged out.
+// Must be protected with Require(ScopeAdmin, ...).
+func HandleSetPassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+	var payload struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+	if len(payload.Password) < minPasswordLength {
+		http.Error(w, "Password must be at least 8 characters long", http.StatusBadRequest)
+		return
+	}
+
+	hash, err := hashPassword(payload.Password)
+	if err != nil {
+		logger.Error("Auth: Failed to hash password: %v", err)
+		http.Error(w, "Failed to set password", http.StatusInternalServerError)
+		return
+	}
+
+	mu.Lock()
+	settings.PasswordHash = hash
+	err = save()
+	mu.Unlock()
+	audit.Record(audit.FromRequest(r), "security:password", "", "", err)
+	if err != nil {
+		logger.Error("Auth: %v", err)
+		http.Error(w, "Failed to save auth settings", http.StatusInternalServerError)
+		return
+	}
+
+	clearSessions()
+	logger.Info("Auth: Admin password changed.")
+	w.WriteHeader(http.StatusOK)
+}
+
+// HandleSettings returns (GET) or updates (POST) the auth settings.
+// Must be protected with Require(ScopeAdmin, ...).
+func HandleSettings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeSettings(w)
+	case http.MethodPost:
+		defer r.Body.Close()
+		var payload struct {
+			Enabled         bool     `json:"enabled"`
+			IPAllowlist     []string `json:"ip_allowlist"`
+			AllowlistAlpaca bool     `json:"allowlist_alpaca"`
+			AllowedOrigins  []string `json:"allowed_origins"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+
+		allowlist := make([]string, 0, len(payload.IPAllowlist))
+		for _, entry := range payload.IPAllowlist {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if !isValidAllowlistEntry(entry) {
+				http.Error(w, "Invalid IP allowlist entry: "+entry, http.StatusBadRequest)
+				return
+			}
+			allowlist = append(allowlist, entry)
+		}
+
+		origins := make([]string, 0, len(payload.AllowedOrigins))
+		for _, entry := range payload.AllowedOrigins {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			origin, err := parseOrigin(entry)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			origins = append(origins, origin)
+		}
+
+		// Make sure the client does not lock itself out.
+		if ip := clientIP(r); !matchAllowlist(allowlist, ip) {
+			http.Error(w, "The IP allowlist must include your own address ("+ip.String()+")", http.StatusBadRequest)
+			return
+		}
+
+		mu.Lock()
+		if payload.Enabled && settings.PasswordHash == "" {
+			mu.Unlock()
+			http.Error(w, "Set an admin password before enabling authentication", http.StatusBadRequest)
+			return
+		}
+		settings.Enabled = payload.Enabled
+		settings.IPAllowlist = allowlist
+		settings.AllowlistAlpaca = payload.AllowlistAlpaca
+		settings.AllowedOrigins = origins
+		err := save()
+		mu.Unlock()
+		audit.Record(audit.FromRequest(r), "security:settings", fmt.Sprintf("enabled=%t allowlist=%v allowlist_alpaca=%t allowed_origins=%v",
+			payload.Enabled, allowlist, payload.AllowlistAlpaca, origins), "", err)
+		if err != nil {
+			logger.Error("Auth: %v", err)
+			http.Error(w, "Failed to save auth settings", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("Auth: Settings updated (authentication enabled: %t, allowlist: %d entries, applies to Alpaca: %t, allowed origins: %d).",
+			payload.Enabled, len(allowlist), payload.AllowlistAlpaca, len(origins))
+		writeSettings(w)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleTokens lists (GET), creates (POST) or deletes (DELETE ?id=) API tokens.
+// The token secret is only returned once, in the response to POST.
+// Must be protected with Require(ScopeAdmin, ...).
+func HandleTokens(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mu.RLock()
+		tokens := tokenInfos()
+		mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(tokens)
+
+	case http.MethodPost:
+		defer r.Body.Close()
+		var payload struct {
+			Name  string `json:"name"`
+			Scope string `json:"scope"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+			return
+		}
+		scope, ok := ParseScope(payload.Scope)
+		if !ok {
+			http.Error(w, "Invalid scope (must be 'read', 'control' or 'admin')", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimSpace(payload.Name)
+		if name == "" {
+			name = "API Token"
+		}
+
+		secret := tokenPrefix + randomString(24)
+		token := APIToken{
+			ID:        randomString(6),
+			Name:      name,
+			Scope:     scope.String(),
+			Hash:      hashToken(secret),
+			CreatedAt: time.Now(),
+		}
+
+		mu.Lock()
+		settings.Tokens = append(settings.Tokens, token)
+		err := save()
+		mu.Unlock()
+		audit.Record(audit.FromRequest(r), "security:token_create", fmt.Sprintf("name=%s scope=%s", token.Name, token.Scope), "", err)
+		if err != nil {
+			logger.Error("Auth: %v", err)
+			http.Error(w, "Failed to save auth settings", http.StatusInternalServerError)
+			return
+		}
+
+		logger.Info("Auth: API token '%s' created with scope '%s'.", token.Name, token.Scope)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			TokenInfo
+			Token string `json:"token"`
+		}{
+			TokenInfo: TokenInfo{ID: token.ID, Name: token.Name, Scope: token.Scope, CreatedAt: token.CreatedAt},
+			Token:     secret,
+		})
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		mu.Lock()
+		found := false
+		for i, t := range settings.Tokens {
+			if t.ID == id {
+				settings.Tokens = append(settings.Tokens[:i], settings.Tokens[i+1:]...)
+				found = true
+				break
+			}
+		}
+		var err error
+		if found {
+			err = save()
+		}
+		mu.Unlock()
+		if !found {
+			http.Error(w, "Token not found", http.StatusNotFound)
+			return
+		}
+		audit.Record(audit.FromRequest(r), "security:token_revoke", "id="+id, "", err)
+		if err != nil {
+			logger.Error("Auth: %v", err)
+			http.Error(w, "Failed to save auth settings", http.StatusInternalServerError)
+			return
+		}
+		logger.Info("Auth: API token '%s' revoked.", id)
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeSettings(w http.ResponseWriter) {
+	mu.RLock()
+	response := SettingsResponse{
+		Enabled:         settings.Enabled,
+		PasswordSet:     settings.PasswordHash != "",
+		IPAllowlist:     append([]string{}, settings.IPAllowlist...),
+		AllowlistAlpaca: settings.AllowlistAlpaca,
+		AllowedOrigins:  append([]string{}, settings.AllowedOrigins...),
+		Tokens:          tokenInfos(),
+	}
+	mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// tokenInfos returns the tokens without their hashes. MUST be called with mu held.
+func tokenInfos() []TokenInfo {
+	infos := make([]TokenInfo, 0, len(settings.Tokens))
+	for _, t := range settings.Tokens {
+		infos = append(infos, TokenInfo{ID: t.ID, Name: t.Name, Scope: t.Scope, CreatedAt: t.CreatedAt, LastUsed: tokenLastUsed(t)})
+	}
+	return infos
+}
+
+func isValidAllowlistEntry(entry string) bool {
+	if strings.Contains(entry, "/") {
+		_, _, err := net.ParseCIDR(entry)
+		return err == nil
+	}
+	return net.ParseIP(entry) != nil
+}
+
+// --- Login rate limiting ---
+
+func isLockedOut(ip string) bool {
+	failedLoginsMu.Lock()
+	defer failedLoginsMu.Unlock()
+	attempts, ok := failedLogins[ip]
+	if !ok {
+		return false
+	}
+	if time.Since(attempts.lastFail) > loginLockout {
+		delete(failedLogins, ip)
+		return false
+	}
+	return attempts.failures >= maxFailedLogins
+}
+
+func recordFailedLogin(ip string) {
+	failedLoginsMu.Lock()
+	defer failedLoginsMu.Unlock()
+	attempts, ok := failedLogins[ip]
+	if !ok {
+		attempts = &loginAttempts{}
+		failedLogins[ip] = attempts
+	}
+	attempts.failures++
+	attempts.lastFail = time.Now()
+}
+
+func clearFailedLogins(ip string) {
+	failedLoginsMu.Lock()
+	defer failedLoginsMu.Unlock()
+	delete(failedLogins, ip)
+}
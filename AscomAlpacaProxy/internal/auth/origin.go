@@ -0,0 +1,143 @@
+package auth
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+)
+
+// Browsers attach an Origin header to cross-site requests and WebSocket handshakes.
+// A state-changing request or WebSocket is only accepted if it comes from the web UI
+// itself (same origin), from an allowlisted dashboard, or from a non-browser client
+// (no Origin header, e.g. Alpaca clients, curl or scripts).
+// A same-origin request only counts as such if the Host is a name or address of this
+// machine; otherwise a DNS rebinding name pointing at the proxy would pass as the web UI.
+
+// IsOriginAllowed reports whether the request's origin may use the API.
+func IsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Not sent by a browser for this request. Fall back to the Fetch Metadata header,
+		// which modern browsers send even where they omit Origin.
+		site := r.Header.Get("Sec-Fetch-Site")
+		return site == "" || site == "same-origin" || site == "none"
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false // Includes the opaque "null" origin of sandboxed pages and local files
+	}
+	if strings.EqualFold(u.Host, r.Host) && isLocalHost(r.Host) {
+		return true
+	}
+	return isAllowedCrossOrigin(origin)
+}
+
+// isLocalHost reports whether a Host header names this machine: localhost, an address of
+// a local interface, the configured listen addresses or the machine's hostname.
+func isLocalHost(hostport string) bool {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if host == "" {
+		return false
+	}
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() {
+			return true
+		}
+		addrs, err := net.InterfaceAddrs()
+		if err != nil {
+			return false
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	conf := config.Get()
+	if strings.EqualFold(host, conf.ListenAddress) || strings.EqualFold(host, conf.AdminListenAddress) {
+		return true
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		hostname = strings.ToLower(hostname)
+		if host == hostname || host == hostname+".local" {
+			return true
+		}
+	}
+	return false
+}
+
+// isAllowedCrossOrigin checks an origin against the allowlist of cross-origin dashboards.
+func isAllowedCrossOrigin(origin string) bool {
+	origin = normalizeOrigin(origin)
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, allowed := range settings.AllowedOrigins {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeOrigin lowercases an origin and removes a trailing slash.
+func normalizeOrigin(origin string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(origin)), "/")
+}
+
+// parseOrigin validates an allowlist entry such as "http://192.168.1.10:8123".
+func parseOrigin(entry string) (string, error) {
+	origin := normalizeOrigin(entry)
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+		return "", fmt.Errorf("invalid origin '%s' (expected e.g. http://host:port)", entry)
+	}
+	return origin, nil
+}
+
+// isStateChanging reports whether the HTTP method can change state.
+func isStateChanging(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// OriginProtection rejects cross-site state-changing requests (CSRF), so a web page opened
+// in the user's browser cannot switch outputs or change settings. Allowlisted dashboards
+// additionally get CORS headers, so they can read the API responses.
+func OriginProtection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		crossOriginAllowed := origin != "" && isAllowedCrossOrigin(origin)
+		if crossOriginAllowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Add("Vary", "Origin")
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE")
+				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Token")
+				w.Header().Set("Access-Control-Max-Age", "600")
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+
+		if isStateChanging(r.Method) && !IsOriginAllowed(r) {
+			logger.Warn("Auth: Rejected cross-site %s request to %s from origin '%s'.", r.Method, r.URL.Path, origin)
+			http.Error(w, "Cross-origin request rejected", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
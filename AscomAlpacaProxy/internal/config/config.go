@@ -3,8 +3,10 @@ package config
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sync"
 )
@@ -27,6 +29,143 @@ type ProxyConfig struct {
 	AlwaysShowLensTemp         bool   `json:"alwaysShowLensTemp"`         // Always expose Lens Temp switch regardless of PID mode
 	LensTempName               string `json:"lensTempName"`               // Custom name for Lens Temp sensor check
 	FirstRunComplete           bool   `json:"firstRunComplete"`           // Onboarding wizard completed
+	RestoreStateAfterRestart   bool   `json:"restoreStateAfterRestart"`   // Reapply the last commanded outputs after a device restart
+
+	AlpacaServerName     string                       `json:"alpacaServerName"`     // ServerName reported by the management API
+	AlpacaLocation       string                       `json:"alpacaLocation"`       // Location reported by the management API
+	AlpacaDeviceNames    map[string]string            `json:"alpacaDeviceNames"`    // Device type -> Alpaca DeviceName
+	AlpacaDeviceIdentity string                       `json:"alpacaDeviceIdentity"` // USB identity of the SV241 the UniqueIDs belong to
+	AlpacaUniqueIDs      map[string]map[string]string `json:"alpacaUniqueIds"`      // Device identity -> device type -> UniqueID
+
+	SafetyMonitor   *SafetyMonitorConfig   `json:"safetyMonitor"`   // Criteria for the SafetyMonitor device
+	CoverCalibrator *CoverCalibratorConfig `json:"coverCalibrator"` // Flat panel driven by a PWM or adjustable output
+	Polling         *PollingConfig         `json:"polling"`         // How often status and sensor values are read from the device
+
+	EnableIndiServer   bool `json:"enableIndiServer"`   // Run an INDI server for KStars/Ekos
+	IndiPort           int  `json:"indiPort"`           // TCP port of the INDI server
+	EnableModbusServer bool `json:"enableModbusServer"` // Run a Modbus TCP server for PLCs
+	ModbusPort         int  `json:"modbusPort"`         // TCP port of the Modbus server
+
+	SeparateAdminListener bool   `json:"separateAdminListener"` // Serve the web UI and management API on their own listener
+	AdminListenAddress    string `json:"adminListenAddress"`    // Listen address of the admin listener
+	AdminPort             int    `json:"adminPort"`             // TCP port of the admin listener
+	EnableTLS             bool   `json:"enableTls"`             // Serve the admin listener over HTTPS
+	TLSCertFile           string `json:"tlsCertFile"`           // User-supplied certificate (empty = self-signed)
+	TLSKeyFile            string `json:"tlsKeyFile"`            // User-supplied private key (empty = self-signed)
+
+	EnableDebugCommands bool `json:"enableDebugCommands"` // Allow raw firmware commands via /api/v1/command
+	AuditRetentionDays  int  `json:"auditRetentionDays"`  // Days to keep audit log entries
+}
+
+// SafetyMonitorConfig defines the criteria used to compute the SafetyMonitor's IsSafe value.
+// A value of 0 disables the respective numeric check.
+type SafetyMonitorConfig struct {
+	MinInputVoltage         float64 `json:"minInputVoltage"`         // Volts
+	MaxInputVoltage         float64 `json:"maxInputVoltage"`         // Volts
+	MinDewPointSpread       float64 `json:"minDewPointSpread"`       // °C between ambient temperature and dew point
+	RequireLensSensor       bool    `json:"requireLensSensor"`       // Lens temperature sensor must be present
+	RequireSerialConnection bool    `json:"requireSerialConnection"` // SV241 must be connected
+	MaxDataAgeSeconds       int     `json:"maxDataAgeSeconds"`       // Sensor data must be newer than this
+}
+
+// DefaultSafetyMonitorConfig returns the default SafetyMonitor criteria:
+// only the serial connection and data freshness are checked.
+func DefaultSafetyMonitorConfig() *SafetyMonitorConfig {
+	return &SafetyMonitorConfig{
+		RequireSerialConnection: true,
+		MaxDataAgeSeconds:       30,
+	}
+}
+
+// CoverCalibratorConfig maps the CoverCalibrator brightness onto a power output.
+// Output values are a PWM duty cycle in percent, or a voltage for "adj_conv".
+type CoverCalibratorConfig struct {
+	Enabled       bool      `json:"enabled"`       // Expose the CoverCalibrator device
+	Output        string    `json:"output"`        // "pwm1", "pwm2" or "adj_conv"
+	MaxBrightness int       `json:"maxBrightness"` // Brightness steps reported to clients
+	MinOutput     float64   `json:"minOutput"`     // Output value at brightness 1
+	MaxOutput     float64   `json:"maxOutput"`     // Output value at MaxBrightness
+	Gamma         float64   `json:"gamma"`         // Curve exponent (1 = linear), used if Curve is empty
+	Curve         []float64 `json:"curve"`         // Optional output values at evenly spaced brightness points
+}
+
+// DefaultCoverCalibratorConfig returns a disabled, linear calibrator on PWM1.
+func DefaultCoverCalibratorConfig() *CoverCalibratorConfig {
+	return &CoverCalibratorConfig{
+		Output:        "pwm1",
+		MaxBrightness: 100,
+		MinOutput:     1,
+		MaxOutput:     100,
+		Gamma:         1,
+	}
+}
+
+// PollingConfig sets how often the status and the sensor values are read from the device.
+// The active intervals apply while Alpaca clients or live viewers use the proxy.
+type PollingConfig struct {
+	StatusActiveMs      int `json:"statusActiveMs"`      // Status interval while clients are active
+	StatusIdleMs        int `json:"statusIdleMs"`        // Status interval otherwise
+	SensorsActiveMs     int `json:"sensorsActiveMs"`     // Sensor interval while clients are active
+	SensorsIdleMs       int `json:"sensorsIdleMs"`       // Sensor interval otherwise
+	ActiveWindowSeconds int `json:"activeWindowSeconds"` // Clients count as active this long after their last request
+}
+
+// DefaultPollingConfig returns the default polling intervals.
+func DefaultPollingConfig() *PollingConfig {
+	return &PollingConfig{
+		StatusActiveMs:      1000,
+		StatusIdleMs:        10000,
+		SensorsActiveMs:     2000,
+		SensorsIdleMs:       10000,
+		ActiveWindowSeconds: 30,
+	}
+}
+
+// Standard ports of the optional protocol servers.
+const (
+	DefaultIndiPort   = 7624
+	DefaultModbusPort = 502
+)
+
+// DefaultAuditRetentionDays is how long audit log entries are kept by default.
+const DefaultAuditRetentionDays = 90
+
+// Defaults of the separate admin listener.
+const (
+	DefaultAdminListenAddress = "127.0.0.1"
+	DefaultAdminPort          = 32242
+)
+
+// IsCoverCalibratorOutput reports whether the output can drive a flat panel.
+func IsCoverCalibratorOutput(output string) bool {
+	return output == "pwm1" || output == "pwm2" || output == "adj_conv"
+}
+
+// CoverCalibratorOutputLimit returns the highest value of a flat panel output: the PWM duty
+// cycle in percent, or the voltage of the adjustable output.
+func CoverCalibratorOutputLimit(output string) float64 {
+	if output == "adj_conv" {
+		return 15
+	}
+	return 100
+}
+
+// ValidateCoverCalibrator checks the output and that the output values fit the output type,
+// so a range meant for a PWM duty cycle is not silently clamped to the maximum voltage.
+func ValidateCoverCalibrator(cc *CoverCalibratorConfig) error {
+	if !IsCoverCalibratorOutput(cc.Output) {
+		return fmt.Errorf("invalid CoverCalibrator output '%s'", cc.Output)
+	}
+	limit := CoverCalibratorOutputLimit(cc.Output)
+	if cc.MinOutput < 0 || cc.MaxOutput > limit || cc.MinOutput > cc.MaxOutput {
+		return fmt.Errorf("CoverCalibrator output range %g-%g does not fit 0-%g for %s", cc.MinOutput, cc.MaxOutput, limit, cc.Output)
+	}
+	for _, value := range cc.Curve {
+		if value < 0 || value > limit {
+			return fmt.Errorf("CoverCalibrator curve value %g does not fit 0-%g for %s", value, limit, cc.Output)
+		}
+	}
+	return nil
 }
 
 // CombinedConfig defines the structure for a full backup file.
@@ -51,6 +190,10 @@ type PowerStartupStates struct {
 // SwitchMapMutex protects concurrent access to SwitchIDMap and ShortSwitchKeyByID.
 var SwitchMapMutex sync.RWMutex
 
+// switchNamesMutex protects SwitchNames, which is changed by the Alpaca SetSwitchName
+// method and the settings page while Alpaca, INDI and the telemetry export read it.
+var switchNamesMutex sync.RWMutex
+
 // Sensor switch keys - these are read-only sensors at fixed IDs 0, 1, 2
 // Sensor switch keys - these are read-only sensors at fixed IDs 0, 1, 2
 const (
@@ -119,6 +262,57 @@ func GetShortSwitchKeyByIDEntry(id int) (string, bool) {
 	return val, ok
 }
 
+// GetSwitchIDByKey returns the switch ID for an internal switch name (e.g. "dc1") in a thread-safe manner.
+func GetSwitchIDByKey(key string) (int, bool) {
+	SwitchMapMutex.RLock()
+	defer SwitchMapMutex.RUnlock()
+	for id, name := range SwitchIDMap {
+		if name == key {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// GetSwitchNames returns a copy of the custom switch names.
+func GetSwitchNames() map[string]string {
+	conf := Get()
+	switchNamesMutex.RLock()
+	defer switchNamesMutex.RUnlock()
+	names := make(map[string]string, len(conf.SwitchNames))
+	for key, name := range conf.SwitchNames {
+		names[key] = name
+	}
+	return names
+}
+
+// GetSwitchName returns the custom name of a switch, or "" if it has none.
+func GetSwitchName(key string) string {
+	conf := Get()
+	switchNamesMutex.RLock()
+	defer switchNamesMutex.RUnlock()
+	return conf.SwitchNames[key]
+}
+
+// SetSwitchName sets the custom name of a switch.
+func SetSwitchName(key, name string) {
+	conf := Get()
+	switchNamesMutex.Lock()
+	defer switchNamesMutex.Unlock()
+	if conf.SwitchNames == nil {
+		conf.SwitchNames = make(map[string]string)
+	}
+	conf.SwitchNames[key] = name
+}
+
+// SetSwitchNames replaces all custom switch names.
+func SetSwitchNames(names map[string]string) {
+	conf := Get()
+	switchNamesMutex.Lock()
+	defer switchNamesMutex.Unlock()
+	conf.SwitchNames = names
+}
+
 // init sets up the path to the configuration file.
 func init() {
 	configDir, err := os.UserConfigDir()
@@ -156,11 +350,19 @@ func Load() error {
 				HistoryRetentionNights: 10,   // Default to 10 nights
 				TelemetryInterval:      10,   // Default to 10 seconds
 				EnableNotifications:    true, // Default to notifications enabled
-
+				SafetyMonitor:          DefaultSafetyMonitorConfig(),
+				CoverCalibrator:        DefaultCoverCalibratorConfig(),
+				Polling:                DefaultPollingConfig(),
+				IndiPort:               DefaultIndiPort,
+				ModbusPort:             DefaultModbusPort,
+				AdminListenAddress:     DefaultAdminListenAddress,
+				AdminPort:              DefaultAdminPort,
+				AuditRetentionDays:     DefaultAuditRetentionDays,
 			}
 			for _, internalName := range SwitchIDMap {
 				proxyConfig.SwitchNames[internalName] = internalName
 			}
+			applyIdentityDefaults(proxyConfig)
 			// Attempt to save the initial default config
 			return Save() // File not found is not an error, just means defaults apply
 		}
@@ -212,8 +414,35 @@ func Load() error {
 	if proxyConfig.HistoryRetentionNights == 0 {
 		proxyConfig.HistoryRetentionNights = 10
 	}
+	if proxyConfig.SafetyMonitor == nil {
+		proxyConfig.SafetyMonitor = DefaultSafetyMonitorConfig()
+	}
+	if proxyConfig.CoverCalibrator == nil {
+		proxyConfig.CoverCalibrator = DefaultCoverCalibratorConfig()
+	}
+	if proxyConfig.Polling == nil {
+		proxyConfig.Polling = DefaultPollingConfig()
+	}
+	if proxyConfig.IndiPort == 0 {
+		proxyConfig.IndiPort = DefaultIndiPort
+	}
+	if proxyConfig.ModbusPort == 0 {
+		proxyConfig.ModbusPort = DefaultModbusPort
+	}
+	if proxyConfig.AdminListenAddress == "" {
+		proxyConfig.AdminListenAddress = DefaultAdminListenAddress
+	}
+	if proxyConfig.AdminPort == 0 {
+		proxyConfig.AdminPort = DefaultAdminPort
+	}
+	if proxyConfig.AuditRetentionDays <= 0 {
+		proxyConfig.AuditRetentionDays = DefaultAuditRetentionDays
+	}
 	// Note: TelemetryInterval=0 is valid (means disabled), so no auto-default here
 
+	// Alpaca identity: generate persistent UniqueIDs if missing.
+	identityChanged := applyIdentityDefaults(proxyConfig)
+
 	// Wenn das Feld in einer alten Konfigurationsdatei fehlt, setzen wir es auf true,
 	// um das bisherige Verhalten beizubehalten.
 	if !proxyConfig.AutoDetectPort && proxyConfig.SerialPortName == "" {
@@ -223,6 +452,13 @@ func Load() error {
 	// Apply the loaded log level immediately.
 	logger.SetLevelFromString(proxyConfig.LogLevel)
 	logger.Info("Loaded proxy config from '%s'", proxyConfigFile)
+
+	// Save right away, so clients see the same UniqueIDs even if the proxy is closed before the next save.
+	if identityChanged {
+		if err := Save(); err != nil {
+			logger.Warn("Failed to save initialized Alpaca identity settings: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -232,7 +468,11 @@ func Save() error {
 		return fmt.Errorf("cannot save nil config")
 	}
 	logger.Debug("Attempting to save proxy config to file: %s", proxyConfigFile)
+	identityMutex.Lock()
+	switchNamesMutex.RLock()
 	data, err := json.MarshalIndent(proxyConfig, "", "  ")
+	switchNamesMutex.RUnlock()
+	identityMutex.Unlock()
 	if err != nil {
 		logger.Error("saveProxyConfig: failed to marshal proxy config: %v", err)
 		return fmt.Errorf("failed to marshal proxy config: %w", err)
@@ -246,6 +486,12 @@ func Save() error {
 	return nil
 }
 
+// GetConfigDir returns the directory that contains proxy_config.json.
+// Other files that belong to the configuration (e.g. credentials) are stored next to it.
+func GetConfigDir() string {
+	return filepath.Dir(proxyConfigFile)
+}
+
 // Get returns a pointer to the singleton ProxyConfig instance.
 func Get() *ProxyConfig {
 	if proxyConfig == nil {
@@ -259,13 +505,33 @@ func Get() *ProxyConfig {
 }
 
 // GetSetupURL builds the full URL for the web setup page based on the current config.
+// If the admin listener is separate, the setup page is only served there.
 func GetSetupURL() string {
-	conf := Get()
-	host := conf.ListenAddress
-	if host == "0.0.0.0" || host == "" {
+	host, port := GetAdminAddress()
+	if host == "0.0.0.0" || host == "::" || host == "" {
 		host = "127.0.0.1"
 	}
-	return fmt.Sprintf("http://%s:%d/setup", host, conf.NetworkPort)
+	scheme := "http"
+	if IsAdminTLSEnabled() {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/setup", scheme, net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// IsAdminTLSEnabled reports whether the admin listener uses HTTPS. TLS requires the separate
+// admin listener, so the Alpaca routes stay plain HTTP for clients that do not support TLS.
+func IsAdminTLSEnabled() bool {
+	conf := Get()
+	return conf.SeparateAdminListener && conf.EnableTLS
+}
+
+// GetAdminAddress returns the listen address and port serving the web UI and management API.
+func GetAdminAddress() (string, int) {
+	conf := Get()
+	if conf.SeparateAdminListener {
+		return conf.AdminListenAddress, conf.AdminPort
+	}
+	return conf.ListenAddress, conf.NetworkPort
 }
 
 // GetSetupURLFromFile reads the configuration file directly to build the setup URL.
@@ -283,8 +549,12 @@ func GetSetupURLFromFile() string {
 	}
 
 	var config struct {
-		NetworkPort   int    `json:"networkPort"`
-		ListenAddress string `json:"listenAddress"`
+		NetworkPort           int    `json:"networkPort"`
+		ListenAddress         string `json:"listenAddress"`
+		SeparateAdminListener bool   `json:"separateAdminListener"`
+		AdminListenAddress    string `json:"adminListenAddress"`
+		AdminPort             int    `json:"adminPort"`
+		EnableTLS             bool   `json:"enableTls"`
 	}
 	if err := json.Unmarshal(file, &config); err != nil {
 		// JSON is corrupt, use failsafe defaults.
@@ -293,13 +563,24 @@ func GetSetupURLFromFile() string {
 
 	host := config.ListenAddress
 	port := config.NetworkPort
+	scheme := "http"
+	if config.SeparateAdminListener {
+		host = config.AdminListenAddress
+		port = config.AdminPort
+		if port == 0 {
+			port = DefaultAdminPort
+		}
+		if config.EnableTLS {
+			scheme = "https"
+		}
+	}
 
-	if host == "0.0.0.0" || host == "" {
+	if host == "0.0.0.0" || host == "::" || host == "" {
 		host = defaultHost
 	}
 	if port == 0 {
 		port = defaultPort
 	}
 
-	return fmt.Sprintf("http://%s:%d/setup", host, port)
+	return fmt.Sprintf("%s://%s/setup", scheme, net.JoinHostPort(host, strconv.Itoa(port)))
 }
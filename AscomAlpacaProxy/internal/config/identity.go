@@ -0,0 +1,186 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"sv241pro-alpaca-proxy/internal/logger"
+
+	"github.com/google/uuid"
+)
+
+// Alpaca device type keys used for UniqueIDs and device names.
+const (
+	DeviceTypeSwitch              = "switch"
+	DeviceTypeObservingConditions = "observingconditions"
+	DeviceTypeSafetyMonitor       = "safetymonitor"
+	DeviceTypeCoverCalibrator     = "covercalibrator"
+)
+
+// Defaults for the Alpaca management description and device names.
+const (
+	DefaultAlpacaServerName = "SV241 Alpaca Proxy"
+	DefaultAlpacaLocation   = "My Observatory"
+)
+
+// maxAlpacaDeviceNameLength is the maximum length of a DeviceName in characters.
+const maxAlpacaDeviceNameLength = 64
+
+// DefaultAlpacaDeviceNames maps each Alpaca device type to its default DeviceName.
+var DefaultAlpacaDeviceNames = map[string]string{
+	DeviceTypeSwitch:              "SV241 Power Switch",
+	DeviceTypeObservingConditions: "SV241 Environment",
+	DeviceTypeSafetyMonitor:       "SV241 Safety Monitor",
+	DeviceTypeCoverCalibrator:     "SV241 Flat Panel",
+}
+
+// identityMutex protects AlpacaUniqueIDs and AlpacaDeviceIdentity, which are
+// written by the serial manager and read by the management API, and AlpacaDeviceNames,
+// which is replaced by the settings page while the Alpaca handlers read it.
+var identityMutex sync.Mutex
+
+// applyIdentityDefaults fills in missing Alpaca identity fields and makes sure
+// every known device type has a UniqueID for the current device identity.
+// It returns true if anything was changed and the config should be saved.
+func applyIdentityDefaults(c *ProxyConfig) bool {
+	changed := false
+	if c.AlpacaServerName == "" {
+		c.AlpacaServerName = DefaultAlpacaServerName
+		changed = true
+	}
+	if c.AlpacaLocation == "" {
+		c.AlpacaLocation = DefaultAlpacaLocation
+		changed = true
+	}
+	if c.AlpacaDeviceNames == nil {
+		c.AlpacaDeviceNames = make(map[string]string)
+	}
+	for deviceType, name := range DefaultAlpacaDeviceNames {
+		if c.AlpacaDeviceNames[deviceType] == "" {
+			c.AlpacaDeviceNames[deviceType] = name
+			changed = true
+		}
+	}
+	if c.AlpacaUniqueIDs == nil {
+		c.AlpacaUniqueIDs = make(map[string]map[string]string)
+	}
+	for deviceType := range DefaultAlpacaDeviceNames {
+		if _, created := ensureUniqueID(c, c.AlpacaDeviceIdentity, deviceType); created {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// ensureUniqueID returns the UniqueID for a device type under the given device identity,
+// generating a new random UUID if none exists yet. MUST be called with identityMutex held
+// (or before the config is shared).
+func ensureUniqueID(c *ProxyConfig, identity, deviceType string) (string, bool) {
+	ids, ok := c.AlpacaUniqueIDs[identity]
+	if !ok {
+		ids = make(map[string]string)
+		c.AlpacaUniqueIDs[identity] = ids
+	}
+	if id, ok := ids[deviceType]; ok && id != "" {
+		return id, false
+	}
+	id := uuid.NewString()
+	ids[deviceType] = id
+	logger.Info("Generated new Alpaca UniqueID for %s: %s", deviceType, id)
+	return id, true
+}
+
+// GetAlpacaUniqueID returns the persistent UniqueID for the given Alpaca device type.
+// The IDs are generated and saved when the config is loaded and when a device is bound,
+// so reading them never writes the config.
+func GetAlpacaUniqueID(deviceType string) string {
+	conf := Get()
+	identityMutex.Lock()
+	defer identityMutex.Unlock()
+	return conf.AlpacaUniqueIDs[conf.AlpacaDeviceIdentity][deviceType]
+}
+
+// GetAlpacaDeviceName returns the configured DeviceName for the given Alpaca device type.
+func GetAlpacaDeviceName(deviceType string) string {
+	conf := Get()
+	identityMutex.Lock()
+	name := conf.AlpacaDeviceNames[deviceType]
+	identityMutex.Unlock()
+	if name != "" {
+		return name
+	}
+	return DefaultAlpacaDeviceNames[deviceType]
+}
+
+// SetAlpacaDeviceNames updates the DeviceNames of the given device types. Names are trimmed;
+// if a device type is unknown or a name is empty or too long, nothing is changed.
+// The map is replaced rather than changed, so readers never see it half-written.
+func SetAlpacaDeviceNames(names map[string]string) error {
+	trimmed := make(map[string]string, len(names))
+	for deviceType, name := range names {
+		if _, ok := DefaultAlpacaDeviceNames[deviceType]; !ok {
+			return fmt.Errorf("unknown Alpaca device type '%s'", deviceType)
+		}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("the device name of '%s' must not be empty", deviceType)
+		}
+		if utf8.RuneCountInString(name) > maxAlpacaDeviceNameLength {
+			return fmt.Errorf("the device name of '%s' is longer than %d characters", deviceType, maxAlpacaDeviceNameLength)
+		}
+		trimmed[deviceType] = name
+	}
+
+	conf := Get()
+	identityMutex.Lock()
+	defer identityMutex.Unlock()
+	updated := make(map[string]string, len(conf.AlpacaDeviceNames)+len(trimmed))
+	for deviceType, name := range conf.AlpacaDeviceNames {
+		updated[deviceType] = name
+	}
+	for deviceType, name := range trimmed {
+		updated[deviceType] = name
+	}
+	conf.AlpacaDeviceNames = updated
+	return nil
+}
+
+// BindDeviceIdentity associates the Alpaca UniqueIDs with the detected SV241 unit.
+// The first identity seen by an installation adopts the IDs that were already handed
+// out, so existing client profiles keep working. A different unit gets its own set of
+// IDs, and switching back to a previously seen unit restores that unit's IDs.
+func BindDeviceIdentity(identity string) {
+	if identity == "" {
+		return
+	}
+	conf := Get()
+
+	identityMutex.Lock()
+	previous := conf.AlpacaDeviceIdentity
+	if previous == identity {
+		identityMutex.Unlock()
+		return
+	}
+	if previous == "" {
+		if ids, ok := conf.AlpacaUniqueIDs[""]; ok {
+			if _, exists := conf.AlpacaUniqueIDs[identity]; !exists {
+				conf.AlpacaUniqueIDs[identity] = ids
+			}
+			delete(conf.AlpacaUniqueIDs, "")
+		}
+		logger.Info("Alpaca UniqueIDs bound to device '%s'.", identity)
+	} else {
+		logger.Info("Detected a different SV241 device ('%s', previously '%s'). Using its own Alpaca UniqueIDs.", identity, previous)
+	}
+	conf.AlpacaDeviceIdentity = identity
+	for deviceType := range DefaultAlpacaDeviceNames {
+		ensureUniqueID(conf, identity, deviceType)
+	}
+	identityMutex.Unlock()
+
+	if err := Save(); err != nil {
+		logger.Warn("Failed to save Alpaca device identity: %v", err)
+	}
+}
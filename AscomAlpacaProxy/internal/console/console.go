@@ -0,0 +1,273 @@
+// Package console implements the debug console: admins send raw JSON commands to the SV241
+// through the serial command queue and see the responses together with the lines the device
+// prints on its own. The proxy keeps the serial port, so clients are not interrupted.
+package console
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/auth"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/devicelog"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// maxScrollback is the number of entries kept in memory for new consoles.
+	maxScrollback = 1000
+	// maxMessageSize limits a message sent by a console (one or more command lines).
+	maxMessageSize = 64 * 1024
+	// commandTimeout is how long a console command may wait in the queue and for the device.
+	commandTimeout = 5 * time.Second
+)
+
+// Kinds of console entries.
+const (
+	KindCommand  = "command"  // Command sent from a console
+	KindResponse = "response" // Answer of the device to a command
+	KindError    = "error"    // Command rejected by the proxy or not answered
+	KindDevice   = "device"   // Line the device printed on its own
+)
+
+// Entry is one line of the console.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Text   string    `json:"text"`
+	Source string    `json:"source,omitempty"` // Who sent the command
+	Boot   bool      `json:"boot,omitempty"`   // The device line is a boot banner
+}
+
+// Hub maintains the set of consoles and sends them the new entries.
+type Hub struct {
+	clients    map[*Client]bool
+	broadcast  chan []byte
+	register   chan *Client
+	unregister chan *Client
+}
+
+// Client is a WebSocket connection of a console.
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	send   chan []byte
+	source audit.Source
+}
+
+var (
+	hub *Hub
+
+	scrollbackMu sync.Mutex
+	scrollback   []Entry
+)
+
+// NewHub creates and returns a new Hub instance.
+func NewHub() *Hub {
+	hub = &Hub{
+		clients:    make(map[*Client]bool),
+		broadcast:  make(chan []byte, 256),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+	}
+	return hub
+}
+
+// Run starts the Hub's message processing loop.
+func (h *Hub) Run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+			// New consoles first get the scrollback.
+			for _, entry := range Scrollback() {
+				if payload, err := json.Marshal(entry); err == nil {
+					h.send(client, payload)
+				}
+			}
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				close(client.send)
+			}
+		case payload := <-h.broadcast:
+			for client := range h.clients {
+				h.send(client, payload)
+			}
+		}
+	}
+}
+
+// send queues a payload for a client. A client that cannot keep up is disconnected.
+func (h *Hub) send(client *Client, payload []byte) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	select {
+	case client.send <- payload:
+	default:
+		close(client.send)
+		delete(h.clients, client)
+	}
+}
+
+// Scrollback returns the entries kept in memory, oldest first.
+func Scrollback() []Entry {
+	scrollbackMu.Lock()
+	defer scrollbackMu.Unlock()
+	return append([]Entry{}, scrollback...)
+}
+
+// add stores an entry and sends it to the consoles without blocking.
+func add(entry Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	scrollbackMu.Lock()
+	scrollback = append(scrollback, entry)
+	if len(scrollback) > maxScrollback {
+		scrollback = append([]Entry(nil), scrollback[len(scrollback)-maxScrollback:]...)
+	}
+	scrollbackMu.Unlock()
+
+	if hub == nil {
+		return
+	}
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	select {
+	case hub.broadcast <- payload:
+	default:
+	}
+}
+
+// DeviceOutput adds a line the device printed on its own. It is registered as a listener
+// of the device log.
+func DeviceOutput(line devicelog.Line) {
+	add(Entry{Time: line.Time, Kind: KindDevice, Text: line.Text, Boot: line.Boot})
+}
+
+// ServeWs connects a console. Every text message holds one or more JSON commands, one per
+// line; the entries are sent back as JSON, one Entry per message.
+// The console is only available while debug commands are enabled in the proxy settings.
+func ServeWs(w http.ResponseWriter, r *http.Request) {
+	if !config.Get().EnableDebugCommands {
+		http.Error(w, "The debug console is disabled. Enable debug commands in the proxy settings.", http.StatusForbidden)
+		return
+	}
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 8192,
+		CheckOrigin:     auth.IsOriginAllowed,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Console: Failed to upgrade to websocket: %v", err)
+		return
+	}
+	source := audit.FromRequest(r)
+	logger.Info("Console: Debug console opened by %s.", source)
+
+	// Large enough for the scrollback, which is sent right after connecting.
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, maxScrollback+64), source: source}
+	hub.register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// readPump reads the commands of the console and sends them one after the other.
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+		logger.Info("Console: Debug console of %s closed.", c.source)
+	}()
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); return nil })
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		for _, line := range strings.Split(string(message), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				c.execute(line)
+			}
+		}
+		// Waiting for the device must not count against the pong deadline.
+		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	}
+}
+
+// execute checks a command like the raw command endpoint and sends it through the queue.
+func (c *Client) execute(line string) {
+	add(Entry{Kind: KindCommand, Text: line, Source: c.source.String()})
+
+	if !config.Get().EnableDebugCommands {
+		add(Entry{Kind: KindError, Text: "Debug commands are disabled in the proxy settings."})
+		return
+	}
+	command, maintenance, err := serial.ValidateCommand([]byte(line))
+	if err != nil {
+		add(Entry{Kind: KindError, Text: fmt.Sprintf("Invalid command: %v", err)})
+		return
+	}
+	switch maintenance {
+	case serial.CommandReboot:
+		add(Entry{Kind: KindError, Text: "Use POST /api/v1/device/reboot for this command"})
+		return
+	case serial.CommandFactoryReset:
+		add(Entry{Kind: KindError, Text: "Use POST /api/v1/device/factory-reset for this command"})
+		return
+	}
+
+	logger.Info("Console: Sending command to device: %s", command)
+	resp, err := serial.SendAuditedCommand(c.source, "console", command, commandTimeout)
+	if err != nil {
+		add(Entry{Kind: KindError, Text: fmt.Sprintf("Failed to send command to device: %v", err)})
+		return
+	}
+	if maintenance == serial.CommandDrySensor {
+		add(Entry{Kind: KindResponse, Text: "Command sent. The device does not answer it."})
+		return
+	}
+	add(Entry{Kind: KindResponse, Text: strings.TrimSpace(resp)})
+}
+
+// writePump sends the queued entries and keeps the connection alive.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(50 * time.Second)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
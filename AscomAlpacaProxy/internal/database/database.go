@@ -2,13 +2,17 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 
 	_ "modernc.org/sqlite" // Pure Go SQLite driver
 )
 
 var (
 	db *sql.DB
+
+	errNotInitialized = errors.New("database is not initialized")
 )
 
 // Init opens the database and ensures the schema exists.
@@ -48,6 +52,18 @@ func Init(dbPath string) error {
 		adj_conv REAL
 	);
 	CREATE INDEX IF NOT EXISTS idx_timestamp ON telemetry_log(timestamp);
+
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		timestamp_ms INTEGER NOT NULL,
+		source TEXT NOT NULL,
+		client TEXT,
+		action TEXT NOT NULL,
+		command TEXT,
+		response TEXT,
+		error TEXT
+	);
+	CREATE INDEX IF NOT EXISTS idx_audit_timestamp ON audit_log(timestamp_ms);
 	`
 	if _, err := db.Exec(schema); err != nil {
 		return fmt.Errorf("failed to create schema: %w", err)
@@ -214,3 +230,107 @@ func PruneOldTelemetry(minNights int) error {
 
 	return nil
 }
+
+// AuditRecord is one entry of the audit log.
+type AuditRecord struct {
+	ID        int64
+	Timestamp int64 // Unix milliseconds
+	Source    string
+	Client    string
+	Action    string
+	Command   string
+	Response  string
+	Error     string
+}
+
+// AuditFilter restricts an audit log query. Empty fields match everything.
+type AuditFilter struct {
+	Start  int64  // Unix milliseconds
+	End    int64  // Unix milliseconds
+	Source string // Exact match
+	Action string // Prefix match
+	Search string // Substring of client, command or response
+	Limit  int
+}
+
+// InsertAudit writes an audit log entry.
+func InsertAudit(r AuditRecord) error {
+	if db == nil {
+		return errNotInitialized
+	}
+	query := `
+	INSERT INTO audit_log (timestamp_ms, source, client, action, command, response, error)
+	VALUES (?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, r.Timestamp, r.Source, r.Client, r.Action, r.Command, r.Response, r.Error)
+	return err
+}
+
+// QueryAudit returns audit log entries matching the filter, newest first.
+func QueryAudit(f AuditFilter) ([]AuditRecord, error) {
+	if db == nil {
+		return nil, errNotInitialized
+	}
+
+	var conditions []string
+	var args []interface{}
+	if f.Start > 0 {
+		conditions = append(conditions, "timestamp_ms >= ?")
+		args = append(args, f.Start)
+	}
+	if f.End > 0 {
+		conditions = append(conditions, "timestamp_ms <= ?")
+		args = append(args, f.End)
+	}
+	if f.Source != "" {
+		conditions = append(conditions, "source = ?")
+		args = append(args, f.Source)
+	}
+	if f.Action != "" {
+		conditions = append(conditions, "substr(action, 1, ?) = ?")
+		args = append(args, len(f.Action), f.Action)
+	}
+	if f.Search != "" {
+		conditions = append(conditions, "(instr(client, ?) > 0 OR instr(command, ?) > 0 OR instr(response, ?) > 0)")
+		args = append(args, f.Search, f.Search, f.Search)
+	}
+
+	query := `SELECT id, timestamp_ms, source, client, action, command, response, error FROM audit_log`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY timestamp_ms DESC, id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []AuditRecord
+	for rows.Next() {
+		var r AuditRecord
+		var client, command, response, errText sql.NullString
+		if err := rows.Scan(&r.ID, &r.Timestamp, &r.Source, &client, &r.Action, &command, &response, &errText); err != nil {
+			return nil, err
+		}
+		r.Client, r.Command, r.Response, r.Error = client.String, command.String, response.String, errText.String
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// PruneOldAudit deletes audit log entries older than the given Unix millisecond timestamp.
+func PruneOldAudit(before int64) (int64, error) {
+	if db == nil {
+		return 0, errNotInitialized
+	}
+	res, err := db.Exec(`DELETE FROM audit_log WHERE timestamp_ms < ?`, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune audit log: %w", err)
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,142 @@
+// Package devicelog keeps the lines the SV241 prints on its own, outside of command
+// responses (boot messages, sensor warnings, crash dumps). The lines are written to a
+// rolling log file, kept in memory for new viewers and streamed to WebSocket clients.
+package devicelog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+const (
+	// maxRecentLines is the number of lines kept in memory for new viewers.
+	maxRecentLines = 500
+	// maxFileSize is the size at which device.log is renamed to device.log.old.
+	maxFileSize = 1 << 20
+)
+
+// Line is one line printed by the device.
+type Line struct {
+	Time time.Time `json:"time"` // When the proxy read the line
+	Text string    `json:"text"`
+	Boot bool      `json:"boot,omitempty"` // The line is a boot banner, i.e. the device restarted
+}
+
+var (
+	mu       sync.Mutex
+	recent   []Line
+	file     *os.File
+	fileSize int64
+	fileErr  bool // Opening the file failed; don't retry (and log) on every line
+
+	listeners []func(Line)
+)
+
+// AddListener registers a function that receives every line, e.g. for the debug console.
+// It is called from the serial command loop and MUST NOT block.
+func AddListener(fn func(Line)) {
+	mu.Lock()
+	defer mu.Unlock()
+	listeners = append(listeners, fn)
+}
+
+// Append stores a line and sends it to the stream clients.
+// It never blocks on the clients, so it is safe to call from the serial command loop.
+func Append(line Line) {
+	mu.Lock()
+	recent = append(recent, line)
+	if len(recent) > maxRecentLines {
+		recent = append([]Line(nil), recent[len(recent)-maxRecentLines:]...)
+	}
+	writeLocked(line)
+	notify := listeners
+	mu.Unlock()
+
+	broadcast(line)
+	for _, fn := range notify {
+		fn(line)
+	}
+}
+
+// Recent returns the lines kept in memory, oldest first.
+func Recent() []Line {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]Line{}, recent...)
+}
+
+// GetFilePath returns the path of the device log file.
+func GetFilePath() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "SV241AlpacaProxy", "device.log")
+}
+
+// Close closes the log file.
+func Close() {
+	mu.Lock()
+	defer mu.Unlock()
+	if file != nil {
+		file.Close()
+		file = nil
+	}
+}
+
+// writeLocked appends a line to the log file, starting a new file when it is full.
+// It MUST be called with mu held.
+func writeLocked(line Line) {
+	if file == nil && !fileErr {
+		openLocked()
+	}
+	if file == nil {
+		return
+	}
+	if fileSize >= maxFileSize {
+		file.Close()
+		file = nil
+		path := GetFilePath()
+		os.Remove(path + ".old")
+		if err := os.Rename(path, path+".old"); err != nil {
+			logger.Warn("Device log: Failed to rotate log file: %v", err)
+		}
+		if openLocked(); file == nil {
+			return
+		}
+	}
+
+	marker := ""
+	if line.Boot {
+		marker = "[BOOT] "
+	}
+	n, err := fmt.Fprintf(file, "%s %s%s\n", line.Time.Format("2006/01/02 15:04:05.000"), marker, line.Text)
+	fileSize += int64(n)
+	if err != nil {
+		logger.Warn("Device log: Failed to write log file: %v", err)
+	}
+}
+
+// openLocked opens the log file for appending. It MUST be called with mu held.
+func openLocked() {
+	path := GetFilePath()
+	if path == "" {
+		fileErr = true
+		return
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		logger.Error("Device log: Could not open log file '%s': %v", path, err)
+		fileErr = true
+		return
+	}
+	fileSize = 0
+	if info, err := f.Stat(); err == nil {
+		fileSize = info.Size()
+	}
+	file = f
+}
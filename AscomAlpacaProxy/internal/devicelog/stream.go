@@ -0,0 +1,156 @@
+package devicelog
+
+import (
+	"encoding/json"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/auth"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hub maintains the set of stream clients and sends them the device output.
+type Hub struct {
+	clients    map[*Client]bool
+	broadcast  chan []byte
+	register   chan *Client
+	unregister chan *Client
+}
+
+// Client is a WebSocket connection receiving the device output.
+type Client struct {
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+}
+
+var hub *Hub
+
+// NewHub creates and returns a new Hub instance.
+func NewHub() *Hub {
+	hub = &Hub{
+		clients:    make(map[*Client]bool),
+		broadcast:  make(chan []byte, 256),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+	}
+	return hub
+}
+
+// Run starts the Hub's message processing loop.
+func (h *Hub) Run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+			// New viewers first get the lines printed before they connected.
+			for _, line := range Recent() {
+				if payload, err := json.Marshal(line); err == nil {
+					h.send(client, payload)
+				}
+			}
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				close(client.send)
+			}
+		case payload := <-h.broadcast:
+			for client := range h.clients {
+				h.send(client, payload)
+			}
+		}
+	}
+}
+
+// send queues a payload for a client. A client that cannot keep up is disconnected.
+func (h *Hub) send(client *Client, payload []byte) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	select {
+	case client.send <- payload:
+	default:
+		close(client.send)
+		delete(h.clients, client)
+	}
+}
+
+// broadcast hands a line to the hub without blocking. If the hub is busy, the line is
+// only missing from the stream; it is still in the file and in Recent.
+func broadcast(line Line) {
+	if hub == nil {
+		return
+	}
+	payload, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+	select {
+	case hub.broadcast <- payload:
+	default:
+	}
+}
+
+// ServeWs streams the device output to a WebSocket client, one JSON Line per message.
+func ServeWs(w http.ResponseWriter, r *http.Request) {
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 8192,
+		CheckOrigin:     auth.IsOriginAllowed,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Device log: Failed to upgrade to websocket: %v", err)
+		return
+	}
+	// Large enough for the lines kept in memory, which are sent right after connecting.
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, maxRecentLines+64)}
+	hub.register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// readPump only handles control messages and notices when the client disconnects.
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); return nil })
+	for {
+		if _, _, err := c.conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// writePump sends the queued lines and keeps the connection alive.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(50 * time.Second)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case payload, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,28 +1,241 @@
+// Package events is an in-process publish/subscribe bus for things that happen in the proxy
+// (connection changes, switch changes, configuration changes, ...). Every subscriber receives
+// every event it subscribed to, in publishing order, without blocking the publisher.
 package events
 
-import "sync"
+import (
+	"fmt"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
 
-// ComPortStatus represents the connection status of the COM port.
-type ComPortStatus bool
+// Type identifies the kind of an event.
+type Type string
 
 const (
-	// Connected indicates the COM port is connected.
-	Connected ComPortStatus = true
-	// Disconnected indicates the COM port is disconnected.
-	Disconnected ComPortStatus = false
+	TypeConnected      Type = "connected"       // The serial port to the SV241 was opened
+	TypeDisconnected   Type = "disconnected"    // The serial port was closed or lost
+	TypePortReleased   Type = "port_released"   // The port was released for external tools (e.g. the web flasher)
+	TypePortResumed    Type = "port_resumed"    // Auto-reconnect was resumed after a release
+	TypeSwitchChanged  Type = "switch_changed"  // An output reported a new state
+	TypeConfigChanged  Type = "config_changed"  // The proxy or firmware configuration was changed
+	TypeFirmwareSynced Type = "firmware_synced" // The switch map was rebuilt from the firmware configuration
+	TypeSensorFault    Type = "sensor_fault"    // A sensor stopped (or resumed) reporting values
+	TypeDeviceRebooted Type = "device_rebooted" // The SV241 printed a boot banner
+	TypeOutputsReset   Type = "outputs_reset"   // The outputs no longer match the last commands after a restart
 )
 
-var (
-	// ComPortStatusChan is a channel that broadcasts the connection status of the COM port.
-	// The serial manager will write to this channel, and other parts of the application (like systray) can listen to it.
-	ComPortStatusChan = make(chan ComPortStatus, 1)
+// Event is implemented by all event payloads.
+type Event interface {
+	Type() Type
+}
+
+// Connected is published when the serial port to the SV241 has been opened.
+type Connected struct {
+	Port string `json:"port"`
+}
+
+// Disconnected is published when the serial port has been closed or lost.
+type Disconnected struct {
+	Port string `json:"port"`
+}
 
-	// once is used to ensure the listener is only started once.
-	once sync.Once
+// PortReleased is published when the serial port is released for external access.
+type PortReleased struct {
+	Port string `json:"port,omitempty"` // Empty if the port was already closed
+}
+
+// PortResumed is published when auto-reconnect is allowed again.
+type PortResumed struct{}
+
+// SwitchChanged is published when the device reports a new state for an output,
+// regardless of who switched it.
+type SwitchChanged struct {
+	Key      string      `json:"key"`  // Firmware key, e.g. "d1"
+	Name     string      `json:"name"` // Proxy switch key, e.g. "dc1"
+	Value    interface{} `json:"value"`
+	Previous interface{} `json:"previous"`
+}
+
+// Configuration scopes of ConfigChanged.
+const (
+	ConfigScopeProxy    = "proxy"
+	ConfigScopeFirmware = "firmware"
 )
 
-// StartListener ensures that any component that needs to react to events can do so.
-// It is designed to be called multiple times safely, but the listener function will only be executed once.
-func StartListener(listener func()) {
-	once.Do(listener)
+// ConfigChanged is published after the proxy or firmware configuration has been written.
+type ConfigChanged struct {
+	Scope  string `json:"scope"`  // ConfigScopeProxy or ConfigScopeFirmware
+	Source string `json:"source"` // Who changed it, e.g. "web (192.168.1.20)"
+}
+
+// FirmwareSynced is published after the switch map has been rebuilt from the firmware configuration.
+type FirmwareSynced struct {
+	Switches int `json:"switches"` // Number of Alpaca switches
+}
+
+// SensorFault is published when a sensor stops reporting values, and again when it recovers.
+type SensorFault struct {
+	Sensor  string `json:"sensor"` // "INA219", "SHT40" or "DS18B20"
+	Cleared bool   `json:"cleared"`
+}
+
+// DeviceRebooted is published when the SV241 prints a boot banner while the port is open,
+// i.e. it restarted without the proxy closing the connection.
+type DeviceRebooted struct {
+	Reason string `json:"reason,omitempty"` // ESP32 reset reason, e.g. "POWERON_RESET", if printed
+	Banner string `json:"banner"`           // The line that was recognized
+}
+
+// OutputsReset is published when the outputs no longer match the values last commanded by
+// the clients after the device restarted (e.g. back to their startup states after a brown-out).
+type OutputsReset struct {
+	Trigger  string                 `json:"trigger"`  // How the restart was noticed, e.g. "boot banner"
+	Outputs  map[string]interface{} `json:"outputs"`  // Firmware key -> last commanded value
+	Restored bool                   `json:"restored"` // The proxy sent the commanded values again
+	Error    string                 `json:"error,omitempty"`
+}
+
+func (Connected) Type() Type      { return TypeConnected }
+func (Disconnected) Type() Type   { return TypeDisconnected }
+func (PortReleased) Type() Type   { return TypePortReleased }
+func (PortResumed) Type() Type    { return TypePortResumed }
+func (SwitchChanged) Type() Type  { return TypeSwitchChanged }
+func (ConfigChanged) Type() Type  { return TypeConfigChanged }
+func (FirmwareSynced) Type() Type { return TypeFirmwareSynced }
+func (SensorFault) Type() Type    { return TypeSensorFault }
+func (DeviceRebooted) Type() Type { return TypeDeviceRebooted }
+func (OutputsReset) Type() Type   { return TypeOutputsReset }
+
+// Message is an event as delivered to the subscribers.
+type Message struct {
+	Type  Type
+	Time  time.Time
+	Event Event
+}
+
+// maxQueueLength limits the backlog of a subscriber that stopped processing events.
+const maxQueueLength = 1000
+
+type subscriber struct {
+	name    string
+	handler func(Message)
+	types   map[Type]bool // Empty means all types
+
+	mu      sync.Mutex
+	queue   []Message
+	dropped int
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+var (
+	subscribers   = make(map[int]*subscriber)
+	subscribersMu sync.RWMutex
+	nextID        int
+)
+
+// Subscribe calls handler for every published event of the given types (all types if none
+// are given). Each subscriber has its own queue and goroutine, so a slow handler neither
+// delays the publisher nor other subscribers. The returned function ends the subscription.
+func Subscribe(name string, handler func(Message), types ...Type) (unsubscribe func()) {
+	s := &subscriber{
+		name:    name,
+		handler: handler,
+		types:   make(map[Type]bool),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	for _, t := range types {
+		s.types[t] = true
+	}
+
+	subscribersMu.Lock()
+	id := nextID
+	nextID++
+	subscribers[id] = s
+	subscribersMu.Unlock()
+
+	go s.run()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			subscribersMu.Lock()
+			delete(subscribers, id)
+			subscribersMu.Unlock()
+			close(s.done)
+		})
+	}
+}
+
+// Publish delivers an event to all subscribers. It never blocks, so it is safe to call
+// while holding locks (e.g. from the serial manager).
+func Publish(e Event) {
+	msg := Message{Type: e.Type(), Time: time.Now(), Event: e}
+
+	subscribersMu.RLock()
+	defer subscribersMu.RUnlock()
+	for _, s := range subscribers {
+		if len(s.types) == 0 || s.types[msg.Type] {
+			s.enqueue(msg)
+		}
+	}
+}
+
+func (s *subscriber) enqueue(msg Message) {
+	s.mu.Lock()
+	if len(s.queue) >= maxQueueLength {
+		// The subscriber is stuck. Drop the oldest event rather than growing without limit.
+		s.queue = s.queue[1:]
+		s.dropped++
+		if s.dropped == 1 || s.dropped%100 == 0 {
+			logger.Warn("Events: Subscriber '%s' is not keeping up, %d events dropped.", s.name, s.dropped)
+		}
+	}
+	s.queue = append(s.queue, msg)
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default: // Already signalled.
+	}
+}
+
+func (s *subscriber) run() {
+	for {
+		select {
+		case <-s.wake:
+		case <-s.done:
+			return
+		}
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			msg := s.queue[0]
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			s.deliver(msg)
+		}
+	}
+}
+
+// deliver calls the handler and keeps the subscription alive if it panics.
+func (s *subscriber) deliver(msg Message) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("Events: Subscriber '%s' failed on '%s' event: %v", s.name, msg.Type, r)
+		}
+	}()
+	s.handler(msg)
+}
+
+// String returns a short description of the event for logging.
+func (m Message) String() string {
+	return fmt.Sprintf("%s %+v", m.Type, m.Event)
 }
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+// confirmationLifetime is how long a confirmation token for a destructive command is valid.
+const confirmationLifetime = 30 * time.Second
+
+type pendingConfirmation struct {
+	action  string
+	expires time.Time
+}
+
+var (
+	confirmations   = make(map[string]pendingConfirmation)
+	confirmationsMu sync.Mutex
+)
+
+// DeviceCommandRequest is the optional body of the typed device command endpoints.
+type DeviceCommandRequest struct {
+	Confirm string `json:"confirm"` // Confirmation token of a destructive command
+}
+
+// ConfirmationResponse is returned (with 428 Precondition Required) when a destructive
+// command is requested without a valid confirmation token.
+type ConfirmationResponse struct {
+	Action            string `json:"action"`
+	ConfirmationToken string `json:"confirmation_token"`
+	ExpiresIn         int    `json:"expires_in"` // Seconds
+	Message           string `json:"message"`
+}
+
+// DeviceCommandResponse is returned after a command was sent to the device.
+type DeviceCommandResponse struct {
+	Success bool   `json:"success"`
+	Action  string `json:"action"`
+	Status  string `json:"status"` // Status message reported by the firmware
+}
+
+// newConfirmation creates a single-use token bound to the given action.
+func newConfirmation(action string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+
+	confirmationsMu.Lock()
+	defer confirmationsMu.Unlock()
+	now := time.Now()
+	for t, c := range confirmations {
+		if now.After(c.expires) {
+			delete(confirmations, t)
+		}
+	}
+	confirmations[token] = pendingConfirmation{action: action, expires: now.Add(confirmationLifetime)}
+	return token
+}
+
+// consumeConfirmation checks and invalidates a confirmation token.
+func consumeConfirmation(token, action string) bool {
+	confirmationsMu.Lock()
+	defer confirmationsMu.Unlock()
+	c, ok := confirmations[token]
+	if !ok {
+		return false
+	}
+	delete(confirmations, token)
+	return c.action == action && time.Now().Before(c.expires)
+}
+
+// HandleDeviceReboot restarts the SV241. Requires a confirmation token.
+func HandleDeviceReboot(w http.ResponseWriter, r *http.Request) {
+	handleDestructiveCommand(w, r, serial.CommandReboot, "The device will restart and all outputs will be reset to their startup states.")
+}
+
+// HandleDeviceFactoryReset restores the firmware defaults and restarts the SV241.
+// Requires a confirmation token.
+func HandleDeviceFactoryReset(w http.ResponseWriter, r *http.Request) {
+	handleDestructiveCommand(w, r, serial.CommandFactoryReset, "All device settings will be reset to factory defaults and the device will restart.")
+}
+
+// HandleDeviceDrySensor starts the drying cycle of the SHT40 humidity sensor. The firmware
+// does not answer this command, so it returns 202 Accepted once the command was sent.
+func HandleDeviceDrySensor(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	logger.Info("Device: Starting SHT40 drying cycle (requested via API).")
+	sendDrySensorCommand(w, r, "device:"+serial.CommandDrySensor)
+}
+
+// sendDrySensorCommand sends the drying command without waiting for a response.
+func sendDrySensorCommand(w http.ResponseWriter, r *http.Request, action string) {
+	if _, err := serial.SendAuditedCommand(audit.FromRequest(r), action, serial.MaintenanceCommand(serial.CommandDrySensor), 5*time.Second); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(DeviceCommandResponse{Success: true, Action: serial.CommandDrySensor, Status: "drying cycle started"})
+}
+
+// handleDestructiveCommand implements the two-step confirmation: a request without a token
+// returns a new token, a request with a valid token sends the command.
+func handleDestructiveCommand(w http.ResponseWriter, r *http.Request, action, message string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	var req DeviceCommandRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, "Invalid JSON format", http.StatusBadRequest)
+		return
+	}
+
+	if req.Confirm == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(ConfirmationResponse{
+			Action:            action,
+			ConfirmationToken: newConfirmation(action),
+			ExpiresIn:         int(confirmationLifetime.Seconds()),
+			Message:           message + " Repeat the request with this confirmation token to proceed.",
+		})
+		return
+	}
+	if !consumeConfirmation(req.Confirm, action) {
+		http.Error(w, "Invalid or expired confirmation token", http.StatusConflict)
+		return
+	}
+
+	logger.Info("Device: Sending confirmed '%s' command.", action)
+	sendMaintenanceCommand(w, r, action)
+}
+
+// sendMaintenanceCommand sends a {"command":...} to the device and returns the firmware status.
+func sendMaintenanceCommand(w http.ResponseWriter, r *http.Request, action string) {
+	resp, err := serial.SendAuditedCommand(audit.FromRequest(r), "device:"+action, serial.MaintenanceCommand(action), 5*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	var reply struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	json.Unmarshal([]byte(resp), &reply)
+	if reply.Error != "" {
+		http.Error(w, fmt.Sprintf("Device rejected the command: %s", reply.Error), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeviceCommandResponse{Success: true, Action: action, Status: reply.Status})
+}
+
+// HandleRawCommand passes a raw JSON command to the device. It is only available if debug
+// commands are enabled, and the command must be part of the firmware command set.
+// Destructive maintenance commands must use the typed endpoints.
+func HandleRawCommand(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !config.Get().EnableDebugCommands {
+		http.Error(w, "Raw commands are disabled. Enable debug commands in the proxy settings, or use the /api/v1/device endpoints.", http.StatusForbidden)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	command, maintenance, err := serial.ValidateCommand(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid command: %v", err), http.StatusBadRequest)
+		return
+	}
+	switch maintenance {
+	case serial.CommandReboot:
+		http.Error(w, "Use POST /api/v1/device/reboot for this command", http.StatusBadRequest)
+		return
+	case serial.CommandFactoryReset:
+		http.Error(w, "Use POST /api/v1/device/factory-reset for this command", http.StatusBadRequest)
+		return
+	case serial.CommandDrySensor:
+		logger.Info("Debug: Sending raw command to device: %s", command)
+		sendDrySensorCommand(w, r, "raw_command")
+		return
+	}
+
+	logger.Info("Debug: Sending raw command to device: %s", command)
+	resp, err := serial.SendAuditedCommand(audit.FromRequest(r), "raw_command", command, 5*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	// The device response is expected to be JSON, so we can just pass it through.
+	fmt.Fprint(w, resp)
+}
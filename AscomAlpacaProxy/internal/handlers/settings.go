@@ -5,18 +5,21 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sv241pro-alpaca-proxy/internal/audit"
 	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sv241pro-alpaca-proxy/internal/serial"
 )
 
 // SettingsResponse defines the structure for the GET /api/v1/settings response.
 type SettingsResponse struct {
-	ProxyConfig         *config.ProxyConfig `json:"proxy_config"`
-	AvailableIPs        []string            `json:"available_ips"`
-	ActiveSwitches      map[int]string      `json:"active_switches"`
-	SerialPortConnected bool                `json:"serial_port_connected"`
-	ReconnectPaused     bool                `json:"reconnect_paused"`
+	ProxyConfig         *config.ProxyConfig   `json:"proxy_config"`
+	AvailableIPs        []string              `json:"available_ips"`
+	ActiveSwitches      map[int]string        `json:"active_switches"`
+	SerialPortConnected bool                  `json:"serial_port_connected"`
+	ReconnectPaused     bool                  `json:"reconnect_paused"`
+	Connection          serial.ConnectionInfo `json:"connection"`
 }
 
 // HandleGetSettings provides the current proxy configuration and available IP addresses.
@@ -29,18 +32,30 @@ func HandleGetSettings(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	conn := serial.GetConnectionInfo()
 	response := SettingsResponse{
 		ProxyConfig:         conf,
 		AvailableIPs:        ips,
 		ActiveSwitches:      config.SwitchIDMap,
-		SerialPortConnected: serial.IsConnected(),
-		ReconnectPaused:     serial.IsReconnectPaused(),
+		SerialPortConnected: conn.Connected(),
+		ReconnectPaused:     conn.ReconnectPaused,
+		Connection:          conn,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// HandleGetConnection returns the state of the connection to the device.
+func HandleGetConnection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serial.GetConnectionInfo())
+}
+
 // HandlePostSettings updates the proxy configuration.
 func HandlePostSettings(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
@@ -59,6 +74,39 @@ func HandlePostSettings(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid Listen Address", http.StatusBadRequest)
 		return
 	}
+	if newConfig.SeparateAdminListener {
+		if newConfig.AdminPort <= 0 || newConfig.AdminPort > 65535 || newConfig.AdminPort == newConfig.NetworkPort {
+			http.Error(w, "Invalid Admin Port", http.StatusBadRequest)
+			return
+		}
+		if net.ParseIP(newConfig.AdminListenAddress) == nil {
+			http.Error(w, "Invalid Admin Listen Address", http.StatusBadRequest)
+			return
+		}
+	}
+	if (newConfig.TLSCertFile == "") != (newConfig.TLSKeyFile == "") {
+		http.Error(w, "TLS certificate and key file must be set together", http.StatusBadRequest)
+		return
+	}
+	if newConfig.EnableIndiServer && (newConfig.IndiPort <= 0 || newConfig.IndiPort > 65535 || newConfig.IndiPort == newConfig.NetworkPort) {
+		http.Error(w, "Invalid INDI Port", http.StatusBadRequest)
+		return
+	}
+	if newConfig.EnableModbusServer && (newConfig.ModbusPort <= 0 || newConfig.ModbusPort > 65535 || newConfig.ModbusPort == newConfig.NetworkPort) {
+		http.Error(w, "Invalid Modbus Port", http.StatusBadRequest)
+		return
+	}
+	if cc := newConfig.CoverCalibrator; cc != nil && cc.Enabled {
+		if err := config.ValidateCoverCalibrator(cc); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// The device names are applied right away, so this must stay the last check.
+	if err := config.SetAlpacaDeviceNames(newConfig.AlpacaDeviceNames); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	conf := config.Get()
 	// Check if serial port settings have changed to trigger a reconnect
@@ -70,25 +118,71 @@ func HandlePostSettings(w http.ResponseWriter, r *http.Request) {
 	conf.SerialPortName = newConfig.SerialPortName
 	conf.AutoDetectPort = newConfig.AutoDetectPort
 	conf.LogLevel = newConfig.LogLevel
-	conf.SwitchNames = newConfig.SwitchNames
+	config.SetSwitchNames(newConfig.SwitchNames)
 	conf.HeaterAutoEnableLeader = newConfig.HeaterAutoEnableLeader
 	conf.HistoryRetentionNights = newConfig.HistoryRetentionNights
 	conf.TelemetryInterval = newConfig.TelemetryInterval
 	conf.EnableAlpacaVoltageControl = newConfig.EnableAlpacaVoltageControl
 	conf.EnableMasterPower = newConfig.EnableMasterPower
+	conf.RestoreStateAfterRestart = newConfig.RestoreStateAfterRestart
 	conf.EnableNotifications = newConfig.EnableNotifications
 	conf.AlwaysShowLensTemp = newConfig.AlwaysShowLensTemp
 	conf.LensTempName = newConfig.LensTempName
 	conf.FirstRunComplete = newConfig.FirstRunComplete
+	if newConfig.AlpacaServerName != "" {
+		conf.AlpacaServerName = newConfig.AlpacaServerName
+	}
+	if newConfig.AlpacaLocation != "" {
+		conf.AlpacaLocation = newConfig.AlpacaLocation
+	}
+	if newConfig.SafetyMonitor != nil {
+		conf.SafetyMonitor = newConfig.SafetyMonitor
+	}
+	if newConfig.CoverCalibrator != nil {
+		if newConfig.CoverCalibrator.MaxBrightness <= 0 {
+			newConfig.CoverCalibrator.MaxBrightness = config.DefaultCoverCalibratorConfig().MaxBrightness
+		}
+		conf.CoverCalibrator = newConfig.CoverCalibrator
+	}
+	if newConfig.Polling != nil {
+		conf.Polling = newConfig.Polling
+	}
+	conf.EnableIndiServer = newConfig.EnableIndiServer
+	if newConfig.IndiPort > 0 {
+		conf.IndiPort = newConfig.IndiPort
+	}
+	conf.EnableModbusServer = newConfig.EnableModbusServer
+	if newConfig.ModbusPort > 0 {
+		conf.ModbusPort = newConfig.ModbusPort
+	}
+	conf.SeparateAdminListener = newConfig.SeparateAdminListener
+	if newConfig.AdminListenAddress != "" {
+		conf.AdminListenAddress = newConfig.AdminListenAddress
+	}
+	if newConfig.AdminPort > 0 {
+		conf.AdminPort = newConfig.AdminPort
+	}
+	conf.EnableTLS = newConfig.EnableTLS
+	conf.TLSCertFile = newConfig.TLSCertFile
+	conf.TLSKeyFile = newConfig.TLSKeyFile
+	conf.EnableDebugCommands = newConfig.EnableDebugCommands
+	if newConfig.AuditRetentionDays > 0 {
+		conf.AuditRetentionDays = newConfig.AuditRetentionDays
+	}
 
 	// Apply log level immediately
 	logger.SetLevelFromString(conf.LogLevel)
 
-	if err := config.Save(); err != nil {
+	err := config.Save()
+	settingsJSON, _ := json.Marshal(conf)
+	src := audit.FromRequest(r)
+	audit.Record(src, "proxy_settings", string(settingsJSON), "", err)
+	if err != nil {
 		logger.Error("Failed to save proxy config: %v", err)
 		http.Error(w, "Failed to save configuration", http.StatusInternalServerError)
 		return
 	}
+	events.Publish(events.ConfigChanged{Scope: events.ConfigScopeProxy, Source: src.String()})
 
 	// Trigger reconnect in a goroutine if needed
 	if portChanged {
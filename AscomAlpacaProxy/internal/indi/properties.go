@@ -0,0 +1,257 @@
+package indi
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/alpaca"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+const (
+	// deviceName is the INDI device name. It must stay stable, as Ekos profiles refer to it.
+	deviceName = "SV241 Pro"
+	// driverInterface announces the device as WEATHER_INTERFACE (128) | AUX_INTERFACE (32768).
+	driverInterface = "32896"
+)
+
+// Property names used by the SV241 device.
+const (
+	propConnection        = "CONNECTION"
+	propDriverInfo        = "DRIVER_INFO"
+	propPowerOutputs      = "POWER_OUTPUTS"
+	propHeaterPower       = "HEATER_POWER"
+	propAdjVoltage        = "ADJ_VOLTAGE"
+	propWeatherParameters = "WEATHER_PARAMETERS"
+	propWeatherStatus     = "WEATHER_STATUS"
+	propPowerSensors      = "POWER_SENSORS"
+)
+
+// property is a snapshot of one INDI property vector, built from the proxy caches.
+type property struct {
+	kind    string // "Switch", "Number", "Text" or "Light"
+	name    string
+	label   string
+	group   string
+	perm    string // "ro" or "rw" (not used for lights)
+	rule    string // Switches only: "OneOfMany" or "AnyOfMany"
+	state   string // "Idle", "Ok", "Busy" or "Alert"
+	members []member
+}
+
+// member is a single element of a property vector.
+type member struct {
+	name  string
+	label string
+	value string
+	// Numbers only
+	format string
+	min    string
+	max    string
+	step   string
+}
+
+// buildProperties creates the current set of properties from the status and conditions caches.
+func buildProperties(appVersion string) []property {
+	connected := serial.IsConnected()
+	connState := "Ok"
+	if !connected {
+		connState = "Alert"
+	}
+
+	props := []property{
+		{
+			kind: "Switch", name: propConnection, label: "Connection", group: "Main Control",
+			perm: "rw", rule: "OneOfMany", state: connState,
+			members: []member{
+				{name: "CONNECT", label: "Connect", value: onOff(connected)},
+				{name: "DISCONNECT", label: "Disconnect", value: onOff(!connected)},
+			},
+		},
+		{
+			kind: "Text", name: propDriverInfo, label: "Driver Info", group: "General Info",
+			perm: "ro", state: "Idle",
+			members: []member{
+				{name: "DRIVER_NAME", label: "Name", value: "SV241 Pro Proxy"},
+				{name: "DRIVER_EXEC", label: "Exec", value: "sv241pro-alpaca-proxy"},
+				{name: "DRIVER_VERSION", label: "Version", value: appVersion},
+				{name: "DRIVER_INTERFACE", label: "Interface", value: driverInterface},
+			},
+		},
+	}
+
+	// Power outputs, in the same order as the Alpaca Switch device.
+	outputs := property{
+		kind: "Switch", name: propPowerOutputs, label: "Power Outputs", group: "Power",
+		perm: "rw", rule: "AnyOfMany", state: connState,
+	}
+	names := config.GetSwitchNames()
+	hasHeater := map[string]bool{}
+	hasAdj := false
+	for _, entry := range outputSwitches() {
+		isOn, _ := alpaca.GetSwitchState(entry.id)
+		label := names[entry.key]
+		if label == "" {
+			label = entry.key
+		}
+		outputs.members = append(outputs.members, member{name: strings.ToUpper(entry.key), label: label, value: onOff(isOn)})
+		if entry.key == "pwm1" || entry.key == "pwm2" {
+			hasHeater[entry.key] = true
+		}
+		if entry.key == "adj_conv" {
+			hasAdj = true
+		}
+	}
+	if len(outputs.members) > 0 {
+		props = append(props, outputs)
+	}
+
+	// Heater duty cycles. The duty cycle lives in the conditions cache, Status only has the enabled state.
+	if len(hasHeater) > 0 {
+		heaters := property{
+			kind: "Number", name: propHeaterPower, label: "Dew Heaters", group: "Power",
+			perm: "rw", state: connState,
+		}
+		for _, key := range []string{"pwm1", "pwm2"} {
+			if !hasHeater[key] {
+				continue
+			}
+			duty, _ := conditionValue(key)
+			heaters.members = append(heaters.members, member{
+				name: strings.ToUpper(key), label: labelFor(names, key) + " (%)", value: formatNumber(duty),
+				format: "%3.0f", min: "0", max: "100", step: "1",
+			})
+		}
+		props = append(props, heaters)
+	}
+
+	// Adjustable voltage. Writable only if voltage control is enabled, as for Alpaca.
+	if hasAdj {
+		perm := "ro"
+		if config.Get().EnableAlpacaVoltageControl {
+			perm = "rw"
+		}
+		voltage, _ := statusValue("adj")
+		props = append(props, property{
+			kind: "Number", name: propAdjVoltage, label: "Adjustable Voltage", group: "Power",
+			perm: perm, state: connState,
+			members: []member{{
+				name: "VOLTAGE", label: labelFor(names, "adj_conv") + " (V)", value: formatNumber(voltage),
+				format: "%5.2f", min: "0", max: "15", step: "0.1",
+			}},
+		})
+	}
+
+	// Weather vector from the environment sensor, using the standard INDI weather names.
+	weather := property{
+		kind: "Number", name: propWeatherParameters, label: "Parameters", group: "Parameters",
+		perm: "ro", state: connState,
+	}
+	for _, p := range []struct{ name, label, key, format, min, max string }{
+		{"WEATHER_TEMPERATURE", "Temperature (C)", "t_amb", "%4.1f", "-50", "80"},
+		{"WEATHER_HUMIDITY", "Humidity (%)", "h_amb", "%4.1f", "0", "100"},
+		{"WEATHER_DEW_POINT", "Dew Point (C)", "d", "%4.1f", "-50", "80"},
+	} {
+		val, ok := conditionValue(p.key)
+		if !ok {
+			weather.state = "Alert"
+		}
+		weather.members = append(weather.members, member{name: p.name, label: p.label, value: formatNumber(val), format: p.format, min: p.min, max: p.max, step: "0"})
+	}
+	props = append(props, weather)
+
+	// Weather status follows the SafetyMonitor criteria.
+	safety := alpaca.EvaluateSafety()
+	safetyState := "Ok"
+	if !safety.IsSafe {
+		safetyState = "Alert"
+	}
+	props = append(props, property{
+		kind: "Light", name: propWeatherStatus, label: "Status", group: "Parameters", state: safetyState,
+		members: []member{{name: "WEATHER_SAFETY", label: "Safety Monitor", value: safetyState}},
+	})
+
+	sensors := property{
+		kind: "Number", name: propPowerSensors, label: "Power Sensors", group: "Sensors",
+		perm: "ro", state: connState,
+	}
+	for _, p := range []struct{ name, label, key, format, max string }{
+		{"SENSOR_VOLTAGE", "Input Voltage (V)", "v", "%5.2f", "30"},
+		{"SENSOR_CURRENT", "Total Current (A)", "i", "%5.2f", "20"},
+		{"SENSOR_POWER", "Total Power (W)", "p", "%6.2f", "500"},
+		{"LENS_TEMPERATURE", "Lens Temperature (C)", "t_lens", "%4.1f", "80"},
+	} {
+		val, _ := conditionValue(p.key)
+		if p.key == "i" {
+			val = val / 1000.0 // Current is in mA
+		}
+		min := "0"
+		if p.key == "t_lens" {
+			min = "-50"
+		}
+		sensors.members = append(sensors.members, member{name: p.name, label: p.label, value: formatNumber(val), format: p.format, min: min, max: p.max, step: "0"})
+	}
+	props = append(props, sensors)
+
+	return props
+}
+
+type outputSwitch struct {
+	id  int
+	key string
+}
+
+// outputSwitches returns all non-sensor switches of the Alpaca switch map, sorted by ID.
+func outputSwitches() []outputSwitch {
+	config.SwitchMapMutex.RLock()
+	defer config.SwitchMapMutex.RUnlock()
+	var result []outputSwitch
+	for id, key := range config.SwitchIDMap {
+		if config.IsSensorSwitch(key) {
+			continue
+		}
+		result = append(result, outputSwitch{id: id, key: key})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].id < result[j].id })
+	return result
+}
+
+// findSwitchID returns the Alpaca switch ID of an output key (e.g. "dc1").
+func findSwitchID(key string) (int, bool) {
+	id, ok := config.GetSwitchIDByKey(key)
+	if !ok || config.IsSensorSwitch(key) {
+		return 0, false
+	}
+	return id, true
+}
+
+func conditionValue(key string) (float64, bool) {
+	return serial.Conditions.Load().Data.Value(key)
+}
+
+func statusValue(key string) (float64, bool) {
+	val, ok := serial.Status.Load().Data.Output(key)
+	if !ok {
+		return 0, false
+	}
+	return val.Float()
+}
+
+func labelFor(names map[string]string, key string) string {
+	if name := names[key]; name != "" {
+		return name
+	}
+	return key
+}
+
+func onOff(on bool) string {
+	if on {
+		return "On"
+	}
+	return "Off"
+}
+
+func formatNumber(val float64) string {
+	return strconv.FormatFloat(val, 'f', 2, 64)
+}
@@ -0,0 +1,393 @@
+// Package indi implements a minimal INDI XML server, so INDI clients such as KStars/Ekos
+// can control the SV241 without an Alpaca bridge. It uses the same switch logic and
+// caches as the Alpaca devices.
+package indi
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/alpaca"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/auth"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"sync"
+	"time"
+)
+
+const (
+	// updateInterval controls how often changed property values are pushed to clients.
+	updateInterval = 2 * time.Second
+	writeTimeout   = 5 * time.Second
+)
+
+// Start runs the INDI server if it is enabled in the proxy config.
+// It blocks while the server is running, so it should be started as a goroutine.
+func Start(appVersion string) {
+	conf := config.Get()
+	if !conf.EnableIndiServer {
+		return
+	}
+
+	addr := net.JoinHostPort(conf.ListenAddress, strconv.Itoa(conf.IndiPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("INDI: Could not listen on '%s': %v", addr, err)
+		logger.Info("HINT: This may be caused by a running indiserver. Choose a different INDI port in the proxy settings.")
+		return
+	}
+	defer listener.Close()
+	logger.Info("INDI server started on %s (device '%s').", addr, deviceName)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Warn("INDI: Failed to accept connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !auth.IsAlpacaClientAllowed(tcpAddr.IP) {
+			logger.Warn("INDI: Rejected connection from %s (not in IP allowlist).", tcpAddr)
+			conn.Close()
+			continue
+		}
+		c := &client{
+			conn:       conn,
+			appVersion: appVersion,
+			lastSent:   make(map[string]string),
+		}
+		go c.serve()
+	}
+}
+
+// client holds the state of one INDI client connection.
+type client struct {
+	conn       net.Conn
+	appVersion string
+	writeMu    sync.Mutex
+
+	mu       sync.Mutex
+	defined  bool              // Client asked for the properties
+	defNames string            // Names of the defined properties, to detect switch map changes
+	lastSent map[string]string // Property name -> last sent values (without timestamp)
+}
+
+// inboundMessage is a top-level element sent by a client, e.g. getProperties or newSwitchVector.
+type inboundMessage struct {
+	XMLName xml.Name
+	Device  string          `xml:"device,attr"`
+	Name    string          `xml:"name,attr"`
+	Members []inboundMember `xml:",any"`
+}
+
+type inboundMember struct {
+	XMLName xml.Name
+	Name    string `xml:"name,attr"`
+	Value   string `xml:",chardata"`
+}
+
+func (c *client) serve() {
+	remote := c.conn.RemoteAddr().String()
+	logger.Info("INDI: Client connected from %s.", remote)
+	done := make(chan struct{})
+	defer func() {
+		close(done)
+		c.conn.Close()
+		logger.Info("INDI: Client %s disconnected.", remote)
+	}()
+	go c.pushUpdates(done)
+
+	dec := xml.NewDecoder(c.conn)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err != io.EOF {
+				logger.Debug("INDI: Read error from %s: %v", remote, err)
+			}
+			return
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		var msg inboundMessage
+		if err := dec.DecodeElement(&msg, &start); err != nil {
+			logger.Debug("INDI: Invalid message from %s: %v", remote, err)
+			return
+		}
+		c.handle(msg)
+	}
+}
+
+func (c *client) handle(msg inboundMessage) {
+	if msg.Device != "" && msg.Device != deviceName {
+		return
+	}
+	switch msg.XMLName.Local {
+	case "getProperties":
+		c.sendDefinitions(msg.Name)
+	case "newSwitchVector":
+		c.handleNewSwitch(msg)
+	case "newNumberVector":
+		c.handleNewNumber(msg)
+	default:
+		// enableBLOB, newTextVector, ... are not used by this device.
+		logger.Debug("INDI: Ignoring '%s' for property '%s'.", msg.XMLName.Local, msg.Name)
+	}
+}
+
+func (c *client) handleNewSwitch(msg inboundMessage) {
+	switch msg.Name {
+	case propConnection:
+		// The serial connection is managed automatically, so we just report its state.
+		for _, m := range msg.Members {
+			if m.Name == "CONNECT" && strings.TrimSpace(m.Value) == "On" && !serial.IsConnected() {
+				c.sendMessage("SV241 device not connected. Please check the USB connection.")
+			}
+		}
+		c.sendProperty(msg.Name, "")
+	case propPowerOutputs:
+		state := "Ok"
+		for _, m := range msg.Members {
+			key := strings.ToLower(m.Name)
+			id, ok := findSwitchID(key)
+			if !ok {
+				c.sendMessage(fmt.Sprintf("Unknown output '%s'.", m.Name))
+				state = "Alert"
+				continue
+			}
+			on := strings.TrimSpace(m.Value) == "On"
+			logger.Info("INDI: Setting output '%s' to %t.", key, on)
+			if err := alpaca.SetSwitch(id, alpaca.SwitchCommand{State: on, Source: audit.FromConn(audit.KindINDI, c.conn.RemoteAddr())}); err != nil {
+				c.sendMessage(fmt.Sprintf("Failed to set output '%s': %v", key, err))
+				state = "Alert"
+			}
+		}
+		c.sendProperty(msg.Name, state)
+	default:
+		c.sendMessage(fmt.Sprintf("Property '%s' is read-only or unknown.", msg.Name))
+	}
+}
+
+func (c *client) handleNewNumber(msg inboundMessage) {
+	var keys map[string]string // INDI member name -> output key
+	switch msg.Name {
+	case propHeaterPower:
+		keys = map[string]string{"PWM1": "pwm1", "PWM2": "pwm2"}
+	case propAdjVoltage:
+		if !config.Get().EnableAlpacaVoltageControl {
+			c.sendMessage("Voltage control is disabled. Enable it in the proxy settings.")
+			c.sendProperty(msg.Name, "Alert")
+			return
+		}
+		keys = map[string]string{"VOLTAGE": "adj_conv"}
+	default:
+		c.sendMessage(fmt.Sprintf("Property '%s' is read-only or unknown.", msg.Name))
+		return
+	}
+
+	state := "Ok"
+	for _, m := range msg.Members {
+		key, known := keys[m.Name]
+		id, exists := findSwitchID(key)
+		value, err := strconv.ParseFloat(strings.TrimSpace(strings.Replace(m.Value, ",", ".", -1)), 64)
+		if !known || !exists || err != nil {
+			c.sendMessage(fmt.Sprintf("Invalid value '%s' for '%s'.", strings.TrimSpace(m.Value), m.Name))
+			state = "Alert"
+			continue
+		}
+		logger.Info("INDI: Setting '%s' to %.2f.", key, value)
+		if err := alpaca.SetSwitch(id, alpaca.SwitchCommand{State: value >= 1.0, Value: value, HasValue: true, Source: audit.FromConn(audit.KindINDI, c.conn.RemoteAddr())}); err != nil {
+			c.sendMessage(fmt.Sprintf("Failed to set '%s': %v", key, err))
+			state = "Alert"
+		}
+	}
+	c.sendProperty(msg.Name, state)
+}
+
+// sendDefinitions sends the def*Vector messages for all properties, or only for the named one.
+func (c *client) sendDefinitions(name string) {
+	props := buildProperties(c.appVersion)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range props {
+		if name != "" && p.name != name {
+			continue
+		}
+		c.write(marshalProperty(p, "def", timestamp()))
+		c.lastSent[p.name] = string(marshalProperty(p, "set", ""))
+	}
+	c.defined = true
+	c.defNames = propertyNames(props)
+}
+
+// sendProperty sends the current values of one property, optionally overriding its state.
+func (c *client) sendProperty(name, state string) {
+	for _, p := range buildProperties(c.appVersion) {
+		if p.name != name {
+			continue
+		}
+		if state != "" {
+			p.state = state
+		}
+		c.mu.Lock()
+		c.write(marshalProperty(p, "set", timestamp()))
+		c.lastSent[p.name] = string(marshalProperty(p, "set", ""))
+		c.mu.Unlock()
+		return
+	}
+}
+
+// pushUpdates periodically sends properties whose values changed since they were last sent.
+// If the set of properties changed (e.g. outputs were disabled), all properties are redefined.
+func (c *client) pushUpdates(done chan struct{}) {
+	ticker := time.NewTicker(updateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		if !c.defined {
+			c.mu.Unlock()
+			continue
+		}
+		serial.NoteClientActivity() // Connected clients expect current values
+		props := buildProperties(c.appVersion)
+		if names := propertyNames(props); names != c.defNames {
+			logger.Debug("INDI: Property set changed, redefining properties.")
+			c.write([]byte(fmt.Sprintf(`<delProperty device="%s" timestamp="%s"/>`, deviceName, timestamp())))
+			c.lastSent = make(map[string]string)
+			c.mu.Unlock()
+			c.sendDefinitions("")
+			continue
+		}
+		for _, p := range props {
+			values := string(marshalProperty(p, "set", ""))
+			// Only update properties the client has defined.
+			if last, ok := c.lastSent[p.name]; !ok || last == values {
+				continue
+			}
+			c.write(marshalProperty(p, "set", timestamp()))
+			c.lastSent[p.name] = values
+		}
+		c.mu.Unlock()
+	}
+}
+
+func (c *client) sendMessage(text string) {
+	msg := struct {
+		XMLName   xml.Name `xml:"message"`
+		Device    string   `xml:"device,attr"`
+		Timestamp string   `xml:"timestamp,attr"`
+		Message   string   `xml:"message,attr"`
+	}{Device: deviceName, Timestamp: timestamp(), Message: text}
+	data, err := xml.Marshal(msg)
+	if err != nil {
+		return
+	}
+	c.write(data)
+}
+
+// write sends one message to the client. Errors close the connection, which ends serve().
+func (c *client) write(data []byte) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		logger.Debug("INDI: Write to %s failed: %v", c.conn.RemoteAddr(), err)
+		c.conn.Close()
+	}
+}
+
+// --- XML Encoding ---
+
+type xmlVector struct {
+	XMLName   xml.Name
+	Device    string      `xml:"device,attr"`
+	Name      string      `xml:"name,attr"`
+	Label     string      `xml:"label,attr,omitempty"`
+	Group     string      `xml:"group,attr,omitempty"`
+	State     string      `xml:"state,attr"`
+	Perm      string      `xml:"perm,attr,omitempty"`
+	Rule      string      `xml:"rule,attr,omitempty"`
+	Timeout   string      `xml:"timeout,attr,omitempty"`
+	Timestamp string      `xml:"timestamp,attr,omitempty"`
+	Members   []xmlMember `xml:",any"`
+}
+
+type xmlMember struct {
+	XMLName xml.Name
+	Name    string `xml:"name,attr"`
+	Label   string `xml:"label,attr,omitempty"`
+	Format  string `xml:"format,attr,omitempty"`
+	Min     string `xml:"min,attr,omitempty"`
+	Max     string `xml:"max,attr,omitempty"`
+	Step    string `xml:"step,attr,omitempty"`
+	Value   string `xml:",chardata"`
+}
+
+// marshalProperty encodes a property as def*Vector ("def") or set*Vector ("set").
+// An empty timestamp is omitted, which is used to compare values between updates.
+func marshalProperty(p property, mode, ts string) []byte {
+	v := xmlVector{
+		XMLName:   xml.Name{Local: mode + p.kind + "Vector"},
+		Device:    deviceName,
+		Name:      p.name,
+		State:     p.state,
+		Timestamp: ts,
+	}
+	memberTag := "one" + p.kind
+	if mode == "def" {
+		memberTag = "def" + p.kind
+		v.Label = p.label
+		v.Group = p.group
+		if p.kind != "Light" {
+			v.Perm = p.perm
+			v.Timeout = "60"
+		}
+		v.Rule = p.rule
+	}
+	for _, m := range p.members {
+		xm := xmlMember{XMLName: xml.Name{Local: memberTag}, Name: m.name, Value: m.value}
+		if mode == "def" {
+			xm.Label = m.label
+			xm.Format = m.format
+			xm.Min = m.min
+			xm.Max = m.max
+			xm.Step = m.step
+		}
+		v.Members = append(v.Members, xm)
+	}
+	data, err := xml.Marshal(v)
+	if err != nil {
+		logger.Warn("INDI: Failed to encode property '%s': %v", p.name, err)
+		return nil
+	}
+	return data
+}
+
+func propertyNames(props []property) string {
+	names := make([]string, 0, len(props))
+	for _, p := range props {
+		// Member names are included, so a changed output list also triggers a redefinition.
+		memberNames := make([]string, 0, len(p.members))
+		for _, m := range p.members {
+			memberNames = append(memberNames, m.name)
+		}
+		names = append(names, p.name+"("+strings.Join(memberNames, ",")+")")
+	}
+	return strings.Join(names, ";")
+}
+
+func timestamp() string {
+	return time.Now().UTC().Format("2006-01-02T15:04:05")
+}
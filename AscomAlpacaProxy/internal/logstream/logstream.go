@@ -2,6 +2,7 @@ package logstream
 
 import (
 	"net/http"
+	"sv241pro-alpaca-proxy/internal/auth"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"time"
 
@@ -89,10 +90,9 @@ func ServeWs(w http.ResponseWriter, r *http.Request) {
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  8192, // Increased from 1024 to prevent truncation
 		WriteBufferSize: 8192, // Increased from 1024 to prevent truncation
-		CheckOrigin: func(r *http.Request) bool {
-			// Allow all connections.
-			return true
-		},
+		// Only the web UI itself and allowlisted dashboards may connect, so other web pages
+		// opened in the browser cannot read the log.
+		CheckOrigin: auth.IsOriginAllowed,
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
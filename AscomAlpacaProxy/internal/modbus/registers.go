@@ -0,0 +1,191 @@
+package modbus
+
+import (
+	"math"
+	"sv241pro-alpaca-proxy/internal/alpaca"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+)
+
+// Register map. Addresses are fixed per output, so PLC programs keep working when
+// outputs are disabled in the firmware (disabled outputs read as off, writes fail).
+
+// coilOutputs maps coil addresses to output keys.
+var coilOutputs = []string{
+	"dc1", "dc2", "dc3", "dc4", "dc5", "usbc12", "usb345", "adj_conv", "pwm1", "pwm2", "master_power",
+}
+
+// Discrete inputs.
+const (
+	discreteConnected = 0 // SV241 is connected
+	discreteSafe      = 1 // SafetyMonitor reports safe
+)
+
+// Holding registers.
+const (
+	holdingPWM1Duty   = 0 // Duty cycle in %
+	holdingPWM2Duty   = 1 // Duty cycle in %
+	holdingAdjVoltage = 2 // Voltage in 0.01 V
+)
+
+// inputRegister describes a scaled, read-only sensor value (signed 16 bit).
+type inputRegister struct {
+	key   string  // Key in the conditions cache
+	scale float64 // Register value = sensor value * scale
+}
+
+// inputRegisters maps input register addresses to sensor values.
+var inputRegisters = []inputRegister{
+	{"v", 100},     // 0: Input voltage in 0.01 V
+	{"i", 1},       // 1: Total current in mA
+	{"p", 10},      // 2: Total power in 0.1 W
+	{"t_amb", 10},  // 3: Ambient temperature in 0.1 °C
+	{"h_amb", 10},  // 4: Humidity in 0.1 %
+	{"d", 10},      // 5: Dew point in 0.1 °C
+	{"t_lens", 10}, // 6: Lens temperature in 0.1 °C
+}
+
+// notAvailable is returned for sensor values that are missing (e.g. no lens sensor).
+const notAvailable = 0x8000
+
+func readCoil(addr int) (bool, byte) {
+	if addr < 0 || addr >= len(coilOutputs) {
+		return false, exceptionIllegalDataAddress
+	}
+	id, ok := outputID(addr)
+	if !ok {
+		return false, 0 // Disabled outputs read as off, so PLCs can read the whole block
+	}
+	isOn, _ := alpaca.GetSwitchState(id)
+	return isOn, 0
+}
+
+// coilOutputID returns the Alpaca switch ID of a writable coil.
+func coilOutputID(addr int) (int, byte) {
+	if addr < 0 || addr >= len(coilOutputs) {
+		return 0, exceptionIllegalDataAddress
+	}
+	// Master Power switches every output at once, so it is only writable if it is enabled.
+	if coilOutputs[addr] == "master_power" && !config.Get().EnableMasterPower {
+		return 0, exceptionIllegalDataAddress
+	}
+	id, ok := outputID(addr)
+	if !ok {
+		return 0, exceptionIllegalDataAddress
+	}
+	return id, 0
+}
+
+func writeCoil(src audit.Source, addr int, on bool) byte {
+	id, exc := coilOutputID(addr)
+	if exc != 0 {
+		return exc
+	}
+	if err := alpaca.SetSwitch(id, alpaca.SwitchCommand{State: on, Source: src}); err != nil {
+		logger.Warn("Modbus: Failed to set '%s': %v", coilOutputs[addr], err)
+		return exceptionServerDeviceFailure
+	}
+	return 0
+}
+
+func readDiscreteInput(addr int) (bool, byte) {
+	switch addr {
+	case discreteConnected:
+		return serial.IsConnected(), 0
+	case discreteSafe:
+		return alpaca.EvaluateSafety().IsSafe, 0
+	}
+	return false, exceptionIllegalDataAddress
+}
+
+func readHoldingRegister(addr int) (uint16, byte) {
+	switch addr {
+	case holdingPWM1Duty, holdingPWM2Duty:
+		// The duty cycle lives in the conditions cache, Status only has the enabled state.
+		key := "pwm1"
+		if addr == holdingPWM2Duty {
+			key = "pwm2"
+		}
+		duty, _ := serial.Conditions.Load().Data.Value(key)
+		return uint16(math.Round(duty)), 0
+	case holdingAdjVoltage:
+		adj, _ := serial.Status.Load().Data.Output("adj")
+		voltage, _ := adj.Float()
+		return uint16(math.Round(voltage * 100)), 0
+	}
+	return 0, exceptionIllegalDataAddress
+}
+
+// registerWrite is a checked holding register write.
+type registerWrite struct {
+	id     int     // Alpaca switch ID
+	key    string  // Output key
+	target float64 // Switch value
+}
+
+// checkHoldingRegisterWrite checks a write to a holding register and returns the switch value to set.
+func checkHoldingRegisterWrite(addr int, value uint16) (registerWrite, byte) {
+	var key string
+	var target float64
+	switch addr {
+	case holdingPWM1Duty, holdingPWM2Duty:
+		key = "pwm1"
+		if addr == holdingPWM2Duty {
+			key = "pwm2"
+		}
+		if value > 100 {
+			return registerWrite{}, exceptionIllegalDataValue
+		}
+		target = float64(value)
+	case holdingAdjVoltage:
+		// Same restriction as for Alpaca: voltage control must be enabled explicitly.
+		if !config.Get().EnableAlpacaVoltageControl {
+			return registerWrite{}, exceptionIllegalDataAddress
+		}
+		if value > 1500 {
+			return registerWrite{}, exceptionIllegalDataValue
+		}
+		key = "adj_conv"
+		target = float64(value) / 100
+	default:
+		return registerWrite{}, exceptionIllegalDataAddress
+	}
+
+	id, ok := config.GetSwitchIDByKey(key)
+	if !ok {
+		return registerWrite{}, exceptionIllegalDataAddress
+	}
+	return registerWrite{id: id, key: key, target: target}, 0
+}
+
+func writeHoldingRegister(src audit.Source, w registerWrite) byte {
+	if err := alpaca.SetSwitch(w.id, alpaca.SwitchCommand{State: w.target >= 1.0, Value: w.target, HasValue: true, Source: src}); err != nil {
+		logger.Warn("Modbus: Failed to set '%s': %v", w.key, err)
+		return exceptionServerDeviceFailure
+	}
+	return 0
+}
+
+func readInputRegister(addr int) (uint16, byte) {
+	if addr < 0 || addr >= len(inputRegisters) {
+		return 0, exceptionIllegalDataAddress
+	}
+	reg := inputRegisters[addr]
+	val, ok := serial.Conditions.Load().Data.Value(reg.key)
+	if !ok {
+		return notAvailable, 0
+	}
+	scaled := math.Round(val * reg.scale)
+	scaled = math.Max(math.MinInt16+1, math.Min(scaled, math.MaxInt16))
+	return uint16(int16(scaled)), 0
+}
+
+// outputID returns the Alpaca switch ID for a coil address, if the output is enabled.
+func outputID(addr int) (int, bool) {
+	if addr < 0 || addr >= len(coilOutputs) {
+		return 0, false
+	}
+	return config.GetSwitchIDByKey(coilOutputs[addr])
+}
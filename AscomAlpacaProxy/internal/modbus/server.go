@@ -0,0 +1,263 @@
+// Package modbus implements a minimal Modbus TCP server, so PLCs (e.g. roll-off roof
+// controllers) can read the SV241 sensors and switch its outputs. Writes use the same
+// switch logic as the Alpaca Switch device.
+package modbus
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/auth"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/serial"
+	"time"
+)
+
+// Function codes
+const (
+	fcReadCoils              = 0x01
+	fcReadDiscreteInputs     = 0x02
+	fcReadHoldingRegisters   = 0x03
+	fcReadInputRegisters     = 0x04
+	fcWriteSingleCoil        = 0x05
+	fcWriteSingleRegister    = 0x06
+	fcWriteMultipleCoils     = 0x0F
+	fcWriteMultipleRegisters = 0x10
+)
+
+// Exception codes
+const (
+	exceptionIllegalFunction     = 0x01
+	exceptionIllegalDataAddress  = 0x02
+	exceptionIllegalDataValue    = 0x03
+	exceptionServerDeviceFailure = 0x04
+)
+
+const (
+	mbapHeaderLength = 7
+	maxPDULength     = 253
+	// idleTimeout closes connections of clients that stopped polling.
+	idleTimeout = 5 * time.Minute
+)
+
+// Start runs the Modbus TCP server if it is enabled in the proxy config.
+// It blocks while the server is running, so it should be started as a goroutine.
+func Start() {
+	conf := config.Get()
+	if !conf.EnableModbusServer {
+		return
+	}
+
+	addr := net.JoinHostPort(conf.ListenAddress, strconv.Itoa(conf.ModbusPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("Modbus: Could not listen on '%s': %v", addr, err)
+		return
+	}
+	defer listener.Close()
+	logger.Info("Modbus TCP server started on %s.", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			logger.Warn("Modbus: Failed to accept connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !auth.IsAlpacaClientAllowed(tcpAddr.IP) {
+			logger.Warn("Modbus: Rejected connection from %s (not in IP allowlist).", tcpAddr)
+			conn.Close()
+			continue
+		}
+		go serveConn(conn)
+	}
+}
+
+func serveConn(conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	logger.Info("Modbus: Client connected from %s.", remote)
+	defer func() {
+		conn.Close()
+		logger.Info("Modbus: Client %s disconnected.", remote)
+	}()
+
+	header := make([]byte, mbapHeaderLength)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		if _, err := io.ReadFull(conn, header); err != nil {
+			if err != io.EOF {
+				logger.Debug("Modbus: Read error from %s: %v", remote, err)
+			}
+			return
+		}
+		transactionID := binary.BigEndian.Uint16(header[0:2])
+		protocolID := binary.BigEndian.Uint16(header[2:4])
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		unitID := header[6]
+
+		// The length includes the unit ID.
+		if protocolID != 0 || length < 2 || length-1 > maxPDULength {
+			logger.Debug("Modbus: Invalid frame from %s (protocol %d, length %d).", remote, protocolID, length)
+			return
+		}
+		pdu := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, pdu); err != nil {
+			logger.Debug("Modbus: Read error from %s: %v", remote, err)
+			return
+		}
+
+		response := handleRequest(pdu, audit.FromConn(audit.KindModbus, conn.RemoteAddr()))
+
+		frame := make([]byte, mbapHeaderLength+len(response))
+		binary.BigEndian.PutUint16(frame[0:2], transactionID)
+		binary.BigEndian.PutUint16(frame[2:4], 0)
+		binary.BigEndian.PutUint16(frame[4:6], uint16(len(response)+1))
+		frame[6] = unitID
+		copy(frame[mbapHeaderLength:], response)
+		if _, err := conn.Write(frame); err != nil {
+			logger.Debug("Modbus: Write to %s failed: %v", remote, err)
+			return
+		}
+	}
+}
+
+// handleRequest processes one request PDU from src and returns the response PDU.
+func handleRequest(pdu []byte, src audit.Source) []byte {
+	serial.NoteClientActivity()
+	fc := pdu[0]
+	data := pdu[1:]
+
+	switch fc {
+	case fcReadCoils, fcReadDiscreteInputs:
+		start, qty, ok := readRange(data, 2000)
+		if !ok {
+			return exception(fc, exceptionIllegalDataValue)
+		}
+		read := readCoil
+		if fc == fcReadDiscreteInputs {
+			read = readDiscreteInput
+		}
+		bits := make([]byte, (qty+7)/8)
+		for i := 0; i < qty; i++ {
+			on, exc := read(start + i)
+			if exc != 0 {
+				return exception(fc, exc)
+			}
+			if on {
+				bits[i/8] |= 1 << (i % 8)
+			}
+		}
+		return append([]byte{fc, byte(len(bits))}, bits...)
+
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		start, qty, ok := readRange(data, 125)
+		if !ok {
+			return exception(fc, exceptionIllegalDataValue)
+		}
+		read := readHoldingRegister
+		if fc == fcReadInputRegisters {
+			read = readInputRegister
+		}
+		resp := []byte{fc, byte(qty * 2)}
+		for i := 0; i < qty; i++ {
+			val, exc := read(start + i)
+			if exc != 0 {
+				return exception(fc, exc)
+			}
+			resp = binary.BigEndian.AppendUint16(resp, val)
+		}
+		return resp
+
+	case fcWriteSingleCoil:
+		if len(data) != 4 {
+			return exception(fc, exceptionIllegalDataValue)
+		}
+		addr := int(binary.BigEndian.Uint16(data[0:2]))
+		value := binary.BigEndian.Uint16(data[2:4])
+		if value != 0xFF00 && value != 0x0000 {
+			return exception(fc, exceptionIllegalDataValue)
+		}
+		logger.Info("Modbus: Write coil %d = %t.", addr, value == 0xFF00)
+		if exc := writeCoil(src, addr, value == 0xFF00); exc != 0 {
+			return exception(fc, exc)
+		}
+		return pdu // Echo the request
+
+	case fcWriteSingleRegister:
+		if len(data) != 4 {
+			return exception(fc, exceptionIllegalDataValue)
+		}
+		addr := int(binary.BigEndian.Uint16(data[0:2]))
+		value := binary.BigEndian.Uint16(data[2:4])
+		w, exc := checkHoldingRegisterWrite(addr, value)
+		if exc != 0 {
+			return exception(fc, exc)
+		}
+		logger.Info("Modbus: Write holding register %d = %d.", addr, value)
+		if exc := writeHoldingRegister(src, w); exc != 0 {
+			return exception(fc, exc)
+		}
+		return pdu // Echo the request
+
+	case fcWriteMultipleCoils:
+		start, qty, ok := readRange(data, 1968)
+		if !ok || len(data) < 5 || int(data[4]) != (qty+7)/8 || len(data) != 5+int(data[4]) {
+			return exception(fc, exceptionIllegalDataValue)
+		}
+		// Check every coil before writing any, so a bad address doesn't leave a partial write.
+		for i := 0; i < qty; i++ {
+			if _, exc := coilOutputID(start + i); exc != 0 {
+				return exception(fc, exc)
+			}
+		}
+		for i := 0; i < qty; i++ {
+			on := data[5+i/8]&(1<<(i%8)) != 0
+			logger.Info("Modbus: Write coil %d = %t.", start+i, on)
+			if exc := writeCoil(src, start+i, on); exc != 0 {
+				return exception(fc, exc)
+			}
+		}
+		return pdu[:5]
+
+	case fcWriteMultipleRegisters:
+		start, qty, ok := readRange(data, 123)
+		if !ok || len(data) < 5 || int(data[4]) != qty*2 || len(data) != 5+qty*2 {
+			return exception(fc, exceptionIllegalDataValue)
+		}
+		// Check every register and value before writing any.
+		writes := make([]registerWrite, qty)
+		for i := range writes {
+			w, exc := checkHoldingRegisterWrite(start+i, binary.BigEndian.Uint16(data[5+i*2:]))
+			if exc != 0 {
+				return exception(fc, exc)
+			}
+			writes[i] = w
+		}
+		for i, w := range writes {
+			logger.Info("Modbus: Write holding register %d = %d.", start+i, binary.BigEndian.Uint16(data[5+i*2:]))
+			if exc := writeHoldingRegister(src, w); exc != 0 {
+				return exception(fc, exc)
+			}
+		}
+		return pdu[:5]
+	}
+
+	return exception(fc, exceptionIllegalFunction)
+}
+
+// readRange parses the start address and quantity of a request.
+func readRange(data []byte, maxQty int) (int, int, bool) {
+	if len(data) < 4 {
+		return 0, 0, false
+	}
+	start := int(binary.BigEndian.Uint16(data[0:2]))
+	qty := int(binary.BigEndian.Uint16(data[2:4]))
+	return start, qty, qty >= 1 && qty <= maxQty
+}
+
+func exception(fc byte, code byte) []byte {
+	return []byte{fc | 0x80, code}
+}
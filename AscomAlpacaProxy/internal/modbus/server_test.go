@@ -0,0 +1,85 @@
+package modbus
+
+import (
+	"bytes"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/config"
+	"testing"
+)
+
+// The tests run without a device, so outputs read as off and sensor values as not
+// available. Only rejected writes are tested, they never reach the device.
+
+func TestHandleRequest(t *testing.T) {
+	// Disable DC2, so writes to it are rejected.
+	config.SwitchMapMutex.Lock()
+	dc2 := config.SwitchIDMap[4]
+	delete(config.SwitchIDMap, 4)
+	config.SwitchMapMutex.Unlock()
+	defer func() {
+		config.SwitchMapMutex.Lock()
+		config.SwitchIDMap[4] = dc2
+		config.SwitchMapMutex.Unlock()
+	}()
+
+	tests := []struct {
+		name string
+		pdu  []byte
+		want []byte
+	}{
+		{"unknown function", []byte{0x07}, []byte{0x87, exceptionIllegalFunction}},
+
+		// FC01 Read Coils
+		{"read coils", []byte{0x01, 0, 0, 0, 11}, []byte{0x01, 2, 0, 0}},
+		{"read coils short", []byte{0x01, 0, 0, 0}, []byte{0x81, exceptionIllegalDataValue}},
+		{"read zero coils", []byte{0x01, 0, 0, 0, 0}, []byte{0x81, exceptionIllegalDataValue}},
+		{"read too many coils", []byte{0x01, 0, 0, 0x07, 0xD1}, []byte{0x81, exceptionIllegalDataValue}},
+		{"read coils past the end", []byte{0x01, 0, 10, 0, 2}, []byte{0x81, exceptionIllegalDataAddress}},
+
+		// FC03 Read Holding Registers
+		{"read holding registers", []byte{0x03, 0, 0, 0, 3}, []byte{0x03, 6, 0, 0, 0, 0, 0, 0}},
+		{"read holding registers short", []byte{0x03, 0, 0}, []byte{0x83, exceptionIllegalDataValue}},
+		{"read too many holding registers", []byte{0x03, 0, 0, 0, 126}, []byte{0x83, exceptionIllegalDataValue}},
+		{"read holding register past the end", []byte{0x03, 0, 3, 0, 1}, []byte{0x83, exceptionIllegalDataAddress}},
+
+		// FC04 Read Input Registers
+		{"read input registers", []byte{0x04, 0, 5, 0, 2}, []byte{0x04, 4, 0x80, 0, 0x80, 0}},
+		{"read input register past the end", []byte{0x04, 0, 6, 0, 2}, []byte{0x84, exceptionIllegalDataAddress}},
+
+		// FC05 Write Single Coil
+		{"write coil short", []byte{0x05, 0, 0, 0xFF}, []byte{0x85, exceptionIllegalDataValue}},
+		{"write coil long", []byte{0x05, 0, 0, 0xFF, 0, 0}, []byte{0x85, exceptionIllegalDataValue}},
+		{"write coil invalid value", []byte{0x05, 0, 0, 0x12, 0x34}, []byte{0x85, exceptionIllegalDataValue}},
+		{"write disabled coil", []byte{0x05, 0, 1, 0xFF, 0}, []byte{0x85, exceptionIllegalDataAddress}},
+		{"write coil past the end", []byte{0x05, 0, 11, 0, 0}, []byte{0x85, exceptionIllegalDataAddress}},
+
+		// FC06 Write Single Register
+		{"write register short", []byte{0x06, 0, 0, 0}, []byte{0x86, exceptionIllegalDataValue}},
+		{"write register out of range", []byte{0x06, 0, 1, 0, 101}, []byte{0x86, exceptionIllegalDataValue}},
+		{"write register past the end", []byte{0x06, 0, 3, 0, 0}, []byte{0x86, exceptionIllegalDataAddress}},
+
+		// FC15 Write Multiple Coils
+		{"write coils byte count mismatch", []byte{0x0F, 0, 0, 0, 9, 1, 0xFF}, []byte{0x8F, exceptionIllegalDataValue}},
+		{"write coils missing data", []byte{0x0F, 0, 0, 0, 9, 2, 0xFF}, []byte{0x8F, exceptionIllegalDataValue}},
+		{"write coils extra data", []byte{0x0F, 0, 0, 0, 1, 1, 0x01, 0}, []byte{0x8F, exceptionIllegalDataValue}},
+		{"write coils no byte count", []byte{0x0F, 0, 0, 0, 1}, []byte{0x8F, exceptionIllegalDataValue}},
+		// DC1 would be written first; the disabled DC2 must reject the whole request.
+		{"write coils with disabled coil", []byte{0x0F, 0, 0, 0, 2, 1, 0x03}, []byte{0x8F, exceptionIllegalDataAddress}},
+		{"write coils past the end", []byte{0x0F, 0, 11, 0, 1, 1, 0x01}, []byte{0x8F, exceptionIllegalDataAddress}},
+
+		// FC16 Write Multiple Registers
+		{"write registers byte count mismatch", []byte{0x10, 0, 0, 0, 2, 2, 0, 50}, []byte{0x90, exceptionIllegalDataValue}},
+		{"write registers missing data", []byte{0x10, 0, 0, 0, 2, 4, 0, 50}, []byte{0x90, exceptionIllegalDataValue}},
+		{"write registers extra data", []byte{0x10, 0, 0, 0, 1, 2, 0, 50, 0}, []byte{0x90, exceptionIllegalDataValue}},
+		// PWM1 would be written first; the invalid PWM2 duty cycle must reject the whole request.
+		{"write registers with invalid value", []byte{0x10, 0, 0, 0, 2, 4, 0, 50, 0, 101}, []byte{0x90, exceptionIllegalDataValue}},
+		{"write registers past the end", []byte{0x10, 0, 3, 0, 1, 2, 0, 0}, []byte{0x90, exceptionIllegalDataAddress}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := handleRequest(tt.pdu, audit.Source{Kind: audit.KindModbus}); !bytes.Equal(got, tt.want) {
+				t.Errorf("handleRequest(% x) = % x, want % x", tt.pdu, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package serial
+
+import (
+	"encoding/json"
+	"fmt"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"time"
+)
+
+// Maintenance commands understood by the firmware ({"command":"..."}).
+const (
+	CommandReboot       = "reboot"
+	CommandFactoryReset = "factory_reset"
+	CommandDrySensor    = "dry_sensor"
+)
+
+// knownGetTargets lists the values of {"get":"..."}.
+var knownGetTargets = map[string]bool{"status": true, "config": true, "sensors": true, "version": true}
+
+// knownSetKeys lists the output keys of {"set":{...}} ("all" switches every enabled output).
+var knownSetKeys = map[string]bool{
+	"d1": true, "d2": true, "d3": true, "d4": true, "d5": true,
+	"u12": true, "u34": true, "adj": true, "pwm1": true, "pwm2": true, "all": true,
+}
+
+// knownConfigKeys lists the top-level keys of {"sc":{...}}.
+var knownConfigKeys = map[string]bool{
+	"so": true, "ui": true, "ps": true, "ac": true, "av": true, "ad": true, "dh": true,
+}
+
+// MaintenanceCommand builds the JSON line of a maintenance command.
+func MaintenanceCommand(name string) string {
+	return fmt.Sprintf(`{"command":"%s"}`, name)
+}
+
+// ValidateCommand checks a raw JSON command against the command set of the firmware.
+// It returns the command in compact form (one line, as required by the firmware)
+// and the maintenance command name, if it is one.
+func ValidateCommand(raw []byte) (string, string, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return "", "", fmt.Errorf("invalid JSON: %w", err)
+	}
+	if len(doc) != 1 {
+		return "", "", fmt.Errorf("expected exactly one of 'command', 'get', 'set' or 'sc'")
+	}
+
+	maintenance := ""
+	for key, value := range doc {
+		switch key {
+		case "command":
+			var name string
+			if err := json.Unmarshal(value, &name); err != nil {
+				return "", "", fmt.Errorf("'command' must be a string")
+			}
+			if name != CommandReboot && name != CommandFactoryReset && name != CommandDrySensor {
+				return "", "", fmt.Errorf("unknown command '%s'", name)
+			}
+			maintenance = name
+		case "get":
+			var target string
+			if err := json.Unmarshal(value, &target); err != nil || !knownGetTargets[target] {
+				return "", "", fmt.Errorf("'get' must be one of status, config, sensors or version")
+			}
+		case "set":
+			var outputs map[string]interface{}
+			if err := json.Unmarshal(value, &outputs); err != nil || len(outputs) == 0 {
+				return "", "", fmt.Errorf("'set' must be a non-empty object")
+			}
+			for name, v := range outputs {
+				if !knownSetKeys[name] {
+					return "", "", fmt.Errorf("unknown output '%s' in 'set'", name)
+				}
+				switch v.(type) {
+				case bool, float64:
+				default:
+					return "", "", fmt.Errorf("value of output '%s' must be a boolean or a number", name)
+				}
+			}
+		case "sc":
+			var sections map[string]json.RawMessage
+			if err := json.Unmarshal(value, &sections); err != nil || len(sections) == 0 {
+				return "", "", fmt.Errorf("'sc' must be a non-empty object")
+			}
+			for name := range sections {
+				if !knownConfigKeys[name] {
+					return "", "", fmt.Errorf("unknown configuration key '%s' in 'sc'", name)
+				}
+			}
+		default:
+			return "", "", fmt.Errorf("unknown command key '%s'", key)
+		}
+	}
+
+	compact, err := json.Marshal(doc)
+	if err != nil {
+		return "", "", err
+	}
+	return string(compact), maintenance, nil
+}
+
+// SendAuditedCommand sends a state-changing command with high priority and records it,
+// together with the device's response, in the audit log.
+func SendAuditedCommand(src audit.Source, action, command string, timeout time.Duration) (string, error) {
+	resp, err := SendCommand(command, true, timeout)
+	audit.Record(src, action, command, resp, err)
+	return resp, err
+}
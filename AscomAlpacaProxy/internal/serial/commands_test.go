@@ -0,0 +1,73 @@
+package serial
+
+import "testing"
+
+func TestValidateCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		command     string
+		maintenance string
+		wantErr     bool
+	}{
+		{name: "get status", raw: `{"get":"status"}`, command: `{"get":"status"}`},
+		{name: "get version", raw: ` { "get" : "version" } `, command: `{"get":"version"}`},
+		{name: "set bool", raw: `{"set":{"d1":true}}`, command: `{"set":{"d1":true}}`},
+		{name: "set number", raw: "{\"set\": {\"pwm1\": 50,\n \"adj\": 12.5}}", command: `{"set":{"pwm1":50,"adj":12.5}}`},
+		{name: "set all", raw: `{"set":{"all":false}}`, command: `{"set":{"all":false}}`},
+		{name: "set config", raw: `{"sc":{"ps":{"d1":1}}}`, command: `{"sc":{"ps":{"d1":1}}}`},
+		{name: "reboot", raw: `{"command":"reboot"}`, command: MaintenanceCommand(CommandReboot), maintenance: CommandReboot},
+		{name: "factory reset", raw: `{"command":"factory_reset"}`, command: MaintenanceCommand(CommandFactoryReset), maintenance: CommandFactoryReset},
+		{name: "dry sensor", raw: `{ "command": "dry_sensor" }`, command: MaintenanceCommand(CommandDrySensor), maintenance: CommandDrySensor},
+
+		{name: "invalid JSON", raw: `{"get":`, wantErr: true},
+		{name: "not an object", raw: `["get"]`, wantErr: true},
+		{name: "empty object", raw: `{}`, wantErr: true},
+		{name: "two keys", raw: `{"get":"status","set":{"d1":true}}`, wantErr: true},
+		{name: "unknown key", raw: `{"reset":true}`, wantErr: true},
+		{name: "unknown command", raw: `{"command":"format"}`, wantErr: true},
+		{name: "command not a string", raw: `{"command":1}`, wantErr: true},
+		{name: "unknown get target", raw: `{"get":"wifi"}`, wantErr: true},
+		{name: "get not a string", raw: `{"get":{"status":true}}`, wantErr: true},
+		{name: "empty set", raw: `{"set":{}}`, wantErr: true},
+		{name: "unknown output", raw: `{"set":{"d9":true}}`, wantErr: true},
+		{name: "string value", raw: `{"set":{"d1":"on"}}`, wantErr: true},
+		{name: "null value", raw: `{"set":{"d1":null}}`, wantErr: true},
+		{name: "empty config", raw: `{"sc":{}}`, wantErr: true},
+		{name: "unknown config key", raw: `{"sc":{"wifi":{}}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			command, maintenance, err := ValidateCommand([]byte(tt.raw))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ValidateCommand(%s) = %q, want an error", tt.raw, command)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ValidateCommand(%s) failed: %v", tt.raw, err)
+			}
+			if command != tt.command || maintenance != tt.maintenance {
+				t.Errorf("ValidateCommand(%s) = %q, %q, want %q, %q", tt.raw, command, maintenance, tt.command, tt.maintenance)
+			}
+		})
+	}
+}
+
+func TestNoReplyCommands(t *testing.T) {
+	// The raw command endpoint and the console send the compact form returned by
+	// ValidateCommand, which must match the key in noReplyCommands.
+	command, _, err := ValidateCommand([]byte(`{"command": "dry_sensor"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if noReplyCommands[command] <= 0 {
+		t.Errorf("%s is not a no-reply command", command)
+	}
+	for _, c := range []string{`{"get":"status"}`, MaintenanceCommand(CommandReboot)} {
+		if _, ok := noReplyCommands[c]; ok {
+			t.Errorf("%s must wait for a reply", c)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package serial
+
+import (
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/statestream"
+	"sync"
+	"time"
+)
+
+// ConnectionState is the state of the connection to the SV241.
+type ConnectionState string
+
+const (
+	StateDisconnected ConnectionState = "disconnected" // No port open, waiting for the next connection attempt
+	StateProbing      ConnectionState = "probing"      // Auto-detection is probing the serial ports
+	StateOpening      ConnectionState = "opening"      // A serial port is being opened
+	StateSyncing      ConnectionState = "syncing"      // Port open, the switch map is read from the firmware configuration
+	StateConnected    ConnectionState = "connected"    // Port open and the device answers
+	StateUnresponsive ConnectionState = "unresponsive" // Port open, but the device did not answer the last commands
+	StateReleased     ConnectionState = "released"     // Port released for external tools, auto-reconnect paused
+)
+
+// maxUnresponsiveCommands is the number of consecutive read timeouts after which the port
+// is closed and reopened.
+const maxUnresponsiveCommands = 3
+
+// maxTransitionHistory is the number of state transitions kept for diagnostics.
+const maxTransitionHistory = 20
+
+// Transition is a change of the connection state.
+type Transition struct {
+	From   ConnectionState `json:"from"`
+	To     ConnectionState `json:"to"`
+	At     time.Time       `json:"at"`
+	Reason string          `json:"reason,omitempty"`
+}
+
+// ConnectionInfo describes the connection state, as returned by /api/v1/connection.
+type ConnectionInfo struct {
+	State           ConnectionState `json:"state"`
+	Port            string          `json:"port"`  // Port being opened or open; empty otherwise
+	Since           time.Time       `json:"since"` // Time of the last state change
+	ConnectedSince  *time.Time      `json:"connected_since,omitempty"`
+	ReconnectPaused bool            `json:"reconnect_paused"`
+	LastError       string          `json:"last_error,omitempty"`
+	LastErrorAt     *time.Time      `json:"last_error_at,omitempty"`
+	// Failed connection attempts since the last successful connection.
+	FailedAttempts int `json:"failed_attempts"`
+	// Consecutive commands the device did not answer.
+	UnansweredCommands int `json:"unanswered_commands"`
+	// Successful connections since the proxy was started.
+	Connects int          `json:"connects"`
+	History  []Transition `json:"history"` // Most recent last
+}
+
+// Connected reports whether the port is open (connected, syncing or unresponsive).
+func (c ConnectionInfo) Connected() bool {
+	return c.State == StateConnected || c.State == StateSyncing || c.State == StateUnresponsive
+}
+
+var (
+	connection   = ConnectionInfo{State: StateDisconnected, Since: time.Now(), History: []Transition{}}
+	connectionMu sync.Mutex
+)
+
+// GetConnectionInfo returns a copy of the current connection state.
+// Unlike the port itself, it never waits for a running command or probe.
+func GetConnectionInfo() ConnectionInfo {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	info := connection
+	info.History = append([]Transition(nil), connection.History...)
+	return info
+}
+
+// setConnectionState moves the state machine to a new state.
+func setConnectionState(state ConnectionState, port, reason string) {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	setConnectionStateLocked(state, port, reason)
+}
+
+// setConnectionStateLocked MUST be called with connectionMu held. It does not publish the
+// state, so callers that also change counters publish once when they are done.
+func setConnectionStateLocked(state ConnectionState, port, reason string) {
+	if state == connection.State && port == connection.Port {
+		return
+	}
+	now := time.Now()
+	if state != connection.State {
+		logger.Debug("Connection state: %s -> %s (%s)", connection.State, state, reason)
+		connection.History = append(connection.History, Transition{From: connection.State, To: state, At: now, Reason: reason})
+		if len(connection.History) > maxTransitionHistory {
+			connection.History = connection.History[len(connection.History)-maxTransitionHistory:]
+		}
+		connection.Since = now
+	}
+
+	wasConnected := connection.Connected()
+	connection.State = state
+	connection.Port = port
+	switch {
+	case state == StateSyncing && !wasConnected:
+		connection.ConnectedSince = &now
+		connection.FailedAttempts = 0
+		connection.UnansweredCommands = 0
+		connection.Connects++
+	case !connection.Connected():
+		connection.ConnectedSince = nil
+	}
+}
+
+// portClosed records that the open port was closed and returns to the disconnected state,
+// or to the released state if auto-reconnect is paused.
+func portClosed(reason string, err error) {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	recordErrorLocked(err)
+	next := StateDisconnected
+	if connection.ReconnectPaused {
+		next = StateReleased
+	}
+	setConnectionStateLocked(next, "", reason)
+}
+
+// probingStarted marks the start of the auto-detection, if no port is open.
+func probingStarted() {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	if !connection.Connected() {
+		setConnectionStateLocked(StateProbing, "", "auto-detecting device")
+	}
+}
+
+// probingFailed records a failed auto-detection.
+func probingFailed(err error) {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	if connection.State == StateProbing {
+		connectionFailedLocked("auto-detection failed", err)
+	}
+}
+
+// connectionFailed records a failed connection attempt and returns to the disconnected state.
+func connectionFailed(reason string, err error) {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	connectionFailedLocked(reason, err)
+}
+
+// connectionFailedLocked MUST be called with connectionMu held; the caller publishes the state.
+func connectionFailedLocked(reason string, err error) {
+	recordErrorLocked(err)
+	connection.FailedAttempts++
+	next := StateDisconnected
+	if connection.ReconnectPaused {
+		next = StateReleased
+	}
+	setConnectionStateLocked(next, "", reason)
+}
+
+// commandAnswered resets the unanswered command counter after a response from the device.
+func commandAnswered() {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	connection.UnansweredCommands = 0
+	if connection.State == StateUnresponsive {
+		setConnectionStateLocked(StateConnected, connection.Port, "device answered again")
+	}
+}
+
+// commandUnanswered records a command the device did not answer. It returns true if the
+// device is unresponsive for too long and the port should be reopened.
+func commandUnanswered(err error) bool {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	recordErrorLocked(err)
+	connection.UnansweredCommands++
+	if connection.State == StateConnected {
+		setConnectionStateLocked(StateUnresponsive, connection.Port, "device did not answer")
+	}
+	return connection.UnansweredCommands >= maxUnresponsiveCommands
+}
+
+// beginSync marks a running firmware configuration sync, if the port is open.
+func beginSync() {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	if connection.State == StateConnected {
+		setConnectionStateLocked(StateSyncing, connection.Port, "syncing firmware configuration")
+	}
+}
+
+// endSync finishes a firmware configuration sync.
+func endSync(err error) {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	if err != nil {
+		recordErrorLocked(err)
+	}
+	if connection.State == StateSyncing {
+		setConnectionStateLocked(StateConnected, connection.Port, "firmware configuration synced")
+	}
+}
+
+// setReconnectPaused records whether auto-reconnect is paused.
+func setReconnectPaused(paused bool) {
+	connectionMu.Lock()
+	defer connectionMu.Unlock()
+	defer publishConnectionStateLocked()
+	connection.ReconnectPaused = paused
+	switch {
+	case paused && !connection.Connected():
+		setConnectionStateLocked(StateReleased, "", "port released")
+	case !paused && connection.State == StateReleased:
+		setConnectionStateLocked(StateDisconnected, "", "auto-reconnect resumed")
+	}
+}
+
+// recordErrorLocked MUST be called with connectionMu held.
+func recordErrorLocked(err error) {
+	if err == nil {
+		return
+	}
+	now := time.Now()
+	connection.LastError = err.Error()
+	connection.LastErrorAt = &now
+}
+
+// publishConnectionStateLocked pushes the connection state to the state stream.
+// It MUST be called with connectionMu held.
+func publishConnectionStateLocked() {
+	data := map[string]interface{}{
+		"state":              string(connection.State),
+		"connected":          connection.Connected(),
+		"port":               connection.Port,
+		"since":              connection.Since.UnixMilli(),
+		"reconnectPaused":    connection.ReconnectPaused,
+		"failedAttempts":     connection.FailedAttempts,
+		"unansweredCommands": connection.UnansweredCommands,
+		"lastError":          connection.LastError,
+	}
+	statestream.Update(statestream.TopicConnection, data)
+}
@@ -0,0 +1,196 @@
+package serial
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+// ErrFirmwareConfigNotLoaded is returned if the firmware configuration has not been read
+// from the device since the port was opened.
+var ErrFirmwareConfigNotLoaded = errors.New("firmware configuration not loaded")
+
+// Dew heater modes (dh[].m).
+const (
+	HeaterModeManual      = 0
+	HeaterModePID         = 1 // PID on the lens temperature
+	HeaterModeAmbTracking = 2
+	HeaterModePIDSync     = 3 // Follows the other heater (PID leader)
+	HeaterModeMinTemp     = 4
+	HeaterModeDisabled    = 5
+)
+
+// FirmwareConfig is the configuration stored on the SV241, as returned by {"get":"config"}
+// and by every {"sc":...} command.
+type FirmwareConfig struct {
+	SO SensorOffsets             `json:"so"`
+	UI UpdateIntervals           `json:"ui"`
+	PS config.PowerStartupStates `json:"ps"`
+	AC AveragingCounts           `json:"ac"`
+	AV float64                   `json:"av"` // Adjustable converter preset voltage
+	AD AutoDryConfig             `json:"ad"`
+	DH []DewHeaterConfig         `json:"dh"`
+}
+
+// SensorOffsets are the calibration offsets of the sensors.
+type SensorOffsets struct {
+	SHT40Temp     float64 `json:"st"`
+	SHT40Humidity float64 `json:"sh"`
+	DS18B20Temp   float64 `json:"dt"`
+	INA219Voltage float64 `json:"iv"`
+	INA219Current float64 `json:"ic"`
+}
+
+// UpdateIntervals are the sensor read intervals in milliseconds.
+type UpdateIntervals struct {
+	INA219  int `json:"i"`
+	SHT40   int `json:"s"`
+	DS18B20 int `json:"d"`
+}
+
+// AveragingCounts are the number of samples averaged per sensor value.
+type AveragingCounts struct {
+	SHT40Temp     int `json:"st"`
+	SHT40Humidity int `json:"sh"`
+	DS18B20Temp   int `json:"dt"`
+	INA219Voltage int `json:"iv"`
+	INA219Current int `json:"ic"`
+}
+
+// AutoDryConfig configures the automatic drying of the SHT40 sensor.
+type AutoDryConfig struct {
+	Enabled           int     `json:"en"`
+	HumidityThreshold float64 `json:"ht"` // %
+	TriggerDuration   int     `json:"td"` // Seconds
+}
+
+// DewHeaterConfig is the configuration of one dew heater.
+type DewHeaterConfig struct {
+	Name           string  `json:"n"`
+	EnabledOnStart int     `json:"en"`
+	Mode           int     `json:"m"`  // HeaterMode*
+	ManualPower    int     `json:"mp"` // % (Manual mode)
+	TargetOffset   float64 `json:"to"` // PID target above the dew point
+	Kp             float64 `json:"kp"`
+	Ki             float64 `json:"ki"`
+	Kd             float64 `json:"kd"`
+	StartDelta     float64 `json:"sd"` // Ambient tracking
+	EndDelta       float64 `json:"ed"`
+	MaxPower       int     `json:"xp"`
+	PIDSyncFactor  float64 `json:"psf"`
+	MinTemp        float64 `json:"mt"`
+}
+
+// Heater returns the configuration of a dew heater (0-based), or false if there is no such heater.
+func (c FirmwareConfig) Heater(index int) (DewHeaterConfig, bool) {
+	if index < 0 || index >= len(c.DH) {
+		return DewHeaterConfig{}, false
+	}
+	return c.DH[index], true
+}
+
+// fwConfigCache holds the last firmware configuration read from the device. The raw JSON is
+// kept as well, so /api/v1/config and backups return exactly what the firmware sent.
+var fwConfigCache struct {
+	sync.RWMutex
+	raw     string
+	config  *FirmwareConfig
+	updated time.Time
+}
+
+// GetFirmwareConfig returns a copy of the cached firmware configuration.
+func GetFirmwareConfig() (FirmwareConfig, error) {
+	fwConfigCache.RLock()
+	defer fwConfigCache.RUnlock()
+	if fwConfigCache.config == nil {
+		return FirmwareConfig{}, ErrFirmwareConfigNotLoaded
+	}
+	c := *fwConfigCache.config
+	c.DH = append([]DewHeaterConfig(nil), fwConfigCache.config.DH...)
+	return c, nil
+}
+
+// GetFirmwareConfigJSON returns the cached firmware configuration as sent by the device,
+// and the time it was read.
+func GetFirmwareConfigJSON() (string, time.Time, error) {
+	fwConfigCache.RLock()
+	defer fwConfigCache.RUnlock()
+	if fwConfigCache.config == nil {
+		return "", time.Time{}, ErrFirmwareConfigNotLoaded
+	}
+	return fwConfigCache.raw, fwConfigCache.updated, nil
+}
+
+// RefreshFirmwareConfig reads the firmware configuration from the device and updates the cache.
+func RefreshFirmwareConfig(ctx context.Context) (string, error) {
+	response, err := SendCommandContext(ctx, `{"get":"config"}`, false)
+	if err != nil {
+		return "", err
+	}
+	if err := storeFirmwareConfig(response); err != nil {
+		return "", err
+	}
+	return response, nil
+}
+
+// storeFirmwareConfig parses a configuration sent by the device and replaces the cache.
+func storeFirmwareConfig(raw string) error {
+	var c FirmwareConfig
+	if err := json.Unmarshal([]byte(raw), &c); err != nil {
+		return fmt.Errorf("failed to parse firmware config: %w", err)
+	}
+	if len(c.DH) == 0 {
+		return fmt.Errorf("unexpected firmware config response: %s", raw)
+	}
+	// The values were set by the user, so implausible ones are reported but kept.
+	if err := c.Validate(); err != nil {
+		logger.Warn("Firmware configuration has values out of range: %v", err)
+	}
+
+	fwConfigCache.Lock()
+	fwConfigCache.raw = raw
+	fwConfigCache.config = &c
+	fwConfigCache.updated = time.Now()
+	fwConfigCache.Unlock()
+	logger.Debug("Firmware configuration cache updated.")
+	return nil
+}
+
+// invalidateFirmwareConfig clears the cache, e.g. when the port is closed and the next
+// device may be a different one.
+func invalidateFirmwareConfig() {
+	fwConfigCache.Lock()
+	defer fwConfigCache.Unlock()
+	fwConfigCache.raw = ""
+	fwConfigCache.config = nil
+}
+
+// firmwareConfigWritten updates the cache from the response to a {"sc":...} command.
+// The firmware answers with the complete configuration after merging the changes. If the
+// response is not a configuration, the cache is reloaded from the device instead.
+// It is called by the command processor, so it MUST NOT wait for another command.
+func firmwareConfigWritten(response string) {
+	if err := storeFirmwareConfig(response); err == nil {
+		return
+	}
+	var reply struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal([]byte(response), &reply) == nil && reply.Error != "" {
+		return // The device rejected the change; the configuration is unchanged.
+	}
+	logger.Warn("Set config response did not contain the configuration. Reloading firmware configuration.")
+	invalidateFirmwareConfig()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := RefreshFirmwareConfig(ctx); err != nil {
+			logger.Warn("Failed to reload firmware configuration: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,444 @@
+package serial
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Plausibility limits for the values reported by the firmware. They are wider than the
+// sensor ranges, so calibration offsets don't trip them; a message outside of them is
+// garbled and not used.
+const (
+	maxAdjVoltage  = 15.0     // Adjustable converter maximum (V)
+	maxInputVolts  = 40.0     // INA219 bus voltage (V)
+	maxCurrentMA   = 30000.0  // INA219 current, both directions (mA)
+	maxPowerW      = 1200.0   // INA219 power, both directions (W)
+	minTemperature = -80.0    // SHT40 / DS18B20 (°C)
+	maxTemperature = 150.0    // SHT40 / DS18B20 (°C)
+	minHumidity    = -10.0    // SHT40 (%)
+	maxHumidity    = 110.0    // SHT40 (%)
+	maxAvgCount    = 20       // MAX_SENSOR_AVG_COUNT of the firmware
+	maxIntervalMs  = 86400000 // Sensor update intervals (ms)
+)
+
+// OutputValue is the state of a power output as reported in the status message.
+// The firmware reports false for an output that is off and true for a heater in an
+// automatic mode. Otherwise it reports a number: 0/1 for switched outputs, the duty cycle
+// in % for a heater in manual mode and the voltage for the adjustable converter.
+type OutputValue struct {
+	IsBool bool    // Reported as true/false
+	Bool   bool    // Value if IsBool
+	Number float64 // Value if !IsBool
+	set    bool    // Present in the message
+}
+
+// IsOn reports whether the output is switched on: true, or a number of at least 1.
+func (v OutputValue) IsOn() bool {
+	if v.IsBool {
+		return v.Bool
+	}
+	return v.Number >= 1.0
+}
+
+// Float returns the reported number, or false if a boolean was reported.
+func (v OutputValue) Float() (float64, bool) {
+	return v.Number, !v.IsBool
+}
+
+// String returns the value as reported by the firmware, e.g. "false" or "75".
+func (v OutputValue) String() string {
+	return mustMarshal(v)
+}
+
+// UnmarshalJSON accepts a boolean or a number.
+func (v *OutputValue) UnmarshalJSON(data []byte) error {
+	*v = OutputValue{set: true}
+	if err := json.Unmarshal(data, &v.Number); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &v.Bool); err != nil {
+		return fmt.Errorf("output value must be a boolean or a number, got %s", data)
+	}
+	v.IsBool = true
+	return nil
+}
+
+// MarshalJSON writes the value the way the firmware reported it.
+func (v OutputValue) MarshalJSON() ([]byte, error) {
+	if v.IsBool {
+		return json.Marshal(v.Bool)
+	}
+	return json.Marshal(v.Number)
+}
+
+// PowerStatus is the "status" object of {"get":"status"} and of every {"set":...} response,
+// with the heater modes ("dm") of the last {"get":"status"}.
+// The JSON encoding is the message as the firmware sent it (see raw), so keys the proxy does
+// not know yet are passed on and missing keys stay missing.
+type PowerStatus struct {
+	Adj      OutputValue `json:"adj"` // false or the voltage
+	D1       OutputValue `json:"d1"`
+	D2       OutputValue `json:"d2"`
+	D3       OutputValue `json:"d3"`
+	D4       OutputValue `json:"d4"`
+	D5       OutputValue `json:"d5"`
+	DewModes []int       `json:"dm,omitempty"` // Heater modes, see HeaterMode*
+	PWM1     OutputValue `json:"pwm1"`         // false, true (automatic mode) or the duty cycle
+	PWM2     OutputValue `json:"pwm2"`
+	U12      OutputValue `json:"u12"`
+	U34      OutputValue `json:"u34"`
+
+	raw map[string]json.RawMessage // The reported keys and values, including "dm"
+}
+
+// powerStatusFields is PowerStatus without its JSON methods.
+type powerStatusFields PowerStatus
+
+// UnmarshalJSON decodes the known fields and keeps the message for MarshalJSON.
+func (s *PowerStatus) UnmarshalJSON(data []byte) error {
+	var fields powerStatusFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = PowerStatus(fields)
+	s.raw = raw
+	return nil
+}
+
+// MarshalJSON writes the status as the firmware reported it, with the keys in alphabetical order.
+func (s PowerStatus) MarshalJSON() ([]byte, error) {
+	if s.raw == nil {
+		return json.Marshal(powerStatusFields(s))
+	}
+	return json.Marshal(s.raw)
+}
+
+// Has reports whether the firmware reported a key (e.g. "d1" or "dm").
+func (s *PowerStatus) Has(key string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.raw[key]
+	return ok
+}
+
+// inheritDewModes takes the heater modes of a previous status, for the {"set":...}
+// responses that don't report them.
+func (s *PowerStatus) inheritDewModes(previous *PowerStatus) {
+	if s.DewModes != nil || previous == nil || !previous.Has("dm") {
+		return
+	}
+	s.DewModes = previous.DewModes
+	if s.raw == nil {
+		s.raw = make(map[string]json.RawMessage)
+	}
+	s.raw["dm"] = previous.raw["dm"]
+}
+
+// OutputKeys lists the firmware keys of the power outputs, in the firmware's order.
+var OutputKeys = []string{"d1", "d2", "d3", "d4", "d5", "u12", "u34", "adj", "pwm1", "pwm2"}
+
+// Output returns the state of an output by its firmware key (e.g. "d1").
+// It is safe to call on a nil status (no status received yet).
+func (s *PowerStatus) Output(key string) (OutputValue, bool) {
+	if s == nil {
+		return OutputValue{}, false
+	}
+	var v OutputValue
+	switch key {
+	case "d1":
+		v = s.D1
+	case "d2":
+		v = s.D2
+	case "d3":
+		v = s.D3
+	case "d4":
+		v = s.D4
+	case "d5":
+		v = s.D5
+	case "u12":
+		v = s.U12
+	case "u34":
+		v = s.U34
+	case "adj":
+		v = s.Adj
+	case "pwm1":
+		v = s.PWM1
+	case "pwm2":
+		v = s.PWM2
+	default:
+		return OutputValue{}, false
+	}
+	return v, v.set
+}
+
+// HeaterMode returns the mode of a dew heater (0-based), if the status reported it.
+func (s *PowerStatus) HeaterMode(index int) (int, bool) {
+	if s == nil || index < 0 || index >= len(s.DewModes) {
+		return 0, false
+	}
+	return s.DewModes[index], true
+}
+
+// Validate checks that all outputs were reported with plausible values.
+func (s *PowerStatus) Validate() error {
+	var errs []error
+	for _, key := range OutputKeys {
+		v, ok := s.Output(key)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: missing", key))
+			continue
+		}
+		switch key {
+		case "adj":
+			if v.IsBool && v.Bool {
+				errs = append(errs, fmt.Errorf("adj: expected false or a voltage"))
+			} else if !v.IsBool && (v.Number < 0 || v.Number > maxAdjVoltage) {
+				errs = append(errs, fmt.Errorf("adj: %g V out of range", v.Number))
+			}
+		case "pwm1", "pwm2":
+			if !v.IsBool && (v.Number < 0 || v.Number > 100) {
+				errs = append(errs, fmt.Errorf("%s: %g%% out of range", key, v.Number))
+			}
+		default:
+			if v.IsBool || (v.Number != 0 && v.Number != 1) {
+				errs = append(errs, fmt.Errorf("%s: expected 0 or 1, got %s", key, v))
+			}
+		}
+	}
+	for i, mode := range s.DewModes {
+		if mode < HeaterModeManual || mode > HeaterModeDisabled {
+			errs = append(errs, fmt.Errorf("dm[%d]: unknown heater mode %d", i, mode))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ParseStatus decodes and validates a status message ({"status":{...},"dm":[...]}).
+// DewModes is nil if the message has no "dm" (the {"set":...} responses).
+func ParseStatus(raw string) (*PowerStatus, error) {
+	var msg struct {
+		Status   *PowerStatus    `json:"status"`
+		DewModes json.RawMessage `json:"dm"`
+	}
+	if err := json.Unmarshal([]byte(raw), &msg); err != nil {
+		return nil, err
+	}
+	if msg.Status == nil {
+		return nil, errors.New("missing 'status' object")
+	}
+	if msg.DewModes != nil {
+		if err := json.Unmarshal(msg.DewModes, &msg.Status.DewModes); err != nil {
+			return nil, fmt.Errorf("dm: %w", err)
+		}
+		if msg.Status.raw == nil {
+			msg.Status.raw = make(map[string]json.RawMessage)
+		}
+		msg.Status.raw["dm"] = msg.DewModes
+	}
+	if err := msg.Status.Validate(); err != nil {
+		return nil, err
+	}
+	return msg.Status, nil
+}
+
+// SensorValues is the response to {"get":"sensors"}. The firmware reports null for the values
+// of a missing or failed sensor. The JSON encoding is the message as reported (see PowerStatus).
+type SensorValues struct {
+	DewPoint     *float64 `json:"d"`      // °C
+	HumAmb       *float64 `json:"h_amb"`  // %
+	HeapFree     int64    `json:"hf"`     // Bytes
+	HeapMaxAlloc int64    `json:"hma"`    // Largest allocatable block
+	HeapMinFree  int64    `json:"hmf"`    // Lowest free heap since boot
+	HeapSize     int64    `json:"hs"`     // Bytes
+	Current      *float64 `json:"i"`      // mA
+	Power        *float64 `json:"p"`      // W
+	PWM1         float64  `json:"pwm1"`   // Heater duty cycle (%)
+	PWM2         float64  `json:"pwm2"`   // Heater duty cycle (%)
+	TempAmb      *float64 `json:"t_amb"`  // °C
+	TempLens     *float64 `json:"t_lens"` // °C
+	Voltage      *float64 `json:"v"`      // V
+
+	raw map[string]json.RawMessage // The reported keys and values
+}
+
+// sensorValuesFields is SensorValues without its JSON methods.
+type sensorValuesFields SensorValues
+
+// UnmarshalJSON decodes the known fields and keeps the message for MarshalJSON.
+func (s *SensorValues) UnmarshalJSON(data []byte) error {
+	var fields sensorValuesFields
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = SensorValues(fields)
+	s.raw = raw
+	return nil
+}
+
+// MarshalJSON writes the values as the firmware reported them, with the keys in alphabetical order.
+func (s SensorValues) MarshalJSON() ([]byte, error) {
+	if s.raw == nil {
+		return json.Marshal(sensorValuesFields(s))
+	}
+	return json.Marshal(s.raw)
+}
+
+// Has reports whether the firmware reported a key, even with a null value.
+func (s *SensorValues) Has(key string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.raw[key]
+	return ok
+}
+
+// Value returns a sensor value by its firmware key (e.g. "t_amb"), or false if the key is
+// unknown or the sensor reported no value. It is safe to call on nil (no values received yet).
+func (s *SensorValues) Value(key string) (float64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	var p *float64
+	switch key {
+	case "v":
+		p = s.Voltage
+	case "i":
+		p = s.Current
+	case "p":
+		p = s.Power
+	case "t_amb":
+		p = s.TempAmb
+	case "h_amb":
+		p = s.HumAmb
+	case "d":
+		p = s.DewPoint
+	case "t_lens":
+		p = s.TempLens
+	case "pwm1":
+		return s.PWM1, s.Has("pwm1")
+	case "pwm2":
+		return s.PWM2, s.Has("pwm2")
+	}
+	if p == nil {
+		return 0, false
+	}
+	return *p, true
+}
+
+// Validate checks that all reported values are plausible.
+func (s *SensorValues) Validate() error {
+	var errs []error
+	check := func(key string, min, max float64) {
+		if v, ok := s.Value(key); ok && (math.IsNaN(v) || v < min || v > max) {
+			errs = append(errs, fmt.Errorf("%s: %g out of range [%g, %g]", key, v, min, max))
+		}
+	}
+	check("v", 0, maxInputVolts)
+	check("i", -maxCurrentMA, maxCurrentMA)
+	check("p", -maxPowerW, maxPowerW)
+	check("t_amb", minTemperature, maxTemperature)
+	check("h_amb", minHumidity, maxHumidity)
+	check("d", minTemperature, maxTemperature)
+	check("t_lens", minTemperature, maxTemperature)
+	check("pwm1", 0, 100)
+	check("pwm2", 0, 100)
+	if s.HeapFree < 0 || s.HeapMaxAlloc < 0 || s.HeapMinFree < 0 || s.HeapSize < 0 {
+		errs = append(errs, errors.New("heap statistics must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// ParseSensors decodes and validates a sensors message.
+func ParseSensors(raw string) (*SensorValues, error) {
+	var s SensorValues
+	if err := json.Unmarshal([]byte(raw), &s); err != nil {
+		return nil, err
+	}
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// VersionInfo is the response to {"get":"version"}.
+type VersionInfo struct {
+	Version string `json:"version"`
+}
+
+// ParseVersion decodes and validates a version message.
+func ParseVersion(raw string) (*VersionInfo, error) {
+	var v VersionInfo
+	if err := json.Unmarshal([]byte(raw), &v); err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(v.Version) == "" {
+		return nil, errors.New("missing 'version'")
+	}
+	return &v, nil
+}
+
+// Validate checks the ranges of the firmware configuration.
+func (c *FirmwareConfig) Validate() error {
+	var errs []error
+	if len(c.DH) == 0 {
+		errs = append(errs, errors.New("dh: no dew heaters"))
+	}
+	ps := map[string]int{"d1": c.PS.DC1, "d2": c.PS.DC2, "d3": c.PS.DC3, "d4": c.PS.DC4, "d5": c.PS.DC5, "u12": c.PS.USBC12, "u34": c.PS.USB345, "adj": c.PS.AdjConv}
+	for key, state := range ps {
+		if state < 0 || state > 2 {
+			errs = append(errs, fmt.Errorf("ps.%s: unknown startup state %d", key, state))
+		}
+	}
+	for key, ms := range map[string]int{"i": c.UI.INA219, "s": c.UI.SHT40, "d": c.UI.DS18B20} {
+		if ms < 0 || ms > maxIntervalMs {
+			errs = append(errs, fmt.Errorf("ui.%s: %d ms out of range", key, ms))
+		}
+	}
+	for key, n := range map[string]int{"st": c.AC.SHT40Temp, "sh": c.AC.SHT40Humidity, "dt": c.AC.DS18B20Temp, "iv": c.AC.INA219Voltage, "ic": c.AC.INA219Current} {
+		if n < 0 || n > maxAvgCount {
+			errs = append(errs, fmt.Errorf("ac.%s: %d out of range [0, %d]", key, n, maxAvgCount))
+		}
+	}
+	if c.AV < 0 || c.AV > maxAdjVoltage {
+		errs = append(errs, fmt.Errorf("av: %g V out of range", c.AV))
+	}
+	for i, h := range c.DH {
+		if h.Mode < HeaterModeManual || h.Mode > HeaterModeDisabled {
+			errs = append(errs, fmt.Errorf("dh[%d].m: unknown heater mode %d", i, h.Mode))
+		}
+		if h.ManualPower < 0 || h.ManualPower > 100 {
+			errs = append(errs, fmt.Errorf("dh[%d].mp: %d%% out of range", i, h.ManualPower))
+		}
+		if h.MaxPower < 0 || h.MaxPower > 100 {
+			errs = append(errs, fmt.Errorf("dh[%d].xp: %d%% out of range", i, h.MaxPower))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// toMap converts a message to the generic form sent to the state stream, so clients get
+// exactly the values of the JSON endpoints.
+func toMap(v interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	if raw, err := json.Marshal(v); err == nil {
+		json.Unmarshal(raw, &m)
+	}
+	return m
+}
+
+func mustMarshal(v interface{}) string {
+	raw, _ := json.Marshal(v)
+	return string(raw)
+}
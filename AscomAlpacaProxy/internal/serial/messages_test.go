@@ -0,0 +1,223 @@
+package serial
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testStatus = `{"status":{"d1":1,"d2":0,"d3":0,"d4":1,"d5":0,"u12":1,"u34":0,"adj":7.5,"pwm1":true,"pwm2":40},"dm":[1,0]}`
+
+// legacyStatusJSON encodes a status message the way the proxy did before the typed structs:
+// the "status" object as a generic map with "dm" injected.
+func legacyStatusJSON(t *testing.T, raw string) string {
+	t.Helper()
+	var root map[string]interface{}
+	if err := json.Unmarshal([]byte(raw), &root); err != nil {
+		t.Fatal(err)
+	}
+	status := root["status"].(map[string]interface{})
+	if dm, ok := root["dm"]; ok {
+		status["dm"] = dm
+	}
+	out, err := json.Marshal(status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{"status with heater modes", testStatus, ""},
+		{"set response without heater modes", `{"status":{"d1":0,"d2":0,"d3":0,"d4":0,"d5":0,"u12":0,"u34":0,"adj":false,"pwm1":false,"pwm2":false}}`, ""},
+		{"unknown key", `{"status":{"d1":0,"d2":0,"d3":0,"d4":0,"d5":0,"u12":0,"u34":0,"adj":false,"pwm1":false,"pwm2":false,"d6":1}}`, ""},
+		{"missing status object", `{"dm":[0,0]}`, "missing 'status'"},
+		{"missing output", `{"status":{"d1":0}}`, "d2: missing"},
+		{"adj out of range", strings.Replace(testStatus, `"adj":7.5`, `"adj":16`, 1), "adj: 16 V out of range"},
+		{"adj reported as true", strings.Replace(testStatus, `"adj":7.5`, `"adj":true`, 1), "adj: expected false"},
+		{"duty cycle out of range", strings.Replace(testStatus, `"pwm2":40`, `"pwm2":101`, 1), "pwm2: 101% out of range"},
+		{"switched output not 0 or 1", strings.Replace(testStatus, `"d1":1`, `"d1":2`, 1), "d1: expected 0 or 1"},
+		{"unknown heater mode", strings.Replace(testStatus, `"dm":[1,0]`, `"dm":[1,9]`, 1), "dm[1]: unknown heater mode 9"},
+		{"output neither bool nor number", strings.Replace(testStatus, `"d1":1`, `"d1":"on"`, 1), "boolean or a number"},
+		{"garbled", `{"status":{"d1":`, "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseStatus(tt.raw)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseStatus() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseStatus() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPowerStatusAccessors(t *testing.T) {
+	status, err := ParseStatus(testStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key    string
+		isBool bool
+		number float64
+		on     bool
+	}{
+		{"d1", false, 1, true},
+		{"d2", false, 0, false},
+		{"adj", false, 7.5, true},
+		{"pwm1", true, 0, true},
+		{"pwm2", false, 40, true},
+	}
+	for _, tt := range tests {
+		v, ok := status.Output(tt.key)
+		if !ok {
+			t.Fatalf("Output(%q) not found", tt.key)
+		}
+		if v.IsBool != tt.isBool || v.Number != tt.number || v.IsOn() != tt.on {
+			t.Errorf("Output(%q) = %+v, want isBool %v, number %g, on %v", tt.key, v, tt.isBool, tt.number, tt.on)
+		}
+	}
+	if _, ok := status.Output("all"); ok {
+		t.Error(`Output("all") found`)
+	}
+	if mode, ok := status.HeaterMode(0); !ok || mode != HeaterModePID {
+		t.Errorf("HeaterMode(0) = %d, %v", mode, ok)
+	}
+	if _, ok := status.HeaterMode(2); ok {
+		t.Error("HeaterMode(2) found")
+	}
+	var none *PowerStatus
+	if _, ok := none.Output("d1"); ok {
+		t.Error("Output on nil status found")
+	}
+}
+
+func TestOutputValueRoundTrip(t *testing.T) {
+	for _, raw := range []string{"false", "true", "0", "1", "7.5", "40"} {
+		var v OutputValue
+		if err := json.Unmarshal([]byte(raw), &v); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", raw, err)
+		}
+		if got := v.String(); got != raw {
+			t.Errorf("round trip of %s = %s", raw, got)
+		}
+	}
+}
+
+func TestPowerStatusJSONMatchesFirmware(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  string
+	}{
+		{"status with heater modes", testStatus},
+		{"unknown key is kept", `{"status":{"d1":0,"d2":0,"d3":0,"d4":0,"d5":0,"u12":0,"u34":0,"adj":false,"pwm1":false,"pwm2":false,"d6":1}}`},
+		{"empty heater modes are kept", strings.Replace(testStatus, `"dm":[1,0]`, `"dm":[]`, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, err := ParseStatus(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := legacyStatusJSON(t, tt.raw); string(got) != want {
+				t.Errorf("Marshal() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestInheritDewModes(t *testing.T) {
+	previous, err := ParseStatus(testStatus)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := ParseStatus(`{"status":{"d1":0,"d2":0,"d3":0,"d4":0,"d5":0,"u12":0,"u34":0,"adj":false,"pwm1":false,"pwm2":false}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.inheritDewModes(previous)
+	if mode, ok := current.HeaterMode(0); !ok || mode != HeaterModePID {
+		t.Errorf("HeaterMode(0) = %d, %v after inheriting", mode, ok)
+	}
+	got, _ := json.Marshal(current)
+	if !strings.Contains(string(got), `"dm":[1,0]`) {
+		t.Errorf("Marshal() = %s, want the inherited dm", got)
+	}
+}
+
+func TestParseSensors(t *testing.T) {
+	const valid = `{"v":12.3,"i":850,"p":10.5,"t_amb":8.2,"h_amb":75,"d":4.1,"t_lens":null,"pwm1":30,"pwm2":0,"hf":150000,"hs":300000,"hmf":120000,"hma":90000}`
+	tests := []struct {
+		name    string
+		raw     string
+		wantErr string
+	}{
+		{"valid", valid, ""},
+		{"voltage out of range", strings.Replace(valid, `"v":12.3`, `"v":41`, 1), "v: 41 out of range"},
+		{"negative current allowed", strings.Replace(valid, `"i":850`, `"i":-850`, 1), ""},
+		{"humidity out of range", strings.Replace(valid, `"h_amb":75`, `"h_amb":120`, 1), "h_amb: 120 out of range"},
+		{"duty cycle out of range", strings.Replace(valid, `"pwm1":30`, `"pwm1":130`, 1), "pwm1: 130 out of range"},
+		{"negative heap", strings.Replace(valid, `"hf":150000`, `"hf":-1`, 1), "heap statistics"},
+		{"garbled", `{"v":`, "unexpected end"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseSensors(tt.raw)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ParseSensors() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ParseSensors() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSensorValues(t *testing.T) {
+	values, err := ParseSensors(`{"v":12.3,"t_lens":null,"pwm1":30,"x_new":1}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key   string
+		value float64
+		ok    bool
+	}{
+		{"v", 12.3, true},
+		{"t_lens", 0, false}, // Reported as null
+		{"t_amb", 0, false},  // Not reported
+		{"pwm1", 30, true},
+		{"pwm2", 0, false}, // Not reported
+		{"unknown", 0, false},
+	}
+	for _, tt := range tests {
+		if value, ok := values.Value(tt.key); value != tt.value || ok != tt.ok {
+			t.Errorf("Value(%q) = %g, %v, want %g, %v", tt.key, value, ok, tt.value, tt.ok)
+		}
+	}
+	if !values.Has("t_lens") || values.Has("t_amb") {
+		t.Errorf("Has() does not match the reported keys")
+	}
+	got, _ := json.Marshal(values)
+	if want := `{"pwm1":30,"t_lens":null,"v":12.3,"x_new":1}`; string(got) != want {
+		t.Errorf("Marshal() = %s, want %s", got, want)
+	}
+}
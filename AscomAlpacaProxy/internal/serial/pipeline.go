@@ -0,0 +1,354 @@
+package serial
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultCommandTimeout applies to commands sent without a deadline.
+	defaultCommandTimeout = 3 * time.Second
+	// minReadTimeout is the shortest time the processor waits for a response.
+	minReadTimeout = 200 * time.Millisecond
+	// maxQueuedCommands limits the number of commands waiting for the device.
+	maxQueuedCommands = 32
+	// maxHighPriorityBurst is the number of high-priority commands executed in a row while
+	// low-priority commands are waiting, so status polling is never starved.
+	maxHighPriorityBurst = 4
+)
+
+var (
+	// ErrQueueFull is returned if too many commands are waiting for the device.
+	ErrQueueFull = errors.New("serial command queue is full")
+	// ErrPortClosed is returned if the serial port is not open.
+	ErrPortClosed = errors.New("serial port is not open")
+)
+
+// noReplyCommands lists the commands the firmware does not answer, with the time it is busy
+// afterwards. The SHT40 drying cycle blocks the firmware's serial task for about a second.
+var noReplyCommands = map[string]time.Duration{
+	MaintenanceCommand(CommandDrySensor): 3 * time.Second,
+}
+
+// pendingCommand is a queued or executing command. Identical read commands share one
+// pendingCommand, so the device answers them only once.
+type pendingCommand struct {
+	command  string
+	kind     string // Statistics key, e.g. "get:status"
+	high     bool
+	busy     time.Duration // The firmware does not answer and is busy this long (see noReplyCommands)
+	deadline time.Time     // Latest deadline of the waiting callers
+	waiters  int
+	enqueued time.Time
+	started  time.Time
+	done     chan struct{}
+	response string
+	err      error
+}
+
+var (
+	queueMu       sync.Mutex
+	highQueue     []*pendingCommand
+	lowQueue      []*pendingCommand
+	inFlightReads = make(map[string]*pendingCommand) // Queued or executing read commands by command
+	highBurst     int
+	queueSignal   = make(chan struct{}, 1)
+)
+
+// SendCommand queues a command to be sent to the device and waits for the response.
+// The timeout covers the time in the queue and the execution (default: 3 seconds).
+func SendCommand(command string, isHighPriority bool, timeout time.Duration) (string, error) {
+	if timeout == 0 {
+		timeout = defaultCommandTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return SendCommandContext(ctx, command, isHighPriority)
+}
+
+// SendCommandContext queues a command and waits for the response until ctx is done.
+// A command whose callers have all given up before it was sent is not sent at all.
+// Identical read commands ({"get":...}) that are already queued or executing are not
+// sent again; the callers share the response.
+// For a command the firmware does not answer (see noReplyCommands), it returns an empty
+// response once the command was written.
+func SendCommandContext(ctx context.Context, command string, isHighPriority bool) (string, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		deadline = time.Now().Add(defaultCommandTimeout)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	pc, err := enqueue(command, isHighPriority, deadline)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case <-pc.done:
+		return pc.response, pc.err
+	case <-ctx.Done():
+		select {
+		case <-pc.done: // Finished at the same time.
+			return pc.response, pc.err
+		default:
+		}
+		if abandon(pc) {
+			recordCancelled(pc.kind)
+			return "", fmt.Errorf("command timed out waiting in queue: %w", ctx.Err())
+		}
+		return "", fmt.Errorf("command timed out waiting for response from device: %w", ctx.Err())
+	}
+}
+
+// isReadCommand reports whether a command only reads from the device and can be shared.
+func isReadCommand(command string) bool {
+	return strings.HasPrefix(command, `{"get":`)
+}
+
+func enqueue(command string, high bool, deadline time.Time) (*pendingCommand, error) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+
+	if isReadCommand(command) {
+		if pc, ok := inFlightReads[command]; ok {
+			pc.waiters++
+			if deadline.After(pc.deadline) {
+				pc.deadline = deadline
+			}
+			if high && !pc.high && pc.started.IsZero() {
+				// Promote the queued command for the high-priority caller.
+				lowQueue = removeCommand(lowQueue, pc)
+				highQueue = append(highQueue, pc)
+				pc.high = true
+			}
+			recordCoalesced(pc.kind)
+			logger.Debug("Coalescing command with identical pending command: %s", command)
+			return pc, nil
+		}
+	}
+
+	if len(highQueue)+len(lowQueue) >= maxQueuedCommands {
+		return nil, ErrQueueFull
+	}
+
+	pc := &pendingCommand{
+		command:  command,
+		kind:     commandKind(command),
+		high:     high,
+		busy:     noReplyCommands[command],
+		deadline: deadline,
+		waiters:  1,
+		enqueued: time.Now(),
+		done:     make(chan struct{}),
+	}
+	if high {
+		logger.Debug("Queueing high-priority command: %s", command)
+		highQueue = append(highQueue, pc)
+	} else {
+		logger.Debug("Queueing low-priority command: %s", command)
+		lowQueue = append(lowQueue, pc)
+	}
+	if isReadCommand(command) {
+		inFlightReads[command] = pc
+	}
+
+	select {
+	case queueSignal <- struct{}{}:
+	default:
+	}
+	return pc, nil
+}
+
+// abandon removes a caller from a command. If no caller is left and the command has not been
+// started, it is removed from the queue. It returns true if the command had not been started.
+func abandon(pc *pendingCommand) bool {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	pc.waiters--
+	if !pc.started.IsZero() {
+		return false
+	}
+	if pc.waiters == 0 {
+		highQueue = removeCommand(highQueue, pc)
+		lowQueue = removeCommand(lowQueue, pc)
+		if inFlightReads[pc.command] == pc {
+			delete(inFlightReads, pc.command)
+		}
+	}
+	return true
+}
+
+func removeCommand(queue []*pendingCommand, pc *pendingCommand) []*pendingCommand {
+	for i, c := range queue {
+		if c == pc {
+			return append(queue[:i], queue[i+1:]...)
+		}
+	}
+	return queue
+}
+
+// nextCommand waits for the next command to execute and marks it as started.
+func nextCommand() *pendingCommand {
+	for {
+		queueMu.Lock()
+		var pc *pendingCommand
+		switch {
+		case len(highQueue) > 0 && (highBurst < maxHighPriorityBurst || len(lowQueue) == 0):
+			pc, highQueue = highQueue[0], highQueue[1:]
+			highBurst++
+		case len(lowQueue) > 0:
+			pc, lowQueue = lowQueue[0], lowQueue[1:]
+			highBurst = 0
+		}
+		if pc != nil {
+			pc.started = time.Now()
+			queueMu.Unlock()
+			return pc
+		}
+		queueMu.Unlock()
+		<-queueSignal
+	}
+}
+
+// finishCommand delivers the result to all callers of a command.
+func finishCommand(pc *pendingCommand, response string, err error) {
+	queueMu.Lock()
+	if inFlightReads[pc.command] == pc {
+		delete(inFlightReads, pc.command)
+	}
+	queueMu.Unlock()
+
+	queueWait := pc.started.Sub(pc.enqueued)
+	execTime := time.Since(pc.started)
+	recordLatency(pc.kind, queueWait, execTime, err)
+	logger.Debug("Command %s: queued %v, executed in %v.", pc.kind, queueWait.Round(time.Millisecond), execTime.Round(time.Millisecond))
+
+	pc.response = response
+	pc.err = err
+	close(pc.done)
+}
+
+// readTimeout returns how long the processor waits for the response to a command.
+func (pc *pendingCommand) readTimeout() time.Duration {
+	queueMu.Lock()
+	deadline := pc.deadline
+	queueMu.Unlock()
+	return max(time.Until(deadline), minReadTimeout)
+}
+
+// commandKind returns the statistics key of a command, e.g. "get:status", "set" or "command:reboot".
+func commandKind(command string) string {
+	var doc map[string]json.RawMessage
+	if json.Unmarshal([]byte(command), &doc) != nil || len(doc) != 1 {
+		return "other"
+	}
+	for key, value := range doc {
+		if key == "get" || key == "command" {
+			var name string
+			if json.Unmarshal(value, &name) == nil {
+				return key + ":" + name
+			}
+		}
+		return key
+	}
+	return "other"
+}
+
+// --- Latency statistics ---
+
+// CommandStats holds the latency statistics of one kind of command.
+type CommandStats struct {
+	Command      string  `json:"command"`   // e.g. "get:status", "set", "sc"
+	Count        int64   `json:"count"`     // Commands sent to the device
+	Coalesced    int64   `json:"coalesced"` // Requests answered by an identical pending command
+	Cancelled    int64   `json:"cancelled"` // Requests given up while still queued
+	Errors       int64   `json:"errors"`
+	AvgQueueMs   float64 `json:"avg_queue_ms"`
+	MaxQueueMs   float64 `json:"max_queue_ms"`
+	LastQueueMs  float64 `json:"last_queue_ms"`
+	AvgExecMs    float64 `json:"avg_exec_ms"`
+	MaxExecMs    float64 `json:"max_exec_ms"`
+	LastExecMs   float64 `json:"last_exec_ms"`
+	totalQueueMs float64
+	totalExecMs  float64
+}
+
+// QueueStats describes the command queue and the latency per kind of command.
+type QueueStats struct {
+	QueuedHigh int            `json:"queued_high"`
+	QueuedLow  int            `json:"queued_low"`
+	Commands   []CommandStats `json:"commands"`
+	Polling    PollingStats   `json:"polling"`
+}
+
+var (
+	commandStats   = make(map[string]*CommandStats)
+	commandStatsMu sync.Mutex
+)
+
+func statsFor(kind string) *CommandStats {
+	s, ok := commandStats[kind]
+	if !ok {
+		s = &CommandStats{Command: kind}
+		commandStats[kind] = s
+	}
+	return s
+}
+
+func recordLatency(kind string, queueWait, execTime time.Duration, err error) {
+	commandStatsMu.Lock()
+	defer commandStatsMu.Unlock()
+	s := statsFor(kind)
+	queueMs := float64(queueWait.Microseconds()) / 1000
+	execMs := float64(execTime.Microseconds()) / 1000
+	s.Count++
+	if err != nil {
+		s.Errors++
+	}
+	s.totalQueueMs += queueMs
+	s.totalExecMs += execMs
+	s.AvgQueueMs = s.totalQueueMs / float64(s.Count)
+	s.AvgExecMs = s.totalExecMs / float64(s.Count)
+	s.MaxQueueMs = max(s.MaxQueueMs, queueMs)
+	s.MaxExecMs = max(s.MaxExecMs, execMs)
+	s.LastQueueMs = queueMs
+	s.LastExecMs = execMs
+}
+
+func recordCoalesced(kind string) {
+	commandStatsMu.Lock()
+	defer commandStatsMu.Unlock()
+	statsFor(kind).Coalesced++
+}
+
+func recordCancelled(kind string) {
+	commandStatsMu.Lock()
+	defer commandStatsMu.Unlock()
+	statsFor(kind).Cancelled++
+}
+
+// GetQueueStats returns the current queue length and the latency statistics per kind of command.
+func GetQueueStats() QueueStats {
+	queueMu.Lock()
+	stats := QueueStats{QueuedHigh: len(highQueue), QueuedLow: len(lowQueue), Commands: []CommandStats{}}
+	queueMu.Unlock()
+
+	commandStatsMu.Lock()
+	for _, s := range commandStats {
+		stats.Commands = append(stats.Commands, *s)
+	}
+	commandStatsMu.Unlock()
+	sort.Slice(stats.Commands, func(i, j int) bool { return stats.Commands[i].Command < stats.Commands[j].Command })
+	stats.Polling = GetPollingStats()
+	return stats
+}
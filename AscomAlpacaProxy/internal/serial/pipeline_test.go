@@ -0,0 +1,209 @@
+package serial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetQueue empties the command queue now and after the test. The tests drive the
+// queue directly, no processor runs.
+func resetQueue(t *testing.T) {
+	reset := func() {
+		queueMu.Lock()
+		highQueue, lowQueue = nil, nil
+		inFlightReads = make(map[string]*pendingCommand)
+		highBurst = 0
+		queueMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func queued() (high, low int) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	return len(highQueue), len(lowQueue)
+}
+
+func mustEnqueue(t *testing.T, command string, high bool) *pendingCommand {
+	t.Helper()
+	pc, err := enqueue(command, high, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("enqueue(%s) failed: %v", command, err)
+	}
+	return pc
+}
+
+func TestEnqueueCoalescing(t *testing.T) {
+	tests := []struct {
+		name       string
+		first      string
+		firstHigh  bool
+		second     string
+		secondHigh bool
+		started    bool // The first command is executing when the second arrives
+		shared     bool
+		wantHigh   bool // Priority of the shared command
+	}{
+		{name: "identical reads", first: `{"get":"status"}`, second: `{"get":"status"}`, shared: true},
+		{name: "different reads", first: `{"get":"status"}`, second: `{"get":"sensors"}`},
+		{name: "identical writes", first: `{"set":{"d1":true}}`, second: `{"set":{"d1":true}}`},
+		{name: "maintenance commands", first: `{"command":"dry_sensor"}`, second: `{"command":"dry_sensor"}`},
+		{name: "promoted by a high-priority caller", first: `{"get":"status"}`, second: `{"get":"status"}`, secondHigh: true, shared: true, wantHigh: true},
+		{name: "high priority kept", first: `{"get":"status"}`, firstHigh: true, second: `{"get":"status"}`, shared: true, wantHigh: true},
+		{name: "executing read", first: `{"get":"status"}`, second: `{"get":"status"}`, secondHigh: true, started: true, shared: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetQueue(t)
+			first := mustEnqueue(t, tt.first, tt.firstHigh)
+			if tt.started {
+				if pc := nextCommand(); pc != first {
+					t.Fatalf("nextCommand() = %s, want %s", pc.command, first.command)
+				}
+			}
+			second := mustEnqueue(t, tt.second, tt.secondHigh)
+
+			if shared := first == second; shared != tt.shared {
+				t.Fatalf("commands shared = %t, want %t", shared, tt.shared)
+			}
+			if !tt.shared {
+				return
+			}
+			if first.waiters != 2 {
+				t.Errorf("waiters = %d, want 2", first.waiters)
+			}
+			if first.high != tt.wantHigh {
+				t.Errorf("high = %t, want %t", first.high, tt.wantHigh)
+			}
+			high, low := queued()
+			if tt.started {
+				if high+low != 0 {
+					t.Errorf("queued = %d/%d, want an empty queue", high, low)
+				}
+			} else if tt.wantHigh && (high != 1 || low != 0) || !tt.wantHigh && (high != 0 || low != 1) {
+				t.Errorf("queued high/low = %d/%d, want the command once in the %s queue", high, low, map[bool]string{true: "high", false: "low"}[tt.wantHigh])
+			}
+
+			// Once answered, the next request is sent again.
+			finishCommand(first, `{"status":{}}`, nil)
+			if third := mustEnqueue(t, tt.second, false); third == first {
+				t.Error("a finished read command was shared")
+			}
+		})
+	}
+}
+
+func TestAbandon(t *testing.T) {
+	const command = `{"get":"sensors"}`
+	tests := []struct {
+		name        string
+		waiters     int
+		abandoned   int
+		started     bool
+		wantQueued  bool
+		wantInQueue bool // abandon reports the command as not started
+	}{
+		{name: "last caller", waiters: 1, abandoned: 1, wantInQueue: true},
+		{name: "one of two callers", waiters: 2, abandoned: 1, wantQueued: true, wantInQueue: true},
+		{name: "both callers", waiters: 2, abandoned: 2, wantInQueue: true},
+		{name: "executing", waiters: 1, abandoned: 1, started: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetQueue(t)
+			var pc *pendingCommand
+			for i := 0; i < tt.waiters; i++ {
+				pc = mustEnqueue(t, command, false)
+			}
+			if tt.started {
+				nextCommand()
+			}
+			for i := 0; i < tt.abandoned; i++ {
+				if got := abandon(pc); got != tt.wantInQueue {
+					t.Errorf("abandon() = %t, want %t", got, tt.wantInQueue)
+				}
+			}
+			high, low := queued()
+			if queuedNow := high+low > 0; queuedNow != tt.wantQueued {
+				t.Errorf("queued = %t, want %t", queuedNow, tt.wantQueued)
+			}
+			queueMu.Lock()
+			_, inFlight := inFlightReads[command]
+			queueMu.Unlock()
+			if wantInFlight := tt.wantQueued || tt.started; inFlight != wantInFlight {
+				t.Errorf("in flight = %t, want %t", inFlight, wantInFlight)
+			}
+		})
+	}
+}
+
+func TestSendCommandContextAbandonsQueuedCommand(t *testing.T) {
+	resetQueue(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := SendCommandContext(ctx, `{"get":"version"}`, false)
+	if err == nil || !strings.Contains(err.Error(), "waiting in queue") {
+		t.Fatalf("SendCommandContext() error = %v, want a queue timeout", err)
+	}
+	if high, low := queued(); high+low != 0 {
+		t.Errorf("queued = %d/%d, want an empty queue", high, low)
+	}
+}
+
+func TestHighPriorityBurst(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue string // Enqueued commands, H = high and L = low priority
+		want  string // Execution order
+	}{
+		{name: "low only", queue: "LLL", want: "LLL"},
+		{name: "high only", queue: "HHHHHH", want: "HHHHHH"},
+		{name: "high first", queue: "LHL", want: "HLL"},
+		{name: "burst limit", queue: "HHHHHHLL", want: "HHHHLHHL"},
+		{name: "burst limit twice", queue: "HHHHHHHHHHL", want: "HHHHLHHHHHH"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetQueue(t)
+			for i, p := range tt.queue {
+				// Writes, so nothing is shared.
+				mustEnqueue(t, fmt.Sprintf(`{"set":{"pwm1":%d}}`, i), p == 'H')
+			}
+			var order strings.Builder
+			for range tt.queue {
+				if nextCommand().high {
+					order.WriteByte('H')
+				} else {
+					order.WriteByte('L')
+				}
+			}
+			if order.String() != tt.want {
+				t.Errorf("order = %s, want %s", order.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	resetQueue(t)
+	for i := 0; i < maxQueuedCommands-1; i++ {
+		mustEnqueue(t, fmt.Sprintf(`{"set":{"pwm1":%d}}`, i), i%2 == 0)
+	}
+	read := mustEnqueue(t, `{"get":"status"}`, false)
+
+	if _, err := enqueue(`{"set":{"d1":true}}`, true, time.Now().Add(time.Second)); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("enqueue() on a full queue = %v, want ErrQueueFull", err)
+	}
+	// Joining a queued read adds no command.
+	if pc := mustEnqueue(t, `{"get":"status"}`, true); pc != read {
+		t.Error("a queued read was not shared while the queue was full")
+	}
+
+	nextCommand()
+	mustEnqueue(t, `{"set":{"d1":true}}`, false)
+}
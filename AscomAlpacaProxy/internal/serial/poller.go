@@ -0,0 +1,262 @@
+package serial
+
+import (
+	"errors"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/statestream"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// minPollInterval protects the device from misconfigured intervals.
+	minPollInterval = 250 * time.Millisecond
+	// pollCheckInterval is the longest the poller sleeps before it re-checks the client
+	// activity, so a client arriving during a long idle interval is served promptly.
+	pollCheckInterval = time.Second
+	// slowPollThreshold is the time after which a poll counts as slow and the interval backs off.
+	slowPollThreshold = time.Second
+	// maxPollBackoff is the largest factor the interval is multiplied with.
+	maxPollBackoff = 8
+)
+
+var (
+	// lastClientActivity is the time of the last client request (UnixNano, 0 = never).
+	lastClientActivity atomic.Int64
+	// refreshAfter makes the poller read every value that has not been updated since
+	// this time (UnixNano), e.g. after a set command.
+	refreshAfter  atomic.Int64
+	refreshSignal = make(chan struct{}, 1)
+	// pollPausedUntil stops polling while the device is busy (UnixNano, 0 = not paused).
+	pollPausedUntil atomic.Int64
+)
+
+// poller reads one kind of value from the device at an interval that depends on the
+// client activity and on how fast the device answers.
+type poller struct {
+	name       string
+	command    string
+	update     func(string)
+	lastUpdate func() time.Time                         // Last cache update, also by command responses
+	intervals  func(p *config.PollingConfig) (int, int) // Active and idle interval in ms
+
+	// Written by the poller goroutine, read by GetPollingStats.
+	backoff      int
+	interval     time.Duration // Interval including the backoff
+	lastPoll     time.Time
+	lastDuration time.Duration
+}
+
+var (
+	pollersMu sync.Mutex
+	pollers   = []*poller{
+		{
+			name:       "status",
+			command:    `{"get":"status"}`,
+			update:     updateStatusCacheFromJSON,
+			lastUpdate: func() time.Time { return Status.Load().UpdatedAt },
+			intervals:  func(p *config.PollingConfig) (int, int) { return p.StatusActiveMs, p.StatusIdleMs },
+			backoff:    1,
+		},
+		{
+			name:       "sensors",
+			command:    `{"get":"sensors"}`,
+			update:     updateConditionsCacheFromJSON,
+			lastUpdate: func() time.Time { return Conditions.Load().UpdatedAt },
+			intervals:  func(p *config.PollingConfig) (int, int) { return p.SensorsActiveMs, p.SensorsIdleMs },
+			backoff:    1,
+		},
+	}
+)
+
+// NoteClientActivity records a client request. While clients are active, the device is
+// polled at the faster active intervals.
+func NoteClientActivity() {
+	lastClientActivity.Store(time.Now().UnixNano())
+}
+
+// clientsActive reports whether a client made a request within the active window
+// or a live viewer is connected to the state stream.
+func clientsActive(conf *config.PollingConfig) bool {
+	if statestream.ClientCount() > 0 {
+		return true
+	}
+	last := lastClientActivity.Load()
+	window := time.Duration(conf.ActiveWindowSeconds) * time.Second
+	return last != 0 && time.Since(time.Unix(0, last)) < window
+}
+
+// requestRefresh makes the poller read all values that have not been updated since the time.
+// It is called by the command processor, so it MUST NOT block.
+func requestRefresh(since time.Time) {
+	refreshAfter.Store(since.UnixNano())
+	select {
+	case refreshSignal <- struct{}{}:
+	default:
+	}
+}
+
+// pausePolling stops polling for a while, e.g. while the device runs a command it does not answer.
+func pausePolling(d time.Duration) {
+	pollPausedUntil.Store(time.Now().Add(d).UnixNano())
+}
+
+// pollingConfig returns the polling configuration with defaults for missing values.
+func pollingConfig() *config.PollingConfig {
+	defaults := config.DefaultPollingConfig()
+	conf := config.Get()
+	if conf == nil || conf.Polling == nil {
+		return defaults
+	}
+	p := *conf.Polling
+	if p.StatusActiveMs <= 0 {
+		p.StatusActiveMs = defaults.StatusActiveMs
+	}
+	if p.StatusIdleMs <= 0 {
+		p.StatusIdleMs = defaults.StatusIdleMs
+	}
+	if p.SensorsActiveMs <= 0 {
+		p.SensorsActiveMs = defaults.SensorsActiveMs
+	}
+	if p.SensorsIdleMs <= 0 {
+		p.SensorsIdleMs = defaults.SensorsIdleMs
+	}
+	if p.ActiveWindowSeconds <= 0 {
+		p.ActiveWindowSeconds = defaults.ActiveWindowSeconds
+	}
+	return &p
+}
+
+// runPoller keeps the status and sensor caches up to date.
+func runPoller(initDone chan struct{}) {
+	logger.Info("Periodic cache update task started. Waiting for initial signal...")
+	<-initDone
+	logger.Info("Initial signal received. Starting cache updates.")
+
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-refreshSignal:
+		}
+		if until := time.Unix(0, pollPausedUntil.Load()); time.Now().Before(until) {
+			timer.Reset(time.Until(until))
+			continue
+		}
+
+		conf := pollingConfig()
+		active := clientsActive(conf)
+		next := time.Now().Add(pollCheckInterval)
+		for _, p := range pollers {
+			due := p.nextPoll(conf, active)
+			if !time.Now().Before(due) {
+				p.poll()
+				due = p.nextPoll(conf, active)
+			}
+			if due.Before(next) {
+				next = due
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
+
+// nextPoll returns the time the value should be read next.
+func (p *poller) nextPoll(conf *config.PollingConfig, active bool) time.Time {
+	activeMs, idleMs := p.intervals(conf)
+	ms := idleMs
+	if active {
+		ms = activeMs
+	}
+
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+	p.interval = max(time.Duration(ms)*time.Millisecond, minPollInterval) * time.Duration(p.backoff)
+
+	last := p.lastPoll
+	if updated := p.lastUpdate(); updated.After(last) {
+		last = updated
+	}
+	if refresh := refreshAfter.Load(); last.UnixNano() < refresh {
+		return time.Time{}
+	}
+	return last.Add(p.interval)
+}
+
+// poll reads the value from the device and adjusts the backoff to the response time.
+func (p *poller) poll() {
+	if !IsConnected() {
+		p.recordPoll(time.Now(), 0, 1)
+		return
+	}
+
+	start := time.Now()
+	response, err := SendCommand(p.command, false, 0)
+	duration := time.Since(start)
+	if err == nil {
+		p.update(response)
+	} else if !errors.Is(err, ErrPortClosed) {
+		logger.Warn("Failed to get %s for cache update: %v", p.name, err)
+	}
+
+	pollersMu.Lock()
+	backoff := p.backoff
+	pollersMu.Unlock()
+	switch {
+	case errors.Is(err, ErrPortClosed):
+		backoff = 1
+	case err != nil || duration > slowPollThreshold:
+		if backoff < maxPollBackoff {
+			backoff *= 2
+			logger.Warn("Device is slow to answer %s polls (%v). Polling %dx less often.", p.name, duration.Round(time.Millisecond), backoff)
+		}
+	case backoff > 1:
+		backoff /= 2
+		if backoff == 1 {
+			logger.Info("Device answers %s polls promptly again. Back to the normal interval.", p.name)
+		}
+	}
+	p.recordPoll(start, duration, backoff)
+}
+
+func (p *poller) recordPoll(at time.Time, duration time.Duration, backoff int) {
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+	p.lastPoll = at
+	p.lastDuration = duration
+	p.backoff = backoff
+}
+
+// PollStats describes the current polling of one kind of value.
+type PollStats struct {
+	Name           string    `json:"name"`
+	IntervalMs     int64     `json:"interval_ms"` // Current interval including the backoff
+	Backoff        int       `json:"backoff"`     // Factor applied because the device answers slowly
+	LastPoll       time.Time `json:"last_poll"`
+	LastDurationMs float64   `json:"last_duration_ms"`
+}
+
+// PollingStats describes the polling of the status and sensor values.
+type PollingStats struct {
+	ClientsActive bool        `json:"clients_active"`
+	Pollers       []PollStats `json:"pollers"`
+}
+
+// GetPollingStats returns the current polling intervals and backoff.
+func GetPollingStats() PollingStats {
+	stats := PollingStats{ClientsActive: clientsActive(pollingConfig()), Pollers: []PollStats{}}
+	pollersMu.Lock()
+	defer pollersMu.Unlock()
+	for _, p := range pollers {
+		stats.Pollers = append(stats.Pollers, PollStats{
+			Name:           p.name,
+			IntervalMs:     p.interval.Milliseconds(),
+			Backoff:        p.backoff,
+			LastPoll:       p.lastPoll,
+			LastDurationMs: float64(p.lastDuration.Microseconds()) / 1000,
+		})
+	}
+	return stats
+}
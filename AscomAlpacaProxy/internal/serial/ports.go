@@ -0,0 +1,483 @@
+package serial
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+	"go.bug.st/serial/enumerator"
+)
+
+const (
+	// hotplugInterval is how often the serial ports are listed to notice added and removed ports.
+	hotplugInterval = 2 * time.Second
+	// probeTimeout is the hard limit for probing one port.
+	probeTimeout = 4 * time.Second
+	// minProbeBackoff and maxProbeBackoff limit the wait before a failed port is tried again.
+	// The wait doubles with every failure.
+	minProbeBackoff = 5 * time.Second
+	maxProbeBackoff = 5 * time.Minute
+	// probeJitter spreads the retries (±20 %), so several failing ports are not probed together.
+	probeJitter = 0.2
+)
+
+// errNotFound is returned by FindPort if no port answered like an SV241.
+var errNotFound = errors.New("could not find SV241 device on any USB serial port")
+
+// portState is what the proxy knows about a serial port listed by the system.
+type portState struct {
+	details    enumerator.PortDetails
+	lastProbe  time.Time
+	lastResult string // "found" or the reason the port was not used
+	failures   int    // Failed attempts in a row
+	nextProbe  time.Time
+}
+
+// ports holds the serial ports of the last listing. Ports that appear are tried right away;
+// ports that fail are retried with an exponential backoff.
+var ports struct {
+	sync.Mutex
+	known  map[string]*portState
+	listed bool // The last listing succeeded
+}
+
+// scanMutex serializes everything that opens serial ports other than the open connection:
+// the connection manager, FindPort, ProbePort and Reconnect. Without it, two of them could
+// open the same port at once and the loser would record a false failure and a backoff.
+// It MUST be taken before portMutex.
+var scanMutex sync.Mutex
+
+// refreshPorts lists the serial ports and updates the known ports: ports that appeared are
+// added (and so tried right away), ports that were removed are dropped with their backoff.
+func refreshPorts() error {
+	list, err := enumerator.GetDetailedPortsList()
+
+	ports.Lock()
+	defer ports.Unlock()
+	if err != nil {
+		ports.listed = false
+		return err
+	}
+	// The first listing after startup is not logged; those ports were there all along.
+	first := ports.known == nil
+	if first {
+		ports.known = make(map[string]*portState)
+	}
+	ports.listed = true
+
+	seen := make(map[string]bool, len(list))
+	for _, details := range list {
+		seen[details.Name] = true
+		if st, ok := ports.known[details.Name]; ok {
+			st.details = *details
+			continue
+		}
+		ports.known[details.Name] = &portState{details: *details}
+		if !first {
+			logger.Info("New serial port %s detected.", details.Name)
+		}
+	}
+	for name := range ports.known {
+		if !seen[name] {
+			logger.Info("Serial port %s was removed.", name)
+			delete(ports.known, name)
+		}
+	}
+	return nil
+}
+
+// portDue reports whether a port may be tried now. Ports that are not listed are only tried
+// if the ports could not be listed.
+func portDue(name string) bool {
+	ports.Lock()
+	defer ports.Unlock()
+	st, ok := ports.known[name]
+	if !ok {
+		return !ports.listed
+	}
+	return !time.Now().Before(st.nextProbe)
+}
+
+// dueUSBPorts returns the USB serial ports that may be probed now.
+func dueUSBPorts() []string {
+	ports.Lock()
+	defer ports.Unlock()
+	now := time.Now()
+	var due []string
+	for name, st := range ports.known {
+		if st.details.IsUSB && !now.Before(st.nextProbe) {
+			due = append(due, name)
+		}
+	}
+	sort.Strings(due)
+	return due
+}
+
+// recordProbe stores the result of an attempt to use a port. After a failure, the port is
+// not tried again before the backoff has passed.
+func recordProbe(name string, err error) {
+	ports.Lock()
+	defer ports.Unlock()
+	if ports.known == nil {
+		ports.known = make(map[string]*portState)
+	}
+	st, ok := ports.known[name]
+	if !ok {
+		st = &portState{details: enumerator.PortDetails{Name: name}}
+		ports.known[name] = st
+	}
+	st.lastProbe = time.Now()
+	if err == nil {
+		st.lastResult = "found"
+		st.failures = 0
+		st.nextProbe = time.Time{}
+		return
+	}
+	st.lastResult = err.Error()
+	st.failures++
+	st.nextProbe = st.lastProbe.Add(probeBackoff(st.failures))
+}
+
+// probeBackoff returns the wait after the given number of failures in a row.
+func probeBackoff(failures int) time.Duration {
+	backoff := minProbeBackoff
+	for i := 1; i < failures && backoff < maxProbeBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxProbeBackoff)
+	jitter := 1 + probeJitter*(2*rand.Float64()-1)
+	return time.Duration(float64(backoff) * jitter)
+}
+
+// resetProbeBackoff makes all ports due again, e.g. when the user starts a scan.
+func resetProbeBackoff() {
+	ports.Lock()
+	defer ports.Unlock()
+	for _, st := range ports.known {
+		st.nextProbe = time.Time{}
+	}
+}
+
+// PortInfo describes a serial port of the system for the API.
+type PortInfo struct {
+	Name         string     `json:"name"`
+	IsUSB        bool       `json:"is_usb"`
+	VID          string     `json:"vid,omitempty"`
+	PID          string     `json:"pid,omitempty"`
+	SerialNumber string     `json:"serial_number,omitempty"`
+	Product      string     `json:"product,omitempty"`
+	Connected    bool       `json:"connected"` // The proxy is connected to the SV241 on this port
+	LastProbe    *time.Time `json:"last_probe,omitempty"`
+	LastResult   string     `json:"last_result,omitempty"` // "found" or the reason the port was not used
+	// Failed probes in a row; the port is not probed automatically before NextProbe.
+	FailedProbes int        `json:"failed_probes"`
+	NextProbe    *time.Time `json:"next_probe,omitempty"`
+}
+
+// ListPorts lists the serial ports of the system with the last probe result of each port.
+func ListPorts() ([]PortInfo, error) {
+	if err := refreshPorts(); err != nil {
+		return nil, err
+	}
+	info := GetConnectionInfo()
+
+	ports.Lock()
+	defer ports.Unlock()
+	list := make([]PortInfo, 0, len(ports.known))
+	for name, st := range ports.known {
+		p := PortInfo{
+			Name:         name,
+			IsUSB:        st.details.IsUSB,
+			VID:          st.details.VID,
+			PID:          st.details.PID,
+			SerialNumber: st.details.SerialNumber,
+			Product:      st.details.Product,
+			Connected:    info.Connected() && info.Port == name,
+			LastResult:   st.lastResult,
+			FailedProbes: st.failures,
+		}
+		if !st.lastProbe.IsZero() {
+			lastProbe := st.lastProbe
+			p.LastProbe = &lastProbe
+		}
+		if st.nextProbe.After(time.Now()) {
+			nextProbe := st.nextProbe
+			p.NextProbe = &nextProbe
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// ErrUnknownPort is returned by ProbePort for a port the system does not list.
+var ErrUnknownPort = errors.New("serial port not found on the system")
+
+// ErrReconnectPaused is returned by ProbePort while the port is released for the web flasher.
+var ErrReconnectPaused = errors.New("serial port is released; resume auto-reconnect first")
+
+// ProbePort probes a port on demand, regardless of its backoff, and connects to it if an
+// SV241 answers. A connection on another port is closed only after the probe succeeded.
+func ProbePort(name string) error {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+	if IsReconnectPaused() {
+		return ErrReconnectPaused
+	}
+	if err := refreshPorts(); err != nil {
+		logger.Warn("ProbePort: Failed to list serial ports: %v", err)
+	} else if !portListed(name) {
+		return ErrUnknownPort
+	}
+	if info := GetConnectionInfo(); info.Connected() && info.Port == name {
+		return nil // The open port cannot be probed, and it is the SV241 already.
+	}
+
+	logger.Info("Probing port %s (requested via API).", name)
+	probingStarted()
+	err := probePortWithTimeout(name, probeTimeout)
+	recordProbe(name, err)
+	if err != nil {
+		probingFailed(fmt.Errorf("%s: %w", name, err))
+		return err
+	}
+
+	portMutex.Lock()
+	defer portMutex.Unlock()
+	if IsReconnectPaused() {
+		return ErrReconnectPaused
+	}
+	logger.Info("Found device on port %s. Connecting...", name)
+	reconnect(name)
+	if sv241Port == nil {
+		err := errors.New("failed to open port")
+		recordProbe(name, err)
+		return err
+	}
+	return nil
+}
+
+// portListed reports whether the last listing contained the port.
+func portListed(name string) bool {
+	ports.Lock()
+	defer ports.Unlock()
+	_, ok := ports.known[name]
+	return ok
+}
+
+// ManageConnection is a background task that ensures the device stays connected.
+// It watches the serial ports and, while disconnected, tries new ports right away and
+// failed ones with a growing delay. Ports are probed without holding portMutex, so
+// a scan never delays commands.
+func ManageConnection(initDone chan struct{}) {
+	logger.Info("Connection manager task started. Waiting for initial signal...")
+	<-initDone
+	logger.Info("Initial signal received. Starting connection management.")
+
+	for {
+		time.Sleep(hotplugInterval)
+		if IsReconnectPaused() {
+			logger.Debug("Connection Manager: Reconnect is paused. Skipping.")
+			continue
+		}
+
+		if err := refreshPorts(); err != nil {
+			logger.Debug("Connection Manager: Failed to list serial ports: %v", err)
+		}
+
+		if portIsOpen() {
+			continue
+		}
+		connectToDevice()
+	}
+}
+
+// portIsOpen reports whether the port to the SV241 is open.
+func portIsOpen() bool {
+	portMutex.Lock()
+	defer portMutex.Unlock()
+	return sv241Port != nil
+}
+
+// connectToDevice tries the configured port and, if auto-detection is enabled, probes the
+// USB ports that are due.
+func connectToDevice() {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+	if portIsOpen() {
+		return // Connected while waiting for a scan started from the API.
+	}
+	conf := config.Get()
+	target := conf.SerialPortName
+	autoDetect := conf.AutoDetectPort
+
+	if target != "" && portDue(target) {
+		logger.Info("Connection Manager: Trying configured port '%s' for reconnection.", target)
+		if openPort(target) {
+			return
+		}
+		if autoDetect {
+			logger.Warn("Connection Manager: Configured port '%s' failed. Falling back to auto-detection.", target)
+			conf.SerialPortName = "" // Leeren, damit der nächste Versuch den Autoscan nutzt
+			config.Save()
+		}
+	}
+	// Wenn Auto-Detect AUS ist, versuchen wir NUR den konfigurierten Port.
+	if !autoDetect && target != "" {
+		return
+	}
+
+	due := dueUSBPorts()
+	if len(due) == 0 {
+		return
+	}
+	probingStarted()
+	for _, name := range due {
+		logger.Info("Probing port: %s", name)
+		err := probePortWithTimeout(name, probeTimeout)
+		recordProbe(name, err)
+		if err == nil {
+			logger.Info("Connection Manager: Found device on port %s. Connecting...", name)
+			if openPort(name) {
+				return
+			}
+		}
+	}
+	probingFailed(errNotFound)
+}
+
+// openPort opens the port to the SV241 and records a failure for the backoff.
+func openPort(name string) bool {
+	portMutex.Lock()
+	defer portMutex.Unlock()
+	if IsReconnectPaused() {
+		return false
+	}
+	if sv241Port != nil {
+		return true // Connected in the meantime, e.g. from the settings page.
+	}
+	reconnect(name)
+	if sv241Port == nil {
+		recordProbe(name, fmt.Errorf("failed to open port"))
+		return false
+	}
+	return true
+}
+
+// FindPort probes all USB serial ports, regardless of the backoff, to find the SV241 device.
+// It waits for a running scan of the connection manager or ProbePort.
+func FindPort() (string, error) {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
+	if err := refreshPorts(); err != nil {
+		logger.Warn("FindPort: enumerator.GetDetailedPortsList returned an error: %v.", err)
+	}
+	resetProbeBackoff()
+	due := dueUSBPorts()
+	if len(due) == 0 {
+		err := errors.New("no USB serial ports found on the system")
+		probingFailed(err)
+		return "", err
+	}
+
+	probingStarted()
+	logger.Info("Found %d USB serial ports. Probing for SV241 device...", len(due))
+	for _, name := range due {
+		logger.Info("Probing port: %s", name)
+		err := probePortWithTimeout(name, probeTimeout)
+		recordProbe(name, err)
+		if err == nil {
+			return name, nil
+		}
+	}
+	probingFailed(errNotFound)
+	return "", errNotFound
+}
+
+// probePortWithTimeout probes a port with a hard timeout that guarantees cleanup.
+// Uses a goroutine for the actual probe, but closes the port if timeout occurs.
+// It returns nil if the port answered like an SV241, or the reason it did not.
+func probePortWithTimeout(portName string, timeout time.Duration) error {
+	resultChan := make(chan error, 1)
+
+	// Shared variable for port handle - allows cleanup on timeout
+	var probePort serial.Port
+	var probeMutex sync.Mutex
+
+	go func() {
+		mode := &serial.Mode{BaudRate: 115200}
+		p, err := serial.Open(portName, mode)
+		if err != nil {
+			logger.Warn("Could not open port %s to probe: %v", portName, err)
+			resultChan <- fmt.Errorf("could not open port: %w", err)
+			return
+		}
+
+		// Store port handle for potential cleanup
+		probeMutex.Lock()
+		probePort = p
+		probeMutex.Unlock()
+
+		// Set read timeout
+		p.SetReadTimeout(2 * time.Second)
+
+		_, err = p.Write([]byte("{\"get\":\"sensors\"}\n"))
+		if err != nil {
+			logger.Debug("Port %s: Write failed: %v", portName, err)
+			p.Close()
+			resultChan <- fmt.Errorf("write failed: %w", err)
+			return
+		}
+
+		reader := bufio.NewReader(p)
+		line, err := reader.ReadString('\n')
+		p.Close() // Close immediately after read
+
+		// Clear the shared handle since we closed it
+		probeMutex.Lock()
+		probePort = nil
+		probeMutex.Unlock()
+
+		if err != nil {
+			logger.Debug("Port %s: Read failed or timed out: %v", portName, err)
+			resultChan <- errors.New("no answer")
+			return
+		}
+
+		var js json.RawMessage
+		if json.Unmarshal([]byte(line), &js) == nil {
+			logger.Info("Successfully probed port: %s", portName)
+			resultChan <- nil
+			return
+		}
+
+		logger.Debug("Port %s: Response was not valid JSON: %s", portName, line)
+		resultChan <- errors.New("answer is not from an SV241")
+	}()
+
+	// Wait for result with hard timeout
+	select {
+	case err := <-resultChan:
+		return err
+	case <-time.After(timeout):
+		logger.Warn("Port %s: Probe timed out after %v. Forcing cleanup.", portName, timeout)
+
+		// Force close the port if goroutine is still holding it
+		probeMutex.Lock()
+		if probePort != nil {
+			probePort.Close()
+			probePort = nil
+		}
+		probeMutex.Unlock()
+
+		return fmt.Errorf("probe timed out after %v", timeout)
+	}
+}
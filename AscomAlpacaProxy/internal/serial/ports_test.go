@@ -0,0 +1,37 @@
+package serial
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		base     time.Duration
+	}{
+		{0, minProbeBackoff},
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{6, 160 * time.Second},
+		{7, maxProbeBackoff}, // 320s, capped
+		{100, maxProbeBackoff},
+	}
+	for _, tt := range tests {
+		low := time.Duration(float64(tt.base) * (1 - probeJitter))
+		high := time.Duration(float64(tt.base) * (1 + probeJitter))
+		shortest, longest := high, low
+		for i := 0; i < 1000; i++ {
+			d := probeBackoff(tt.failures)
+			if d < low || d > high {
+				t.Fatalf("probeBackoff(%d) = %v, want %v to %v", tt.failures, d, low, high)
+			}
+			shortest, longest = min(shortest, d), max(longest, d)
+		}
+		// The jitter spreads the probes of several ports, so the waits must differ.
+		if longest-shortest < time.Duration(float64(tt.base)*probeJitter) {
+			t.Errorf("probeBackoff(%d) ranged from %v to %v, want a jitter of ±%.0f%%", tt.failures, shortest, longest, probeJitter*100)
+		}
+	}
+}
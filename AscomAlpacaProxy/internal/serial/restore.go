@@ -0,0 +1,165 @@
+package serial
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// restoreSettleDelay gives the firmware time to finish its setup after a restart
+	// before the outputs are compared.
+	restoreSettleDelay = 3 * time.Second
+	// outputTolerance is the difference below which a voltage or duty cycle counts as unchanged.
+	outputTolerance = 0.05
+)
+
+// commanded holds the last value the clients commanded for each output, as the device
+// reported it in the response (firmware key -> value). Outputs that were never switched
+// through the proxy are not included.
+var commanded struct {
+	sync.Mutex
+	values map[string]OutputValue
+}
+
+// checkingOutputs is set while the outputs are compared after a restart, so the triggers
+// of one restart (boot banner, reconnect, heap statistics) result in one check.
+var checkingOutputs atomic.Bool
+
+// GetCommandedState returns the last commanded value of each output switched through the proxy.
+func GetCommandedState() map[string]OutputValue {
+	commanded.Lock()
+	defer commanded.Unlock()
+	values := make(map[string]OutputValue, len(commanded.values))
+	for key, value := range commanded.values {
+		values[key] = value
+	}
+	return values
+}
+
+// rememberCommandedState records the outputs of a {"set":...} command with the values the
+// device reported in its response. It is called by the command processor.
+func rememberCommandedState(command, response string) {
+	var doc struct {
+		Set map[string]json.RawMessage `json:"set"`
+	}
+	if json.Unmarshal([]byte(command), &doc) != nil || len(doc.Set) == 0 {
+		return
+	}
+	status, err := ParseStatus(response)
+	if err != nil {
+		return // Rejected or garbled, so the device state is unknown.
+	}
+
+	keys := OutputKeys
+	if _, all := doc.Set["all"]; !all {
+		keys = make([]string, 0, len(doc.Set))
+		for key := range doc.Set {
+			keys = append(keys, key)
+		}
+	}
+
+	commanded.Lock()
+	defer commanded.Unlock()
+	if commanded.values == nil {
+		commanded.values = make(map[string]OutputValue)
+	}
+	for _, key := range keys {
+		if value, ok := status.Output(key); ok {
+			commanded.values[key] = value
+		}
+	}
+}
+
+// forgetCommandedState clears the remembered outputs, e.g. after a factory reset, when the
+// outputs are expected to be at their defaults.
+func forgetCommandedState() {
+	commanded.Lock()
+	defer commanded.Unlock()
+	commanded.values = nil
+}
+
+// heapStatsReset reports whether the lowest free heap since boot went up, which only
+// happens when the device restarted.
+func heapStatsReset(previous, current *SensorValues) bool {
+	return previous != nil && previous.HeapMinFree > 0 && current.HeapMinFree > previous.HeapMinFree
+}
+
+// sameOutput compares two output values, ignoring rounding of voltages and duty cycles.
+func sameOutput(a, b OutputValue) bool {
+	if a.IsBool != b.IsBool {
+		return false
+	}
+	if a.IsBool {
+		return a.Bool == b.Bool
+	}
+	return math.Abs(a.Number-b.Number) < outputTolerance
+}
+
+// checkOutputsAfterRestart compares the outputs with the commanded values after the device
+// may have restarted, and sends the commanded values again if this is enabled.
+// It waits for the device and the command queue, so it MUST run in its own goroutine.
+func checkOutputsAfterRestart(trigger string) {
+	if !checkingOutputs.CompareAndSwap(false, true) {
+		return
+	}
+	defer checkingOutputs.Store(false)
+
+	want := GetCommandedState()
+	if len(want) == 0 {
+		return
+	}
+	time.Sleep(restoreSettleDelay)
+
+	response, err := SendCommand(`{"get":"status"}`, true, 5*time.Second)
+	if err != nil {
+		logger.Warn("Restart check (%s): Failed to read the outputs: %v", trigger, err)
+		return
+	}
+	status, err := ParseStatus(response)
+	if err != nil {
+		logger.Warn("Restart check (%s): Invalid status: %v", trigger, err)
+		return
+	}
+
+	reset := make(map[string]interface{})
+	var names []string
+	for key, value := range want {
+		if current, _ := status.Output(key); !sameOutput(current, value) {
+			reset[key] = value
+			names = append(names, switchNameForKey(key))
+		}
+	}
+	if len(reset) == 0 {
+		logger.Debug("Restart check (%s): All outputs match the last commands.", trigger)
+		return
+	}
+	sort.Strings(names)
+	logger.Warn("Device restart (%s): Outputs no longer match the last commands: %s.", trigger, strings.Join(names, ", "))
+
+	event := events.OutputsReset{Trigger: trigger, Outputs: reset}
+	if !config.Get().RestoreStateAfterRestart {
+		logger.Warn("Restoring outputs after a restart is disabled in the proxy settings. The outputs are left as they are.")
+		events.Publish(event)
+		return
+	}
+
+	command := mustMarshal(map[string]interface{}{"set": reset})
+	logger.Info("Restoring outputs after device restart: %s", command)
+	if _, err := SendAuditedCommand(audit.Internal, "restore_outputs", command, 5*time.Second); err != nil {
+		logger.Error("Failed to restore outputs after device restart: %v", err)
+		event.Error = err.Error()
+	} else {
+		logger.Info("Outputs restored after device restart.")
+		event.Restored = true
+	}
+	events.Publish(event)
+}
@@ -1,14 +1,13 @@
 package serial
 
 import (
-	"bufio"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
 	"sv241pro-alpaca-proxy/internal/config"
 	"sv241pro-alpaca-proxy/internal/events"
 	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/statestream"
 	"sync"
 	"time"
 
@@ -16,55 +15,33 @@ import (
 	"go.bug.st/serial/enumerator"
 )
 
-// Command defines a command to be sent to the serial device.
-type Command struct {
-	Command  string
-	Response chan<- string
-	Error    chan<- error
-	Timeout  time.Duration
-}
-
-// StatusCache stores the latest power status from the device.
-type StatusCache struct {
-	Data map[string]interface{}
-	*sync.RWMutex
-}
-
-// ConditionsCache stores the latest sensor readings from the device.
-type ConditionsCache struct {
-	Data map[string]interface{}
-	*sync.RWMutex
-}
-
 var (
-	highPriorityCommands = make(chan Command)
-	lowPriorityCommands  = make(chan Command)
-	sv241Port            serial.Port
-	portMutex            = &sync.Mutex{}
-	firmwareVersion      = "unknown"
+	sv241Port       serial.Port
+	portMutex       = &sync.Mutex{}
+	firmwareVersion = "unknown"
 
 	// Caches are managed within the serial package
-	Status     = &StatusCache{RWMutex: &sync.RWMutex{}}
-	Conditions = &ConditionsCache{RWMutex: &sync.RWMutex{}}
+	Status     = &StatusCache{}
+	Conditions = &ConditionsCache{}
 
 	// Memory logging state
-	lastLoggedHeapFree     float64
-	lastLoggedHeapMinFree  float64
-	lastLoggedHeapMaxAlloc float64
-	lastLoggedHeapSize     float64
+	lastLoggedHeapFree     int64
+	lastLoggedHeapMinFree  int64
+	lastLoggedHeapMaxAlloc int64
+	lastLoggedHeapSize     int64
 	lastMemoryLogTime      time.Time
 
-	// lastSentStatus tracks the last connection status event sent to avoid duplicate notifications.
-	lastSentStatus events.ComPortStatus = events.Disconnected
+	// connectedEventSent tracks whether the last published connection event was "connected",
+	// so every connect and disconnect is only published once.
+	connectedEventSent = false
+
+	// sensorFaults tracks which sensors currently report no values (see checkSensorFaults).
+	sensorFaults = make(map[string]bool)
 
 	// ActiveVoltageTarget tracks the last set voltage for the "adj" output (RAM target).
 	// Initialized to -1.0 to indicate "unknown/unset" (use config default).
 	ActiveVoltageTarget = -1.0
 	VoltageMutex        sync.RWMutex
-
-	// reconnectPaused prevents the connection manager from auto-reconnecting.
-	// Used when the flasher releases the port for external access.
-	reconnectPaused = false
 )
 
 // StartManager initializes all background tasks for serial communication.
@@ -73,7 +50,7 @@ func StartManager() {
 
 	go ProcessCommands()
 	go ManageConnection(initDone)
-	go periodicCacheUpdater(initDone)
+	go runPoller(initDone)
 
 	// Perform an initial, synchronous connection attempt.
 	logger.Info("Performing initial device connection attempt...")
@@ -110,11 +87,10 @@ func StartManager() {
 
 }
 
-// IsConnected returns the current connection status of the serial port.
+// IsConnected returns true if the serial port to the device is open.
+// It uses the connection state, so it never waits for a running command.
 func IsConnected() bool {
-	portMutex.Lock()
-	defer portMutex.Unlock()
-	return sv241Port != nil
+	return GetConnectionInfo().Connected()
 }
 
 // GetFirmwareVersion returns the cached firmware version.
@@ -122,110 +98,124 @@ func GetFirmwareVersion() string {
 	return firmwareVersion
 }
 
-// SendCommand queues a command to be sent to the device.
-func SendCommand(command string, isHighPriority bool, timeout time.Duration) (string, error) {
-	if timeout == 0 {
-		timeout = 3 * time.Second // Default timeout
+// ProcessCommands is the heart of the command prioritization system.
+// It executes the queued commands one at a time (see nextCommand for the order).
+func ProcessCommands() {
+	logger.Info("Serial command processor started.")
+	for {
+		pc := nextCommand()
+		response, err := executeCommand(pc)
+		finishCommand(pc, response, err)
+		if pc.busy > 0 && err == nil {
+			// The device cannot answer until it is done; don't count that against it.
+			time.Sleep(pc.busy)
+		}
 	}
+}
 
-	responseChan := make(chan string, 1)
-	errorChan := make(chan error, 1)
-
-	cmd := Command{
-		Command:  command,
-		Response: responseChan,
-		Error:    errorChan,
-		Timeout:  timeout,
+// executeCommand sends a command to the device and reads the response line.
+func executeCommand(pc *pendingCommand) (string, error) {
+	portMutex.Lock()
+	if sv241Port == nil {
+		portMutex.Unlock()
+		return "", ErrPortClosed
 	}
 
-	if isHighPriority {
-		logger.Debug("Queueing high-priority command: %s", command)
-		highPriorityCommands <- cmd
-	} else {
-		logger.Debug("Queueing low-priority command: %s", command)
-		lowPriorityCommands <- cmd
-	}
+	// Drain input buffer to capture unsolicited data (e.g. boot logs) before sending new command
+	// This ensures the next line we read is likely the response to our command.
+	// We read with a very short timeout until no more data is available.
+	drainInputBuffer(sv241Port)
 
-	select {
-	case response := <-responseChan:
-		return response, nil
-	case err := <-errorChan:
-		return "", err
-	case <-time.After(timeout):
-		return "", errors.New("command timed out waiting for response from processor")
+	logger.Debug("Processing command: %s", pc.command)
+	_, err := sv241Port.Write([]byte(pc.command + "\n"))
+	if err != nil {
+		logger.Error("Serial write failed: %v. Marking port as disconnected.", err)
+		handleDisconnect("write failed", err)
+		portMutex.Unlock()
+		return "", fmt.Errorf("failed to write to serial port: %w", err)
+	}
+	if pc.busy > 0 {
+		portMutex.Unlock()
+		logger.Debug("Command %s is not answered by the device; pausing for %v.", pc.kind, pc.busy)
+		pausePolling(pc.busy)
+		return "", nil
 	}
-}
 
-// ProcessCommands is the heart of the command prioritization system.
-func ProcessCommands() {
-	logger.Info("Serial command processor started.")
+	// Use a simple byte-by-byte read to avoid buffering issues with bufio
+	// Wait for the response until the latest deadline of the waiting callers
+	// Lines that are not JSON were printed by the device on its own, e.g. while it restarts.
+	var response string
+	readDeadline := time.Now().Add(pc.readTimeout())
 	for {
-		var cmd Command
-		select {
-		case cmd = <-highPriorityCommands:
-		default:
-			select {
-			case cmd = <-highPriorityCommands:
-			case cmd = <-lowPriorityCommands:
-			}
-		}
-
-		portMutex.Lock()
-		if sv241Port == nil {
-			portMutex.Unlock()
-			cmd.Error <- errors.New("serial port is not open")
-			continue
+		remaining := time.Until(readDeadline)
+		if remaining <= 0 {
+			err = errReadTimeout
+			break
 		}
-
-		// Drain input buffer to remove unsolicited data (e.g. boot logs) before sending new command
-		// This ensures the next line we read is likely the response to our command.
-		// We read with a very short timeout until no more data is available.
-		drainInputBuffer(sv241Port)
-
-		logger.Debug("Processing command: %s", cmd.Command)
-		_, err := sv241Port.Write([]byte(cmd.Command + "\n"))
-		if err != nil {
-			logger.Error("Serial write failed: %v. Marking port as disconnected.", err)
-			handleDisconnect()
-			portMutex.Unlock()
-			cmd.Error <- fmt.Errorf("failed to write to serial port: %w", err)
-			continue
+		response, err = readLine(sv241Port, remaining)
+		if err != nil || isResponseLine(response) {
+			break
 		}
-
-		// Use a simple byte-by-byte read to avoid buffering issues with bufio
-		// Use the command's specific timeout for reading
-		response, err := readLine(sv241Port, cmd.Timeout)
-		if err != nil {
-			logger.Error("Serial read failed: %v. Marking port as disconnected.", err)
-			handleDisconnect()
-			portMutex.Unlock()
-			cmd.Error <- fmt.Errorf("failed to read from serial port: %w", err)
-			continue
+		captureUnsolicited([]byte(response + "\n"))
+	}
+	if errors.Is(err, errReadTimeout) {
+		// Keep the port open for a few unanswered commands, e.g. while the device is busy.
+		if commandUnanswered(err) {
+			logger.Error("Device did not answer %d commands in a row. Reopening the port.", maxUnresponsiveCommands)
+			handleDisconnect("device unresponsive", err)
+		} else {
+			logger.Warn("Device did not answer command: %s", pc.command)
 		}
 		portMutex.Unlock()
+		return "", fmt.Errorf("failed to read from serial port: %w", err)
+	} else if err != nil {
+		logger.Error("Serial read failed: %v. Marking port as disconnected.", err)
+		handleDisconnect("read failed", err)
+		portMutex.Unlock()
+		return "", fmt.Errorf("failed to read from serial port: %w", err)
+	}
+	commandAnswered()
+	portMutex.Unlock()
 
-		trimmedResponse := strings.TrimSpace(response)
-		logger.Debug("Received response from device: %s", trimmedResponse)
-
-		// Instant Cache Update (Turbo): Sniff the response for status or sensor data.
-		// If found, update the global cache immediately so NINA sees the change without waiting for the poller.
-		if strings.Contains(trimmedResponse, `"status":`) {
-			updateStatusCacheFromJSON(trimmedResponse)
-		} else if strings.Contains(trimmedResponse, `"sht_temperature":`) {
-			updateConditionsCacheFromJSON(trimmedResponse)
-		}
+	trimmedResponse := strings.TrimSpace(response)
+	logger.Debug("Received response from device: %s", trimmedResponse)
 
-		cmd.Response <- trimmedResponse
+	// Instant Cache Update (Turbo): Sniff the response for status or sensor data.
+	// If found, update the global cache immediately so NINA sees the change without waiting for the poller.
+	if strings.Contains(trimmedResponse, `"status":`) {
+		updateStatusCacheFromJSON(trimmedResponse)
+	} else if strings.Contains(trimmedResponse, `"sht_temperature":`) {
+		updateConditionsCacheFromJSON(trimmedResponse)
+	}
+	// The device answers a set config command with the complete, merged configuration.
+	if pc.kind == "sc" {
+		firmwareConfigWritten(trimmedResponse)
+	}
+	// Remember what the clients switched, so it can be restored after a device restart.
+	switch pc.kind {
+	case "set":
+		rememberCommandedState(pc.command, trimmedResponse)
+	case "command:" + CommandFactoryReset:
+		forgetCommandedState()
 	}
+	// Commands that change something are followed by a fresh read of the values that
+	// did not come with the response.
+	if !isReadCommand(pc.command) {
+		requestRefresh(pc.started)
+	}
+
+	return trimmedResponse, nil
 }
 
 // drainInputBuffer reads from the port until no more data is available or a timeout occurs.
+// The data was sent by the device on its own (e.g. boot logs) and goes to the device log.
 func drainInputBuffer(port serial.Port) {
 	// Set a very short timeout for draining
 	port.SetReadTimeout(100 * time.Millisecond)
 	buf := make([]byte, 1024)
 	for {
 		n, err := port.Read(buf)
+		captureUnsolicited(buf[:n])
 		if err != nil || n == 0 {
 			break
 		}
@@ -234,8 +224,14 @@ func drainInputBuffer(port serial.Port) {
 			break
 		}
 	}
+	if len(unsolicited.partial) > 0 && time.Since(unsolicited.partialSince) > partialLineTimeout {
+		flushUnsolicited()
+	}
 }
 
+// errReadTimeout is returned by readLine if the device did not answer in time.
+var errReadTimeout = errors.New("read timeout")
+
 // readLine reads from the port until a newline is encountered or timeout.
 func readLine(port serial.Port, timeout time.Duration) (string, error) {
 	port.SetReadTimeout(timeout)
@@ -245,7 +241,7 @@ func readLine(port serial.Port, timeout time.Duration) (string, error) {
 
 	for {
 		if time.Since(start) > timeout {
-			return "", errors.New("read timeout")
+			return "", errReadTimeout
 		}
 
 		n, err := port.Read(buf)
@@ -267,173 +263,28 @@ func readLine(port serial.Port, timeout time.Duration) (string, error) {
 	return string(result), nil
 }
 
-// ManageConnection is a background task that ensures the device stays connected.
-func ManageConnection(initDone chan struct{}) {
-	logger.Info("Connection manager task started. Waiting for initial signal...")
-	<-initDone
-	logger.Info("Initial signal received. Starting connection management.")
-
-	for {
-		time.Sleep(5 * time.Second)
-		logger.Debug("Connection Manager: Checking connection status...")
-
-		portMutex.Lock()
-		// Skip reconnection if paused (e.g., during flashing)
-		if reconnectPaused {
-			logger.Debug("Connection Manager: Reconnect is paused. Skipping.")
-			portMutex.Unlock()
-			continue
-		}
-
-		isConnected := (sv241Port != nil)
-		if !isConnected {
-			logger.Info("Connection Manager: Device is disconnected. Attempting to connect...")
-			conf := config.Get()
-			targetPort := conf.SerialPortName
-			autoDetect := conf.AutoDetectPort
-
-			// Wenn Auto-Detect AUS ist, versuchen wir NUR den konfigurierten Port.
-			if !autoDetect && targetPort != "" {
-				logger.Info("Connection Manager: Trying configured port '%s' for reconnection.", targetPort)
-				reconnect(targetPort)
-			} else {
-				// Wenn Auto-Detect AN ist (oder kein Port konfiguriert ist), verhalten wir uns wie bisher.
-				if targetPort != "" {
-					logger.Info("Connection Manager: Trying configured port '%s' for reconnection.", targetPort)
-					reconnect(targetPort)
-					if sv241Port == nil {
-						logger.Warn("Connection Manager: Configured port '%s' failed. Falling back to auto-detection.", targetPort)
-						conf.SerialPortName = "" // Leeren, damit der nächste Versuch den Autoscan nutzt
-						config.Save()
-					}
-				}
-
-				// Wenn immer noch nicht verbunden, starte den Autoscan.
-				if sv241Port == nil {
-					logger.Info("Connection Manager: Starting auto-detection...")
-					foundPort, err := FindPort()
-					if err != nil {
-						logger.Warn("Connection Manager: Auto-detection failed: %v", err)
-					} else {
-						logger.Info("Connection Manager: Auto-detection found device on port %s. Connecting...", foundPort)
-						reconnect(foundPort)
-					}
-				}
-			}
-		} else {
-			logger.Debug("Connection Manager: Device is connected.")
-		}
-		portMutex.Unlock()
-	}
-}
-
-// FindPort iterates through available serial ports to find the SV241 device.
-func FindPort() (string, error) {
+// portIdentity returns a stable identity for the USB device behind a serial port,
+// built from its VID, PID and USB serial number. It returns an empty string if the
+// port has no USB serial number, since VID/PID alone don't distinguish units.
+func portIdentity(portName string) string {
 	ports, err := enumerator.GetDetailedPortsList()
 	if err != nil {
-		logger.Warn("FindPort: enumerator.GetDetailedPortsList returned an error: %v.", err)
-	}
-	if len(ports) == 0 {
-		return "", errors.New("no serial ports found on the system")
+		logger.Debug("portIdentity: enumerator.GetDetailedPortsList returned an error: %v.", err)
+		return ""
 	}
-
-	logger.Info("Found %d serial ports. Probing for SV241 device...", len(ports))
 	for _, port := range ports {
-		logger.Debug("Checking port: %s (IsUSB: %t, VID: %s, PID: %s)", port.Name, port.IsUSB, port.VID, port.PID)
-		if port.IsUSB {
-			logger.Info("Probing port: %s", port.Name)
-
-			if probePortWithTimeout(port.Name, 4*time.Second) {
-				return port.Name, nil
-			}
-		} else {
-			logger.Debug("Skipping port %s: Not a USB port.", port.Name)
+		if port.Name == portName && port.IsUSB && port.SerialNumber != "" {
+			return fmt.Sprintf("%s:%s:%s", port.VID, port.PID, port.SerialNumber)
 		}
 	}
-	return "", errors.New("could not find SV241 device on any USB serial port")
-}
-
-// probePortWithTimeout probes a port with a hard timeout that guarantees cleanup.
-// Uses a goroutine for the actual probe, but closes the port if timeout occurs.
-func probePortWithTimeout(portName string, timeout time.Duration) bool {
-	resultChan := make(chan bool, 1)
-
-	// Shared variable for port handle - allows cleanup on timeout
-	var probePort serial.Port
-	var probeMutex sync.Mutex
-
-	go func() {
-		mode := &serial.Mode{BaudRate: 115200}
-		p, err := serial.Open(portName, mode)
-		if err != nil {
-			logger.Warn("Could not open port %s to probe: %v", portName, err)
-			resultChan <- false
-			return
-		}
-
-		// Store port handle for potential cleanup
-		probeMutex.Lock()
-		probePort = p
-		probeMutex.Unlock()
-
-		// Set read timeout
-		p.SetReadTimeout(2 * time.Second)
-
-		_, err = p.Write([]byte("{\"get\":\"sensors\"}\n"))
-		if err != nil {
-			logger.Debug("Port %s: Write failed: %v", portName, err)
-			p.Close()
-			resultChan <- false
-			return
-		}
-
-		reader := bufio.NewReader(p)
-		line, err := reader.ReadString('\n')
-		p.Close() // Close immediately after read
-
-		// Clear the shared handle since we closed it
-		probeMutex.Lock()
-		probePort = nil
-		probeMutex.Unlock()
-
-		if err != nil {
-			logger.Debug("Port %s: Read failed or timed out: %v", portName, err)
-			resultChan <- false
-			return
-		}
-
-		var js json.RawMessage
-		if json.Unmarshal([]byte(line), &js) == nil {
-			logger.Info("Successfully probed port: %s", portName)
-			resultChan <- true
-			return
-		}
-
-		logger.Debug("Port %s: Response was not valid JSON: %s", portName, line)
-		resultChan <- false
-	}()
-
-	// Wait for result with hard timeout
-	select {
-	case success := <-resultChan:
-		return success
-	case <-time.After(timeout):
-		logger.Warn("Port %s: Probe timed out after %v. Forcing cleanup.", portName, timeout)
-
-		// Force close the port if goroutine is still holding it
-		probeMutex.Lock()
-		if probePort != nil {
-			probePort.Close()
-			probePort = nil
-		}
-		probeMutex.Unlock()
-
-		return false
-	}
+	return ""
 }
 
 // Reconnect is a public wrapper for reconnecting, intended to be called from other packages.
+// It waits for a running port scan, so the port is not opened twice.
 func Reconnect(portName string) {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
 	portMutex.Lock()
 	defer portMutex.Unlock()
 	reconnect(portName)
@@ -442,16 +293,19 @@ func Reconnect(portName string) {
 // reconnect attempts to close the current port and open a new one.
 // It MUST be called within a portMutex lock.
 func reconnect(newPortName string) {
-	handleDisconnect() // Close existing port if any
+	handleDisconnect("reconnecting", nil) // Close existing port if any
 
 	if newPortName != "" {
 		logger.Info("Attempting to open serial port: %s", newPortName)
+		setConnectionState(StateOpening, newPortName, "opening port")
 		mode := &serial.Mode{BaudRate: 115200}
 		p, err := serial.Open(newPortName, mode)
 		if err != nil {
 			logger.Error("reconnect: Failed to open port %s: %v", newPortName, err)
+			connectionFailed("failed to open "+newPortName, err)
 		} else {
 			sv241Port = p
+			setConnectionState(StateSyncing, newPortName, "port opened")
 			conf := config.Get()
 			conf.SerialPortName = newPortName // Update config with the valid port
 			if err := config.Save(); err != nil {
@@ -459,20 +313,20 @@ func reconnect(newPortName string) {
 			}
 			logger.Info("Successfully opened serial port: %s", newPortName)
 
-			// Send a connected event if the status changed from disconnected.
-			if lastSentStatus == events.Disconnected {
-				// Use a non-blocking send. If the channel is full or no one is listening,
-				// this will not block the serial manager. This is important at startup.
-				select {
-				case events.ComPortStatusChan <- events.Connected:
-					lastSentStatus = events.Connected
-				default: // Do nothing if the channel is not ready.
-				}
+			// Tie the persistent Alpaca UniqueIDs to this physical unit.
+			config.BindDeviceIdentity(portIdentity(newPortName))
+
+			// Publish a connected event if the status changed from disconnected.
+			if !connectedEventSent {
+				events.Publish(events.Connected{Port: newPortName})
+				connectedEventSent = true
 
 				// TRIGGER CONFIG SYNC
 				// We do this in a goroutine to avoid blocking the mutex or deadlocking with ProcessCommands
 				go SyncFirmwareConfig()
 				go FetchFirmwareVersion()
+				// The device may have lost power while the port was closed.
+				go checkOutputsAfterRestart("reconnect")
 			}
 		}
 	} else {
@@ -481,22 +335,20 @@ func reconnect(newPortName string) {
 }
 
 // handleDisconnect closes the port and sets it to nil. MUST be called within a portMutex lock.
-func handleDisconnect() {
+// err is the error that caused the disconnect, if any.
+func handleDisconnect(reason string, err error) {
 	if sv241Port != nil {
-		// Send a disconnected event if the status changed from connected.
-		if lastSentStatus == events.Connected {
-			// Use a non-blocking send.
-			select {
-			case events.ComPortStatusChan <- events.Disconnected:
-				lastSentStatus = events.Disconnected
-			default: // Do nothing if the channel is not ready.
-			}
+		// Publish a disconnected event if the status changed from connected.
+		if connectedEventSent {
+			events.Publish(events.Disconnected{Port: config.Get().SerialPortName})
 		}
 		sv241Port.Close()
 		sv241Port = nil
-	} else {
-		lastSentStatus = events.Disconnected
+		flushUnsolicited()
+		invalidateFirmwareConfig()
+		portClosed(reason, err)
 	}
+	connectedEventSent = false
 }
 
 // ReleasePort closes the serial port to allow external tools (e.g., web flasher) to access it.
@@ -505,16 +357,18 @@ func ReleasePort() error {
 	portMutex.Lock()
 	defer portMutex.Unlock()
 
-	reconnectPaused = true
 	logger.Info("ReleasePort: Auto-reconnect paused.")
+	setReconnectPaused(true)
 
 	if sv241Port == nil {
 		logger.Info("ReleasePort: Port is already closed.")
+		events.Publish(events.PortReleased{})
 		return nil
 	}
 
 	logger.Info("ReleasePort: Closing serial port for external access...")
-	handleDisconnect()
+	events.Publish(events.PortReleased{Port: config.Get().SerialPortName})
+	handleDisconnect("port released", nil)
 	logger.Info("ReleasePort: Serial port closed successfully.")
 	return nil
 }
@@ -523,98 +377,114 @@ func ReleasePort() error {
 func ResumeReconnect() {
 	portMutex.Lock()
 	defer portMutex.Unlock()
-	reconnectPaused = false
 	logger.Info("ResumeReconnect: Auto-reconnect resumed.")
+	setReconnectPaused(false)
+	events.Publish(events.PortResumed{})
 }
 
 // IsReconnectPaused returns true if auto-reconnect is paused (e.g., for firmware flashing).
 func IsReconnectPaused() bool {
-	portMutex.Lock()
-	defer portMutex.Unlock()
-	return reconnectPaused
+	return GetConnectionInfo().ReconnectPaused
 }
 
 // --- Cache Management ---
 
-func periodicCacheUpdater(initDone chan struct{}) {
-	logger.Info("Periodic cache update task started. Waiting for initial signal...")
-	<-initDone
-	logger.Info("Initial signal received. Starting cache updates.")
+func updateStatusCacheFromJSON(statusJSON string) {
+	status, err := ParseStatus(statusJSON)
+	if err != nil {
+		logger.Warn("Ignoring invalid status from device: %v. Raw data: %s", err, statusJSON)
+		return
+	}
 
-	for {
-		performCacheUpdate()
-		time.Sleep(3 * time.Second)
+	Status.writeMu.Lock()
+	defer Status.writeMu.Unlock()
+	previous := Status.Load().Data
+
+	// Important: 'set' command responses don't include 'dm', but we need it for the UI.
+	// Preserve the existing 'dm' from the cache if available.
+	status.inheritDewModes(previous)
+
+	publishSwitchChanges(previous, status)
+	snapshot := Status.storeLocked(status)
+	logger.Debug("Successfully updated status cache (seq %d).", snapshot.Seq)
+	statestream.Update(statestream.TopicStatus, toMap(status))
+
+	// Sync ActiveVoltageTarget from firmware report if available
+	if adjFloat, ok := status.Adj.Float(); ok && adjFloat > 0 {
+		VoltageMutex.Lock()
+		ActiveVoltageTarget = adjFloat
+		VoltageMutex.Unlock()
 	}
 }
 
-func performCacheUpdate() {
-	logger.Debug("Performing on-demand cache update.")
-	statusJSON, err := SendCommand(`{"get":"status"}`, false, 0)
-	if err == nil {
-		updateStatusCacheFromJSON(statusJSON)
-	} else {
-		logger.Warn("Failed to get status for cache update: %v", err)
+func updateConditionsCacheFromJSON(conditionsJSON string) {
+	values, err := ParseSensors(conditionsJSON)
+	if err != nil {
+		logger.Warn("Ignoring invalid sensor values from device: %v. Raw data: %s", err, conditionsJSON)
+		return
 	}
 
-	conditionsJSON, err := SendCommand(`{"get":"sensors"}`, false, 0)
-	if err == nil {
-		updateConditionsCacheFromJSON(conditionsJSON)
-	} else {
-		logger.Warn("Failed to get conditions for cache update: %v", err)
+	Conditions.writeMu.Lock()
+	defer Conditions.writeMu.Unlock()
+	if heapStatsReset(Conditions.Load().Data, values) {
+		logger.Warn("Device restarted (heap statistics were reset).")
+		go checkOutputsAfterRestart("heap statistics reset")
 	}
+	snapshot := Conditions.storeLocked(values)
+	logMemoryStatus(values)
+	checkSensorFaults(values)
+	logger.Debug("Successfully updated conditions cache (seq %d).", snapshot.Seq)
+	statestream.Update(statestream.TopicConditions, toMap(values))
 }
 
-func updateStatusCacheFromJSON(statusJSON string) {
-	var rootData map[string]interface{}
-	// Unmarshal into generic map because we have mixed types ("status" object, "dm" array)
-	if json.Unmarshal([]byte(statusJSON), &rootData) == nil {
-		// Extract "status" block
-		if statusMap, ok := rootData["status"].(map[string]interface{}); ok {
-			Status.Lock()
-			defer Status.Unlock()
-
-			// Inject "dm" (Dew Mode) array into the status map so handlers can find it easily
-			if dmVal, found := rootData["dm"]; found {
-				statusMap["dm"] = dmVal
-			} else {
-				// Important: 'set' command responses don't include 'dm', but we need it for the UI.
-				// Preserve the existing 'dm' from the cache if available.
-				if Status.Data != nil {
-					if existingDM, ok := Status.Data["dm"]; ok {
-						statusMap["dm"] = existingDM
-					}
-				}
-			}
-
-			Status.Data = statusMap
-			logger.Debug("Successfully updated status cache.")
+// publishSwitchChanges publishes a SwitchChanged event for every output whose reported state
+// differs from the previous status. Nothing is published for the first status after startup.
+func publishSwitchChanges(previous, current *PowerStatus) {
+	if previous == nil {
+		return
+	}
+	for _, key := range OutputKeys {
+		old, _ := previous.Output(key)
+		value, _ := current.Output(key)
+		if old != value {
+			events.Publish(events.SwitchChanged{Key: key, Name: switchNameForKey(key), Value: value, Previous: old})
+		}
+	}
+}
 
-			// Sync ActiveVoltageTarget from firmware report if available
-			if adjVal, ok := Status.Data["adj"]; ok {
-				if adjFloat, ok := adjVal.(float64); ok && adjFloat > 0 {
-					VoltageMutex.Lock()
-					ActiveVoltageTarget = adjFloat
-					VoltageMutex.Unlock()
-				}
-			}
-		} else {
-			logger.Warn("Status JSON missing 'status' object")
+// switchNameForKey returns the proxy switch key (e.g. "dc1") of a firmware key (e.g. "d1").
+func switchNameForKey(shortKey string) string {
+	for name, key := range config.ShortSwitchIDMap {
+		if key == shortKey {
+			return name
 		}
-	} else {
-		logger.Warn("Failed to unmarshal status JSON from device. Raw data: %s", statusJSON)
 	}
+	return shortKey
 }
 
-func updateConditionsCacheFromJSON(conditionsJSON string) {
-	var conditionsData map[string]interface{}
-	if err := json.Unmarshal([]byte(conditionsJSON), &conditionsData); err == nil {
-		Conditions.Lock()
-		defer Conditions.Unlock()
-		Conditions.Data = conditionsData
-		logMemoryStatus(conditionsData)
-		logger.Debug("Successfully updated conditions cache.")
-	} else {
-		logger.Warn("Failed to unmarshal conditions JSON from device. Raw data: %s", conditionsJSON)
+// sensorKeys maps the sensors of the SV241 to the keys they report in {"get":"sensors"}.
+// The firmware reports null for the values of a sensor that is missing or disconnected.
+var sensorKeys = map[string][]string{
+	"INA219":  {"v", "i", "p"},
+	"SHT40":   {"t_amb", "h_amb", "d"},
+	"DS18B20": {"t_lens"},
+}
+
+// checkSensorFaults publishes a SensorFault event when a sensor stops reporting values or recovers.
+// It MUST be called with Conditions.writeMu held.
+func checkSensorFaults(values *SensorValues) {
+	for sensor, keys := range sensorKeys {
+		faulty := false
+		for _, key := range keys {
+			if _, ok := values.Value(key); !ok {
+				faulty = true
+			}
+		}
+		if faulty == sensorFaults[sensor] {
+			continue
+		}
+		sensorFaults[sensor] = faulty
+		events.Publish(events.SensorFault{Sensor: sensor, Cleared: !faulty})
 	}
 }
 
@@ -630,10 +500,8 @@ func FetchFirmwareVersion() {
 		return
 	}
 
-	var versionResponse struct {
-		Version string `json:"version"`
-	}
-	if err := json.Unmarshal([]byte(resp), &versionResponse); err != nil {
+	versionResponse, err := ParseVersion(resp)
+	if err != nil {
 		logger.Warn("Could not parse firmware version response: %v", err)
 		return
 	}
@@ -641,20 +509,11 @@ func FetchFirmwareVersion() {
 	logger.Info("Firmware version: %s", firmwareVersion)
 }
 
-func logMemoryStatus(data map[string]interface{}) {
-	getFloat := func(key string) float64 {
-		if val, ok := data[key]; ok {
-			if fVal, ok := val.(float64); ok {
-				return fVal
-			}
-		}
-		return 0
-	}
-
-	currentHeapFree := getFloat("hf")
-	currentHeapMinFree := getFloat("hmf")
-	currentHeapMaxAlloc := getFloat("hma")
-	currentHeapSize := getFloat("hs")
+func logMemoryStatus(values *SensorValues) {
+	currentHeapFree := values.HeapFree
+	currentHeapMinFree := values.HeapMinFree
+	currentHeapMaxAlloc := values.HeapMaxAlloc
+	currentHeapSize := values.HeapSize
 
 	valuesChanged := currentHeapFree != lastLoggedHeapFree ||
 		currentHeapMinFree != lastLoggedHeapMinFree ||
@@ -664,7 +523,7 @@ func logMemoryStatus(data map[string]interface{}) {
 	timeForcedLog := time.Since(lastMemoryLogTime) > 2*time.Minute
 
 	if valuesChanged || timeForcedLog {
-		logger.Debug("ESP32 Heap Status: Size=%.0f, Free=%.0f, MinFree=%.0f, MaxAlloc=%.0f",
+		logger.Debug("ESP32 Heap Status: Size=%d, Free=%d, MinFree=%d, MaxAlloc=%d",
 			currentHeapSize, currentHeapFree, currentHeapMinFree, currentHeapMaxAlloc)
 
 		lastLoggedHeapFree = currentHeapFree
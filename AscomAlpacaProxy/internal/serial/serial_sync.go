@@ -1,36 +1,41 @@
 package serial
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/events"
 	"sv241pro-alpaca-proxy/internal/logger"
+	"sv241pro-alpaca-proxy/internal/statestream"
 	"time"
 )
 
-// SyncFirmwareConfig fetches the firmware configuration and updates the proxy's internal switch list
+// SyncFirmwareConfig updates the proxy's internal switch list from the firmware configuration
 // to hide any heaters that are set to "Disabled" mode (Mode 5).
+// The cached configuration is used if available; after connecting, it is read from the device.
 func SyncFirmwareConfig() {
-	// Wait a moment for the connection to stabilize and the mutex to be released
-	time.Sleep(1 * time.Second)
-
 	logger.Info("Syncing switch configuration with firmware...")
 
-	response, err := SendCommand(`{"get":"config"}`, false, 5*time.Second)
+	fwConfig, err := GetFirmwareConfig()
+	if errors.Is(err, ErrFirmwareConfigNotLoaded) {
+		// Wait a moment for the connection to stabilize and the mutex to be released
+		time.Sleep(1 * time.Second)
+		beginSync()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = RefreshFirmwareConfig(ctx)
+		cancel()
+		if err == nil {
+			fwConfig, err = GetFirmwareConfig()
+		}
+	} else {
+		beginSync()
+	}
 	if err != nil {
 		logger.Error("Failed to sync firmware config: %v", err)
-		return
-	}
-
-	var fwConfig struct {
-		DH []struct {
-			M int `json:"m"` // Mode
-		} `json:"dh"`
-		PS config.PowerStartupStates `json:"ps"` // Power Startup States
-	}
-
-	if err := json.Unmarshal([]byte(response), &fwConfig); err != nil {
-		logger.Error("Failed to parse firmware config for sync: %v", err)
+		endSync(fmt.Errorf("firmware config sync failed: %w", err))
 		return
 	}
 
@@ -55,18 +60,13 @@ func SyncFirmwareConfig() {
 	// 0a. Dynamic Sensors (Lens Temp, PWM1, PWM2)
 	// Check modes for Heater 1 and Heater 2
 	// Modes: 0=Manual, 1=PID(Lens), 2=AmbTracking, 3=PID-Sync, 4=MinTemp, 5=Disabled
-	h1Mode := 0
-	h2Mode := 0
-	if len(fwConfig.DH) >= 1 {
-		h1Mode = fwConfig.DH[0].M
-	}
-	if len(fwConfig.DH) >= 2 {
-		h2Mode = fwConfig.DH[1].M
-	}
+	h1, _ := fwConfig.Heater(0)
+	h2, _ := fwConfig.Heater(1)
+	h1Mode, h2Mode := h1.Mode, h2.Mode
 
 	// Lens Temperature (ID dynamic)
 	// Show if at least one heater needs it (Mode 1 or 4) OR if forced by config
-	if h1Mode == 1 || h1Mode == 4 || h2Mode == 1 || h2Mode == 4 || config.Get().AlwaysShowLensTemp {
+	if h1Mode == HeaterModePID || h1Mode == HeaterModeMinTemp || h2Mode == HeaterModePID || h2Mode == HeaterModeMinTemp || config.Get().AlwaysShowLensTemp {
 		newIDMap[currentID] = config.SensorLensTempKey
 		newShortKeyByID[currentID] = config.SensorLensTempKey
 		currentID++
@@ -74,7 +74,7 @@ func SyncFirmwareConfig() {
 
 	// PWM1 Level (ID dynamic)
 	// Show unless disabled
-	if h1Mode != 5 {
+	if h1Mode != HeaterModeDisabled {
 		newIDMap[currentID] = config.SensorPWM1Key
 		newShortKeyByID[currentID] = config.SensorPWM1Key
 		currentID++
@@ -82,7 +82,7 @@ func SyncFirmwareConfig() {
 
 	// PWM2 Level (ID dynamic)
 	// Show unless disabled
-	if h2Mode != 5 {
+	if h2Mode != HeaterModeDisabled {
 		newIDMap[currentID] = config.SensorPWM2Key
 		newShortKeyByID[currentID] = config.SensorPWM2Key
 		currentID++
@@ -130,7 +130,7 @@ func SyncFirmwareConfig() {
 	// 2. Dew Heaters
 	for i := range fwConfig.DH {
 		// If heater is Disabled (Mode 5), skip it to hide from ASCOM
-		if fwConfig.DH[i].M == 5 {
+		if fwConfig.DH[i].Mode == HeaterModeDisabled {
 			continue
 		}
 
@@ -155,7 +155,15 @@ func SyncFirmwareConfig() {
 	config.ShortSwitchKeyByID = newShortKeyByID
 	config.SwitchMapMutex.Unlock()
 
+	switchMap := make(map[string]interface{}, len(newIDMap))
+	for id, name := range newIDMap {
+		switchMap[strconv.Itoa(id)] = name
+	}
+	statestream.Update(statestream.TopicSwitchMap, switchMap)
+
 	logger.Info("Switch configuration sync complete. Total Switches: %d", len(newIDMap))
+	endSync(nil)
+	events.Publish(events.FirmwareSynced{Switches: len(newIDMap)})
 }
 
 func resetSwitchMaps() {
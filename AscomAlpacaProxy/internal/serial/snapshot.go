@@ -0,0 +1,66 @@
+package serial
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatusSnapshot is the power status at one point in time. Snapshots are never modified
+// after they have been published, so readers can keep and use them without locking.
+type StatusSnapshot struct {
+	Seq       uint64       // Increases with every update; 0 until the first status was received
+	UpdatedAt time.Time    // Time of the update
+	Data      *PowerStatus // nil until the first status was received. MUST NOT be modified.
+}
+
+// ConditionsSnapshot is the sensor values at one point in time (see StatusSnapshot).
+type ConditionsSnapshot struct {
+	Seq       uint64
+	UpdatedAt time.Time
+	Data      *SensorValues // nil until the first sensor values were received. MUST NOT be modified.
+}
+
+// StatusCache holds the latest power status from the device.
+// Readers get the current snapshot with Load; updates replace it with a new one.
+type StatusCache struct {
+	current atomic.Pointer[StatusSnapshot]
+	writeMu sync.Mutex // Serializes updates; readers never wait for it
+}
+
+// ConditionsCache holds the latest sensor readings from the device (see StatusCache).
+type ConditionsCache struct {
+	current atomic.Pointer[ConditionsSnapshot]
+	writeMu sync.Mutex
+}
+
+// Load returns the current snapshot. It is never nil.
+func (c *StatusCache) Load() *StatusSnapshot {
+	if s := c.current.Load(); s != nil {
+		return s
+	}
+	return &StatusSnapshot{}
+}
+
+// storeLocked publishes a new snapshot. It MUST be called with writeMu held, so an update
+// based on the previous snapshot (e.g. keeping the heater modes) never gets lost.
+func (c *StatusCache) storeLocked(status *PowerStatus) *StatusSnapshot {
+	next := &StatusSnapshot{Seq: c.Load().Seq + 1, UpdatedAt: time.Now(), Data: status}
+	c.current.Store(next)
+	return next
+}
+
+// Load returns the current snapshot. It is never nil.
+func (c *ConditionsCache) Load() *ConditionsSnapshot {
+	if s := c.current.Load(); s != nil {
+		return s
+	}
+	return &ConditionsSnapshot{}
+}
+
+// storeLocked publishes new sensor values. It MUST be called with writeMu held.
+func (c *ConditionsCache) storeLocked(values *SensorValues) *ConditionsSnapshot {
+	next := &ConditionsSnapshot{Seq: c.Load().Seq + 1, UpdatedAt: time.Now(), Data: values}
+	c.current.Store(next)
+	return next
+}
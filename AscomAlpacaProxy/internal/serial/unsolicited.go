@@ -0,0 +1,142 @@
+package serial
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/devicelog"
+	"sv241pro-alpaca-proxy/internal/events"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"time"
+	"unicode"
+)
+
+const (
+	// maxPartialLine is the longest line kept while waiting for its end.
+	maxPartialLine = 4096
+	// partialLineTimeout is how long an unterminated line is kept before it is logged as is.
+	partialLineTimeout = 2 * time.Second
+	// bootReasonMaxAge is how long the reset reason printed by the ROM is kept for the
+	// firmware banner that follows it.
+	bootReasonMaxAge = 10 * time.Second
+)
+
+// firmwareBanner is the first line the firmware prints at startup. It marks a restart.
+const firmwareBanner = "--- SV241"
+
+// romBanners are the beginnings of lines printed by the ESP32 ROM and panic handler
+// before the firmware starts.
+var romBanners = []string{
+	"rst:0x",     // Reset reason
+	"ESP-ROM:",   // ESP32-S2/S3/C3 ROM version
+	"ets ",       // ESP32 ROM version
+	"Rebooting.", // Panic handler
+}
+
+// resetReason extracts the reason from e.g. "rst:0xc (SW_CPU_RESET),boot:0x13 (SPI_FAST_FLASH_BOOT)".
+var resetReason = regexp.MustCompile(`rst:0x[0-9a-fA-F]+ \(([A-Z0-9_]+)\)`)
+
+// unsolicited collects the device output that is not a command response.
+// It is only accessed with portMutex held.
+var unsolicited struct {
+	partial      []byte
+	partialSince time.Time
+	bootReason   string // Reset reason printed by the ROM before the firmware banner
+	bootReasonAt time.Time
+}
+
+// captureUnsolicited handles bytes the device sent outside of a command response.
+// Complete lines go to the device log; the rest is kept until the line is complete.
+// It MUST be called with portMutex held.
+func captureUnsolicited(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if len(unsolicited.partial) == 0 {
+		unsolicited.partialSince = time.Now()
+	}
+	unsolicited.partial = append(unsolicited.partial, data...)
+	for {
+		i := bytes.IndexByte(unsolicited.partial, '\n')
+		if i < 0 {
+			break
+		}
+		deviceOutput(string(unsolicited.partial[:i]))
+		unsolicited.partial = unsolicited.partial[i+1:]
+		unsolicited.partialSince = time.Now()
+	}
+	if len(unsolicited.partial) > maxPartialLine {
+		flushUnsolicited()
+	}
+}
+
+// flushUnsolicited logs an unterminated line that has been waiting for too long.
+// It MUST be called with portMutex held.
+func flushUnsolicited() {
+	if len(unsolicited.partial) > 0 {
+		deviceOutput(string(unsolicited.partial))
+	}
+	unsolicited.partial = nil
+}
+
+// deviceOutput stores a line printed by the device and checks it for a boot banner.
+func deviceOutput(text string) {
+	// Garbage from a baud rate change during boot must not break the log or the stream.
+	text = strings.Map(func(r rune) rune {
+		if r == '\t' || unicode.IsPrint(r) {
+			return r
+		}
+		return -1
+	}, strings.ToValidUTF8(text, ""))
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+
+	boot := isBootBanner(text)
+	devicelog.Append(devicelog.Line{Time: time.Now(), Text: text, Boot: boot})
+	logger.Debug("Device output: %s", text)
+	if m := resetReason.FindStringSubmatch(text); m != nil {
+		unsolicited.bootReason = m[1]
+		unsolicited.bootReasonAt = time.Now()
+	}
+	if strings.HasPrefix(text, firmwareBanner) {
+		deviceRebooted(text)
+	}
+}
+
+func isBootBanner(text string) bool {
+	if strings.HasPrefix(text, firmwareBanner) {
+		return true
+	}
+	for _, banner := range romBanners {
+		if strings.HasPrefix(text, banner) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceRebooted reports a restart of the device. The ROM lines before the firmware banner
+// are not always sent over USB, so only the firmware banner counts as a restart.
+func deviceRebooted(banner string) {
+	reason := ""
+	if time.Since(unsolicited.bootReasonAt) < bootReasonMaxAge {
+		reason = unsolicited.bootReason
+	}
+	unsolicited.bootReason = ""
+
+	if reason != "" {
+		logger.Warn("Device restarted (reset reason: %s).", reason)
+	} else {
+		logger.Warn("Device restarted.")
+	}
+	events.Publish(events.DeviceRebooted{Reason: reason, Banner: banner})
+	go checkOutputsAfterRestart("boot banner")
+}
+
+// isResponseLine reports whether a line read after a command is the device's answer.
+// All answers are JSON objects; anything else was printed by the device on its own.
+func isResponseLine(line string) bool {
+	return strings.HasPrefix(strings.TrimSpace(line), "{")
+}
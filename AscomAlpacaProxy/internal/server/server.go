@@ -1,30 +1,78 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"sv241pro-alpaca-proxy/internal/alpaca"
+	"sv241pro-alpaca-proxy/internal/audit"
+	"sv241pro-alpaca-proxy/internal/auth"
 	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/console"
+	"sv241pro-alpaca-proxy/internal/devicelog"
+	"sv241pro-alpaca-proxy/internal/events"
 	"sv241pro-alpaca-proxy/internal/handlers"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sv241pro-alpaca-proxy/internal/logstream"
 	"sv241pro-alpaca-proxy/internal/serial"
+	"sv241pro-alpaca-proxy/internal/statestream"
 	"sv241pro-alpaca-proxy/internal/telemetry"
+	"sv241pro-alpaca-proxy/internal/tlscert"
 )
 
 // Start initializes and starts the HTTP server, serving the frontend from the provided filesystem.
+// If a separate admin listener is configured, the web UI and management API are served there,
+// and the main listener only serves the Alpaca routes.
 func Start(frontendFS fs.FS, appVersion string) {
-	setupRoutes(frontendFS, appVersion)
-
+	api := alpaca.NewAPI(appVersion)
 	conf := config.Get()
-	addr := fmt.Sprintf("%s:%d", conf.ListenAddress, conf.NetworkPort)
+	addr := net.JoinHostPort(conf.ListenAddress, strconv.Itoa(conf.NetworkPort))
+
+	alpacaMux := http.NewServeMux()
+	setupAlpacaRoutes(alpacaMux, api)
+
+	var adminListener net.Listener
+	var adminMux *http.ServeMux
+	if conf.SeparateAdminListener {
+		adminAddr := net.JoinHostPort(conf.AdminListenAddress, strconv.Itoa(conf.AdminPort))
+		var err error
+		adminListener, err = net.Listen("tcp", adminAddr)
+		if err != nil {
+			logger.Fatal("Could not bind admin listener to address '%s' (reason: %v). Please check your configuration.", adminAddr, err)
+			return
+		}
+		scheme := "HTTP"
+		if conf.EnableTLS {
+			tlsConfig, err := tlscert.TLSConfig()
+			if err != nil {
+				logger.Fatal("Could not set up TLS for the admin listener (reason: %v). Please check your configuration.", err)
+				return
+			}
+			adminListener = tls.NewListener(adminListener, tlsConfig)
+			scheme = "HTTPS"
+		}
+		// The web UI switches outputs via the Alpaca routes, so the admin listener serves them as well.
+		adminMux = http.NewServeMux()
+		setupAdminRoutes(adminMux, frontendFS, appVersion)
+		setupAlpacaRoutes(adminMux, api)
+		logger.Info("Starting admin server (web UI and management API, %s) on %s...", scheme, adminAddr)
+	} else {
+		if conf.EnableTLS {
+			logger.Warn("TLS requires the separate admin listener, so Alpaca clients can keep using plain HTTP. Serving the web UI over HTTP.")
+		}
+		setupAdminRoutes(alpacaMux, frontendFS, appVersion)
+	}
 
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -37,15 +85,26 @@ func Start(frontendFS fs.FS, appVersion string) {
 	// Initialize CSV Telemetry Logger
 	telemetry.Init()
 
-	if err := http.Serve(listener, nil); err != nil {
+	// Start writing the audit log (stored in the telemetry database)
+	audit.Start()
+
+	if adminListener != nil {
+		go func() {
+			if err := http.Serve(adminListener, auth.OriginProtection(adminMux)); err != nil {
+				logger.Fatal("Admin HTTP server failed: %v", err)
+			}
+		}()
+	}
+
+	if err := http.Serve(listener, auth.OriginProtection(alpacaMux)); err != nil {
 		logger.Fatal("HTTP server failed: %v", err)
 	}
 }
 
-func setupRoutes(frontendFS fs.FS, appVersion string) {
-	api := alpaca.NewAPI(appVersion)
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// setupAdminRoutes registers the web UI, the management REST API and the WebSockets.
+func setupAdminRoutes(mux *http.ServeMux, frontendFS fs.FS, appVersion string) {
+	// Static web UI files only check the IP allowlist, so the login screen can load.
+	mux.HandleFunc("/", auth.AllowlistOnly(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" || r.URL.Path == "/setup" {
 			// Serve the SPA entry point
 			http.ServeFileFS(w, r, frontendFS, "index.html")
@@ -53,66 +112,93 @@ func setupRoutes(frontendFS fs.FS, appVersion string) {
 			// Serve static assets
 			http.FileServer(http.FS(frontendFS)).ServeHTTP(w, r)
 		}
-	})
+	}))
 
-	http.HandleFunc("/flasher", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/flasher", auth.AllowlistOnly(func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFileFS(w, r, frontendFS, "flasher/index.html")
-	})
+	}))
 	// Create a sub-filesystem for the flasher directory so that /flasher/firmware/x.bin works correctly
 	flasherFS, err := fs.Sub(frontendFS, "flasher")
 	if err != nil {
 		logger.Error("Failed to create flasher sub-filesystem: %v", err)
 	} else {
-		http.Handle("/flasher/", http.StripPrefix("/flasher/", http.FileServer(http.FS(flasherFS))))
+		mux.HandleFunc("/flasher/", auth.AllowlistOnly(http.StripPrefix("/flasher/", http.FileServer(http.FS(flasherFS))).ServeHTTP))
 	}
 
-	// --- Management API ---
-	http.HandleFunc("/management/v1/description", api.HandleManagementDescription)
-	http.HandleFunc("/management/v1/configureddevices", alpaca.HandleManagementConfiguredDevices)
-	http.HandleFunc("/management/apiversions", alpaca.HandleManagementApiVersions)
+	// --- Alpaca Discovery ---
+	mux.HandleFunc("/api/v1/discovery/scan", auth.Require(auth.ScopeRead, alpaca.HandleDiscoveryScan))
+
+	// --- Authentication ---
+	mux.HandleFunc("/api/v1/auth/status", auth.AllowlistOnly(auth.HandleStatus))
+	mux.HandleFunc("/api/v1/auth/login", auth.HandleLogin)
+	mux.HandleFunc("/api/v1/auth/logout", auth.HandleLogout)
+	mux.HandleFunc("/api/v1/auth/password", auth.Require(auth.ScopeAdmin, auth.HandleSetPassword))
+	mux.HandleFunc("/api/v1/auth/settings", auth.Require(auth.ScopeAdmin, auth.HandleSettings))
+	mux.HandleFunc("/api/v1/auth/tokens", auth.Require(auth.ScopeAdmin, auth.HandleTokens))
 
 	// --- Setup Page API ---
-	http.HandleFunc("/api/v1/config", handleGetFirmwareConfig)
-	http.HandleFunc("/api/v1/config/set", handleSetFirmwareConfig)
-	http.HandleFunc("/api/v1/power/status", handleGetPowerStatus)
-	http.HandleFunc("/api/v1/status", handleGetLiveStatus)
-	http.HandleFunc("/api/v1/power/all", handleSetAllPower)
-	http.HandleFunc("/api/v1/command", handleDeviceCommand)
-	http.HandleFunc("/api/v1/firmware/version", handleGetFirmwareVersion)
-	http.HandleFunc("/api/v1/proxy/version", handleGetProxyVersion(appVersion))
-	http.HandleFunc("/api/v1/backup/create", handleCreateBackup)
-	http.HandleFunc("/api/v1/backup/restore", handleRestoreBackup)
-	http.HandleFunc("/api/v1/telemetry/dates", telemetry.HandleGetLogDates)
-	http.HandleFunc("/api/v1/telemetry/history", telemetry.HandleGetHistory)
-	http.HandleFunc("/api/v1/telemetry/download", telemetry.HandleDownloadCSV)
-	http.HandleFunc("/api/v1/log/download", handleDownloadLog)
-	http.HandleFunc("/api/serial/release", handleSerialRelease)
-	http.HandleFunc("/api/serial/resume", handleSerialResume)
+	mux.HandleFunc("/api/v1/config", auth.Require(auth.ScopeRead, handleGetFirmwareConfig))
+	mux.HandleFunc("/api/v1/config/set", auth.Require(auth.ScopeAdmin, handleSetFirmwareConfig))
+	mux.HandleFunc("/api/v1/power/status", auth.Require(auth.ScopeRead, handleGetPowerStatus))
+	mux.HandleFunc("/api/v1/status", auth.Require(auth.ScopeRead, handleGetLiveStatus))
+	mux.HandleFunc("/api/v1/power/all", auth.Require(auth.ScopeControl, handleSetAllPower))
+	mux.HandleFunc("/api/v1/command", auth.Require(auth.ScopeAdmin, handlers.HandleRawCommand))
+	mux.HandleFunc("/api/v1/device/reboot", auth.Require(auth.ScopeAdmin, handlers.HandleDeviceReboot))
+	mux.HandleFunc("/api/v1/device/factory-reset", auth.Require(auth.ScopeAdmin, handlers.HandleDeviceFactoryReset))
+	mux.HandleFunc("/api/v1/device/dry-sensor", auth.Require(auth.ScopeAdmin, handlers.HandleDeviceDrySensor))
+	mux.HandleFunc("/api/v1/firmware/version", auth.Require(auth.ScopeRead, handleGetFirmwareVersion))
+	mux.HandleFunc("/api/v1/proxy/version", auth.Require(auth.ScopeRead, handleGetProxyVersion(appVersion)))
+	mux.HandleFunc("/api/v1/backup/create", auth.Require(auth.ScopeAdmin, handleCreateBackup))
+	mux.HandleFunc("/api/v1/backup/restore", auth.Require(auth.ScopeAdmin, handleRestoreBackup))
+	mux.HandleFunc("/api/v1/safety", auth.Require(auth.ScopeRead, alpaca.HandleGetSafetyStatus))
+	mux.HandleFunc("/api/v1/telemetry/dates", auth.Require(auth.ScopeRead, telemetry.HandleGetLogDates))
+	mux.HandleFunc("/api/v1/telemetry/history", auth.Require(auth.ScopeRead, telemetry.HandleGetHistory))
+	mux.HandleFunc("/api/v1/telemetry/download", auth.Require(auth.ScopeRead, telemetry.HandleDownloadCSV))
+	mux.HandleFunc("/api/v1/log/download", auth.Require(auth.ScopeRead, handleDownloadLog))
+	mux.HandleFunc("/api/v1/device-log", auth.Require(auth.ScopeRead, handleGetDeviceLog))
+	mux.HandleFunc("/api/v1/device-log/download", auth.Require(auth.ScopeRead, handleDownloadDeviceLog))
+	mux.HandleFunc("/api/v1/audit", auth.Require(auth.ScopeRead, audit.HandleQuery))
+	mux.HandleFunc("/api/v1/tls/ca.crt", auth.AllowlistOnly(tlscert.HandleDownloadCA))
+	mux.HandleFunc("/api/v1/connection", auth.Require(auth.ScopeRead, handlers.HandleGetConnection))
+	mux.HandleFunc("/api/v1/serial/stats", auth.Require(auth.ScopeRead, handleSerialStats))
+	mux.HandleFunc("/api/v1/serial/ports", auth.Require(auth.ScopeRead, handleGetSerialPorts))
+	mux.HandleFunc("/api/v1/serial/ports/probe", auth.Require(auth.ScopeAdmin, handleProbeSerialPort))
+	mux.HandleFunc("/api/serial/release", auth.Require(auth.ScopeAdmin, handleSerialRelease))
+	mux.HandleFunc("/api/serial/resume", auth.Require(auth.ScopeAdmin, handleSerialResume))
 
 	// New settings endpoint combines getting and setting proxy config
-	http.HandleFunc("/api/v1/settings", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("/api/v1/settings", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodGet {
 			// This handler now returns the proxy config AND available IPs
-			handlers.HandleGetSettings(w, r)
+			auth.Require(auth.ScopeRead, handlers.HandleGetSettings)(w, r)
 		} else if r.Method == http.MethodPost {
 			// This handler now saves the entire proxy config
-			handlers.HandlePostSettings(w, r)
+			auth.Require(auth.ScopeAdmin, handlers.HandlePostSettings)(w, r)
 		} else {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
 	})
 
 	// --- WebSocket ---
-	http.HandleFunc("/ws/logs", logstream.ServeWs)
-
-	// --- Alpaca Device API ---
-	setupAlpacaDeviceRoutes(api)
+	mux.HandleFunc("/ws/logs", auth.Require(auth.ScopeRead, logstream.ServeWs))
+	mux.HandleFunc("/ws/state", auth.Require(auth.ScopeRead, statestream.ServeWs))
+	mux.HandleFunc("/ws/device-log", auth.Require(auth.ScopeRead, devicelog.ServeWs))
+	mux.HandleFunc("/ws/console", auth.Require(auth.ScopeAdmin, console.ServeWs))
+	mux.HandleFunc("/api/v1/events", auth.Require(auth.ScopeRead, statestream.ServeSSE))
 }
 
-func setupAlpacaDeviceRoutes(api *alpaca.API) {
+// setupAlpacaRoutes registers the Alpaca management and device API.
+func setupAlpacaRoutes(mux *http.ServeMux, api *alpaca.API) {
+	// --- Management API ---
+	mux.HandleFunc("/management/v1/description", auth.AlpacaAllowlist(api.HandleManagementDescription))
+	mux.HandleFunc("/management/v1/configureddevices", auth.AlpacaAllowlist(alpaca.HandleManagementConfiguredDevices))
+	mux.HandleFunc("/management/apiversions", auth.AlpacaAllowlist(alpaca.HandleManagementApiVersions))
+
 	// Redirects for ASCOM client setup requests
-	http.HandleFunc("/setup/v1/switch/0/setup", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/setup", http.StatusFound) })
-	http.HandleFunc("/setup/v1/observingconditions/0/setup", func(w http.ResponseWriter, r *http.Request) { http.Redirect(w, r, "/setup", http.StatusFound) })
+	mux.HandleFunc("/setup/v1/switch/0/setup", auth.AlpacaAllowlist(redirectToSetup))
+	mux.HandleFunc("/setup/v1/observingconditions/0/setup", auth.AlpacaAllowlist(redirectToSetup))
+	mux.HandleFunc("/setup/v1/safetymonitor/0/setup", auth.AlpacaAllowlist(redirectToSetup))
+	mux.HandleFunc("/setup/v1/covercalibrator/0/setup", auth.AlpacaAllowlist(redirectToSetup))
 
 	// Common handlers
 	commonHandlers := map[string]http.HandlerFunc{
@@ -137,21 +223,21 @@ func setupAlpacaDeviceRoutes(api *alpaca.API) {
 		"maxswitchvalue":       api.HandleSwitchMaxSwitchValue,
 		"minswitchvalue":       api.HandleSwitchMinSwitchValue,
 		"switchstep":           api.HandleSwitchSwitchStep,
-		"name":                 api.HandleDeviceName("SV241 Power Switch"),
+		"name":                 api.HandleDeviceName(config.DeviceTypeSwitch),
 		"supportedactions":     api.HandleSwitchSupportedActions,
 		"action":               api.HandleSwitchAction,
 	}
 	for k, v := range commonHandlers {
 		switchHandlers[k] = v
 	}
-	http.HandleFunc("/api/v1/switch/0/", alpaca.Handler(deviceMux(switchHandlers, api)))
+	mux.HandleFunc("/api/v1/switch/0/", auth.AlpacaAllowlist(alpaca.Handler(deviceMux(switchHandlers, api))))
 
 	// ObservingConditions device
 	obsCondHandlers := map[string]http.HandlerFunc{
 		"temperature":         api.HandleObsCondTemperature,
 		"humidity":            api.HandleObsCondHumidity,
 		"dewpoint":            api.HandleObsCondDewPoint,
-		"name":                api.HandleDeviceName("SV241 Environment"),
+		"name":                api.HandleDeviceName(config.DeviceTypeObservingConditions),
 		"supportedactions":    api.HandleSupportedActions,
 		"action":              api.HandleObsCondAction,
 		"averageperiod":       api.HandleObsCondAveragePeriod,
@@ -172,7 +258,53 @@ func setupAlpacaDeviceRoutes(api *alpaca.API) {
 	for k, v := range commonHandlers {
 		obsCondHandlers[k] = v
 	}
-	http.HandleFunc("/api/v1/observingconditions/0/", alpaca.Handler(deviceMux(obsCondHandlers, api)))
+	mux.HandleFunc("/api/v1/observingconditions/0/", auth.AlpacaAllowlist(alpaca.Handler(deviceMux(obsCondHandlers, api))))
+
+	// SafetyMonitor device
+	safetyHandlers := map[string]http.HandlerFunc{
+		"issafe":           api.HandleSafetyMonitorIsSafe,
+		"name":             api.HandleDeviceName(config.DeviceTypeSafetyMonitor),
+		"supportedactions": api.HandleSafetyMonitorSupportedActions,
+		"action":           api.HandleSafetyMonitorAction,
+	}
+	for k, v := range commonHandlers {
+		safetyHandlers[k] = v
+	}
+	// The SafetyMonitor stays connectable while the SV241 is not, to report unsafe.
+	safetyHandlers["connected"] = api.HandleSafetyMonitorConnected
+	mux.HandleFunc("/api/v1/safetymonitor/0/", auth.AlpacaAllowlist(alpaca.Handler(deviceMux(safetyHandlers, api))))
+
+	// CoverCalibrator device (only listed in configureddevices when enabled)
+	coverCalibratorHandlers := map[string]http.HandlerFunc{
+		"brightness":       api.HandleCoverCalibratorBrightness,
+		"maxbrightness":    api.HandleCoverCalibratorMaxBrightness,
+		"calibratorstate":  api.HandleCoverCalibratorCalibratorState,
+		"coverstate":       api.HandleCoverCalibratorCoverState,
+		"calibratoron":     api.HandleCoverCalibratorCalibratorOn,
+		"calibratoroff":    api.HandleCoverCalibratorCalibratorOff,
+		"opencover":        api.HandleCoverCalibratorCoverNotImplemented,
+		"closecover":       api.HandleCoverCalibratorCoverNotImplemented,
+		"haltcover":        api.HandleCoverCalibratorCoverNotImplemented,
+		"name":             api.HandleDeviceName(config.DeviceTypeCoverCalibrator),
+		"supportedactions": api.HandleCoverCalibratorSupportedActions,
+		"action":           api.HandleCoverCalibratorAction,
+	}
+	for k, v := range commonHandlers {
+		coverCalibratorHandlers[k] = v
+	}
+	mux.HandleFunc("/api/v1/covercalibrator/0/", auth.AlpacaAllowlist(alpaca.Handler(deviceMux(coverCalibratorHandlers, api))))
+}
+
+// redirectToSetup sends ASCOM client setup requests to the web UI. Requests on the
+// Alpaca-only listener are redirected to the separate admin listener.
+func redirectToSetup(w http.ResponseWriter, r *http.Request) {
+	target := "/setup"
+	if conf := config.Get(); conf.SeparateAdminListener {
+		if localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); !ok || localAddr.Port != conf.AdminPort {
+			target = config.GetSetupURL()
+		}
+	}
+	http.Redirect(w, r, target, http.StatusFound)
 }
 
 // deviceMux creates a handler that routes to sub-handlers based on the final URL path segment.
@@ -196,8 +328,16 @@ func deviceMux(handlers map[string]http.HandlerFunc, api *alpaca.API) http.Handl
 
 // --- API Handlers ---
 
+// handleGetFirmwareConfig serves the cached firmware configuration. The device is only asked
+// if the cache is empty or ?refresh=true is given.
 func handleGetFirmwareConfig(w http.ResponseWriter, r *http.Request) {
-	resp, err := serial.SendCommand(`{"get":"config"}`, false, 0)
+	resp, _, err := serial.GetFirmwareConfigJSON()
+	if err != nil || r.URL.Query().Get("refresh") == "true" {
+		// Give up on the queued command if the client goes away.
+		ctx, cancel := context.WithTimeout(r.Context(), 3*time.Second)
+		defer cancel()
+		resp, err = serial.RefreshFirmwareConfig(ctx)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -220,11 +360,13 @@ func handleSetFirmwareConfig(w http.ResponseWriter, r *http.Request) {
 	}
 	command := fmt.Sprintf(`{"sc":%s}`, string(body))
 	logger.Debug("Sending to device: %s", command)
-	resp, err := serial.SendCommand(command, true, 10*time.Second)
+	src := audit.FromRequest(r)
+	resp, err := serial.SendAuditedCommand(src, "firmware_config", command, 10*time.Second)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
 		return
 	}
+	events.Publish(events.ConfigChanged{Scope: events.ConfigScopeFirmware, Source: src.String()})
 
 	// Trigger a switch map sync in case standard switches were enabled/disabled
 	go serial.SyncFirmwareConfig()
@@ -234,14 +376,22 @@ func handleSetFirmwareConfig(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleGetPowerStatus(w http.ResponseWriter, r *http.Request) {
-	serial.Status.RLock()
-	defer serial.Status.RUnlock()
-	if serial.Status.Data == nil {
+	serial.NoteClientActivity() // The web interface polls here while the state stream is down
+	snapshot := serial.Status.Load()
+	if snapshot.Data == nil {
 		http.Error(w, "Status cache is not yet populated", http.StatusServiceUnavailable)
 		return
 	}
+	setSnapshotHeaders(w, snapshot.Seq, snapshot.UpdatedAt)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(serial.Status.Data)
+	json.NewEncoder(w).Encode(snapshot.Data)
+}
+
+// setSnapshotHeaders identifies the cache snapshot a response was built from, so clients
+// can tell whether the value has changed since their last request.
+func setSnapshotHeaders(w http.ResponseWriter, seq uint64, updatedAt time.Time) {
+	w.Header().Set("X-Snapshot-Seq", strconv.FormatUint(seq, 10))
+	w.Header().Set("X-Snapshot-Time", updatedAt.UTC().Format(time.RFC3339Nano))
 }
 
 func handleSetAllPower(w http.ResponseWriter, r *http.Request) {
@@ -258,88 +408,58 @@ func handleSetAllPower(w http.ResponseWriter, r *http.Request) {
 		stateInt = 1
 	}
 	command := fmt.Sprintf(`{"set":{"all":%d}}`, stateInt)
-	responseJSON, err := serial.SendCommand(command, true, 0)
-	if err != nil {
+	// The command processor updates the status cache from the response.
+	if _, err := serial.SendAuditedCommand(audit.FromRequest(r), "all_power", command, 0); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
 		return
 	}
-	var statusData map[string]map[string]interface{}
-	if json.Unmarshal([]byte(responseJSON), &statusData) == nil {
-		serial.Status.Lock()
-		serial.Status.Data = statusData["status"]
-		serial.Status.Unlock()
-	}
 	w.WriteHeader(http.StatusOK)
 }
 
 func handleGetLiveStatus(w http.ResponseWriter, r *http.Request) {
-	serial.Conditions.RLock()
-	defer serial.Conditions.RUnlock()
-	if serial.Conditions.Data == nil {
+	serial.NoteClientActivity()
+	snapshot := serial.Conditions.Load()
+	if snapshot.Data == nil {
 		w.Header().Set("Content-Type", "application/json")
 		fmt.Fprint(w, "{}")
 		return
 	}
+	setSnapshotHeaders(w, snapshot.Seq, snapshot.UpdatedAt)
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(serial.Conditions.Data)
+	json.NewEncoder(w).Encode(snapshot.Data)
 }
 
-func handleDeviceCommand(w http.ResponseWriter, r *http.Request) {
-	body, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
-	}
-	defer r.Body.Close()
-
-	// We need to check the command type to see if we should wait for a response.
-	var commandPayload struct {
-		Command string `json:"command"`
-	}
-	// We ignore the error here because the body might be a different type of command JSON
-	// and we want to handle those generically.
-	json.Unmarshal(body, &commandPayload)
-
-	commandJSON := string(body)
-
-	// Fire-and-forget commands
-	if commandPayload.Command == "reboot" || commandPayload.Command == "factory_reset" {
-		logger.Info("Received command '%s' from web UI. Sending to device.", commandJSON)
-		serial.SendCommand(commandJSON, true, 0) // Don't wait for response
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/json")
-		fmt.Fprint(w, `{"status":"Command sent successfully"}`) // Return valid JSON
+func handleDownloadLog(w http.ResponseWriter, r *http.Request) {
+	logPath := logger.GetLogFilePath()
+	if logPath == "" {
+		http.Error(w, "Log file path not available", http.StatusInternalServerError)
 		return
 	}
 
-	// For all other commands, send and wait for a response.
-	if commandPayload.Command == "dry_sensor" {
-		logger.Info("Received command '%s' from web UI. Sending to device.", commandJSON)
-	} else {
-		logger.Debug("Received generic command from web UI: %s", commandJSON)
-	}
-
-	// Use a timeout that's appropriate for commands that might take a moment.
-	resp, err := serial.SendCommand(commandJSON, true, 5*time.Second)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to send command to device: %v", err), http.StatusServiceUnavailable)
-		return
-	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"proxy.log\"")
+	http.ServeFile(w, r, logPath)
+}
 
+// handleGetDeviceLog returns the recent lines the device printed on its own.
+func handleGetDeviceLog(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	// The device response is expected to be JSON, so we can just pass it through.
-	fmt.Fprint(w, resp)
+	json.NewEncoder(w).Encode(devicelog.Recent())
 }
 
-func handleDownloadLog(w http.ResponseWriter, r *http.Request) {
-	logPath := logger.GetLogFilePath()
+func handleDownloadDeviceLog(w http.ResponseWriter, r *http.Request) {
+	logPath := devicelog.GetFilePath()
 	if logPath == "" {
-		http.Error(w, "Log file path not available", http.StatusInternalServerError)
+		http.Error(w, "Device log file path not available", http.StatusInternalServerError)
+		return
+	}
+	if _, err := os.Stat(logPath); err != nil {
+		http.Error(w, "The device has not printed anything yet", http.StatusNotFound)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain")
-	w.Header().Set("Content-Disposition", "attachment; filename=\"proxy.log\"")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"device.log\"")
 	http.ServeFile(w, r, logPath)
 }
 
@@ -367,7 +487,12 @@ func handleGetProxyVersion(appVersion string) http.HandlerFunc {
 
 func handleCreateBackup(w http.ResponseWriter, r *http.Request) {
 	logger.Info("Creating combined configuration backup...")
-	firmwareConfigJSON, err := serial.SendCommand(`{"get":"config"}`, true, 0)
+	firmwareConfigJSON, _, err := serial.GetFirmwareConfigJSON()
+	if err != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		firmwareConfigJSON, err = serial.RefreshFirmwareConfig(ctx)
+	}
 	if err != nil {
 		http.Error(w, "Failed to get firmware configuration", http.StatusInternalServerError)
 		return
@@ -409,33 +534,110 @@ func handleRestoreBackup(w http.ResponseWriter, r *http.Request) {
 	// Restore Firmware Config
 	compactFirmwareConfig, _ := json.Marshal(backup.FirmwareConfig)
 	firmwareCommand := fmt.Sprintf(`{"sc":%s}`, string(compactFirmwareConfig))
-	if _, err := serial.SendCommand(firmwareCommand, true, 10*time.Second); err != nil {
+	src := audit.FromRequest(r)
+	if _, err := serial.SendAuditedCommand(src, "backup_restore:firmware", firmwareCommand, 10*time.Second); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to send firmware config to device: %v", err), http.StatusServiceUnavailable)
 		return
 	}
 	logger.Info("Firmware configuration restored successfully.")
+	events.Publish(events.ConfigChanged{Scope: events.ConfigScopeFirmware, Source: src.String()})
 
 	// Restore Proxy Config
 	conf := config.Get()
+	var warnings []string // Settings of the backup that were not restored
 	conf.NetworkPort = backup.ProxyConfig.NetworkPort
 	conf.ListenAddress = backup.ProxyConfig.ListenAddress
 	conf.LogLevel = backup.ProxyConfig.LogLevel
-	conf.SwitchNames = backup.ProxyConfig.SwitchNames
+	config.SetSwitchNames(backup.ProxyConfig.SwitchNames)
 	conf.HeaterAutoEnableLeader = backup.ProxyConfig.HeaterAutoEnableLeader
 	conf.HistoryRetentionNights = backup.ProxyConfig.HistoryRetentionNights
 	conf.TelemetryInterval = backup.ProxyConfig.TelemetryInterval
 	conf.EnableAlpacaVoltageControl = backup.ProxyConfig.EnableAlpacaVoltageControl
 	conf.EnableMasterPower = backup.ProxyConfig.EnableMasterPower
+	conf.RestoreStateAfterRestart = backup.ProxyConfig.RestoreStateAfterRestart
 	conf.AutoDetectPort = backup.ProxyConfig.AutoDetectPort
+	if backup.ProxyConfig.AlpacaServerName != "" {
+		conf.AlpacaServerName = backup.ProxyConfig.AlpacaServerName
+	}
+	if backup.ProxyConfig.AlpacaLocation != "" {
+		conf.AlpacaLocation = backup.ProxyConfig.AlpacaLocation
+	}
+	if err := config.SetAlpacaDeviceNames(backup.ProxyConfig.AlpacaDeviceNames); err != nil {
+		warnings = append(warnings, fmt.Sprintf("The Alpaca device names were not restored: %v.", err))
+	}
+	if backup.ProxyConfig.SafetyMonitor != nil {
+		conf.SafetyMonitor = backup.ProxyConfig.SafetyMonitor
+	}
+	if cc := backup.ProxyConfig.CoverCalibrator; cc != nil {
+		if err := config.ValidateCoverCalibrator(cc); cc.Enabled && err != nil {
+			warnings = append(warnings, fmt.Sprintf("The CoverCalibrator settings were not restored: %v.", err))
+		} else {
+			conf.CoverCalibrator = cc
+		}
+	}
+	if backup.ProxyConfig.Polling != nil {
+		conf.Polling = backup.ProxyConfig.Polling
+	}
+	conf.EnableIndiServer = backup.ProxyConfig.EnableIndiServer
+	if backup.ProxyConfig.IndiPort > 0 {
+		conf.IndiPort = backup.ProxyConfig.IndiPort
+	}
+	conf.EnableModbusServer = backup.ProxyConfig.EnableModbusServer
+	if backup.ProxyConfig.ModbusPort > 0 {
+		conf.ModbusPort = backup.ProxyConfig.ModbusPort
+	}
+	// An admin address that does not exist on this PC would stop the proxy at the next start.
+	if err := checkAdminListener(conf, backup.ProxyConfig); err != nil {
+		warnings = append(warnings, fmt.Sprintf("The admin listener settings were not restored: %v.", err))
+	} else {
+		conf.SeparateAdminListener = backup.ProxyConfig.SeparateAdminListener
+		if backup.ProxyConfig.AdminListenAddress != "" {
+			conf.AdminListenAddress = backup.ProxyConfig.AdminListenAddress
+		}
+		if backup.ProxyConfig.AdminPort > 0 {
+			conf.AdminPort = backup.ProxyConfig.AdminPort
+		}
+	}
+	// Certificate files of another machine would stop the admin listener from starting.
+	if missing := missingFiles(backup.ProxyConfig.TLSCertFile, backup.ProxyConfig.TLSKeyFile); len(missing) > 0 {
+		warnings = append(warnings, fmt.Sprintf("The HTTPS settings were not restored because %s does not exist on this PC.", strings.Join(missing, " and ")))
+	} else {
+		conf.EnableTLS = backup.ProxyConfig.EnableTLS
+		conf.TLSCertFile = backup.ProxyConfig.TLSCertFile
+		conf.TLSKeyFile = backup.ProxyConfig.TLSKeyFile
+	}
+	// Raw commands and the debug console are only switched on by a backup if the request
+	// asks for it, so importing a file cannot open them unnoticed.
+	if backup.ProxyConfig.EnableDebugCommands != conf.EnableDebugCommands {
+		if r.URL.Query().Get("restore_debug_commands") == "true" {
+			conf.EnableDebugCommands = backup.ProxyConfig.EnableDebugCommands
+			logger.Warn("Restore: Debug commands set to %t by the backup (requested via restore_debug_commands).", conf.EnableDebugCommands)
+			audit.Record(src, "backup_restore:debug_commands", fmt.Sprintf("enabled=%t", conf.EnableDebugCommands), "", nil)
+		} else if backup.ProxyConfig.EnableDebugCommands {
+			warnings = append(warnings, "Debug commands were left disabled; enable them in the Proxy tab if needed.")
+		} else {
+			conf.EnableDebugCommands = false // Turning them off is always safe.
+		}
+	}
+	if backup.ProxyConfig.AuditRetentionDays > 0 {
+		conf.AuditRetentionDays = backup.ProxyConfig.AuditRetentionDays
+	}
 	conf.SerialPortName = "" // Clear port to trigger auto-detection
 	logger.Info("Serial port name cleared to trigger auto-detection.")
 	logger.SetLevelFromString(conf.LogLevel)
 
-	if err := config.Save(); err != nil {
+	err = config.Save()
+	proxyConfigJSON, _ := json.Marshal(backup.ProxyConfig)
+	audit.Record(src, "backup_restore:proxy", string(proxyConfigJSON), "", err)
+	if err != nil {
 		http.Error(w, "Failed to save proxy configuration", http.StatusInternalServerError)
 		return
 	}
 	logger.Info("Proxy configuration restored successfully.")
+	for _, warning := range warnings {
+		logger.Warn("Restore: %s", warning)
+	}
+	events.Publish(events.ConfigChanged{Scope: events.ConfigScopeProxy, Source: src.String()})
 
 	// Synchronously attempt to reconnect so the user comes back to a connected system
 	logger.Info("Restore: Disconnecting current session...")
@@ -457,6 +659,118 @@ func handleRestoreBackup(w http.ResponseWriter, r *http.Request) {
 		go serial.Reconnect("")
 		fmt.Fprint(w, "Configuration restored successfully. Logic will retry connection in background.")
 	}
+	for _, warning := range warnings {
+		fmt.Fprintf(w, " %s", warning)
+	}
+}
+
+// checkAdminListener checks that the admin listener of a restored configuration can be
+// started on this PC, by binding its address unless it is the one already in use.
+func checkAdminListener(current, restored *config.ProxyConfig) error {
+	if !restored.SeparateAdminListener {
+		return nil
+	}
+	address, port := restored.AdminListenAddress, restored.AdminPort
+	if address == "" {
+		address = current.AdminListenAddress
+	}
+	if port <= 0 {
+		port = current.AdminPort
+	}
+	if net.ParseIP(address) == nil {
+		return fmt.Errorf("invalid address '%s'", address)
+	}
+	if port > 65535 || port == current.NetworkPort {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	if current.SeparateAdminListener && address == current.AdminListenAddress && port == current.AdminPort {
+		return nil // Bound by the running admin listener.
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(address, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s:%d", address, port)
+	}
+	listener.Close()
+	return nil
+}
+
+// missingFiles returns the given (non-empty) paths that do not exist.
+func missingFiles(paths ...string) []string {
+	var missing []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, "'"+path+"'")
+		}
+	}
+	return missing
+}
+
+// handleSerialStats reports the serial command queue and the latency per kind of command.
+func handleSerialStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(serial.GetQueueStats())
+}
+
+// handleGetSerialPorts lists the serial ports of the system with their last probe result.
+func handleGetSerialPorts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ports, err := serial.ListPorts()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list serial ports: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ports)
+}
+
+// handleProbeSerialPort probes a port chosen by the user and connects to it if an SV241 answers.
+func handleProbeSerialPort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	defer r.Body.Close()
+
+	var req struct {
+		Port string `json:"port"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Port == "" {
+		http.Error(w, "Invalid JSON format, expected {\"port\":\"COM3\"}", http.StatusBadRequest)
+		return
+	}
+
+	err := serial.ProbePort(req.Port)
+	audit.Record(audit.FromRequest(r), "serial_probe", req.Port, "", err)
+	switch {
+	case errors.Is(err, serial.ErrUnknownPort):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, serial.ErrReconnectPaused):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		logger.Warn("Probe of port %s failed: %v", req.Port, err)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"success": false,
+			"port":    req.Port,
+			"error":   err.Error(),
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"success": true,
+		"port":    req.Port,
+		"message": fmt.Sprintf("SV241 found on %s. Connected.", req.Port),
+	})
 }
 
 // handleSerialRelease closes the serial port to allow external tools (e.g., web flasher) to access it.
@@ -468,6 +782,7 @@ func handleSerialRelease(w http.ResponseWriter, r *http.Request) {
 
 	logger.Info("API request to release serial port received.")
 	err := serial.ReleasePort()
+	audit.Record(audit.FromRequest(r), "serial_release", "", "", err)
 
 	w.Header().Set("Content-Type", "application/json")
 	if err != nil {
@@ -494,6 +809,7 @@ func handleSerialResume(w http.ResponseWriter, r *http.Request) {
 
 	logger.Info("API request to resume serial reconnect received.")
 	serial.ResumeReconnect()
+	audit.Record(audit.FromRequest(r), "serial_resume", "", "", nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
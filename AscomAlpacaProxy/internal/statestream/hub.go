@@ -0,0 +1,333 @@
+package statestream
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/auth"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Hub maintains the set of active clients and sends them the updates of their topics.
+type Hub struct {
+	clients    map[*Client]bool
+	broadcast  chan Message
+	register   chan *Client
+	unregister chan *Client
+	subscribe  chan subscription
+}
+
+// Client is a WebSocket or Server-Sent Events connection with its subscribed topics.
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn // nil for Server-Sent Events clients
+	send   chan []byte
+	topics map[string]bool // Only accessed by the hub's Run loop
+}
+
+// subscription changes the topics of a client.
+type subscription struct {
+	client *Client
+	topics []string
+	add    bool
+}
+
+// clientRequest is a message sent by a WebSocket client.
+type clientRequest struct {
+	Action string   `json:"action"` // "subscribe" or "unsubscribe"
+	Topics []string `json:"topics"`
+}
+
+// subscriptionsMessage confirms the current topics of a client.
+type subscriptionsMessage struct {
+	Type   string   `json:"type"` // Always "subscriptions"
+	Topics []string `json:"topics"`
+}
+
+var hub *Hub
+
+// clientCount mirrors len(hub.clients) for readers outside the Run loop.
+var clientCount atomic.Int32
+
+// ClientCount returns the number of connected WebSocket and Server-Sent Events clients.
+func ClientCount() int {
+	return int(clientCount.Load())
+}
+
+// NewHub creates and returns a new Hub instance.
+func NewHub() *Hub {
+	hub = &Hub{
+		clients:    make(map[*Client]bool),
+		broadcast:  make(chan Message, 256),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		subscribe:  make(chan subscription),
+	}
+	return hub
+}
+
+// Run starts the Hub's message processing loop.
+func (h *Hub) Run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.clients[client] = true
+			for _, topic := range Topics {
+				if client.topics[topic] && topic != TopicEvents {
+					h.deliver(client, snapshot(topic))
+				}
+			}
+		case client := <-h.unregister:
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				close(client.send)
+			}
+		case sub := <-h.subscribe:
+			if _, ok := h.clients[sub.client]; !ok {
+				continue
+			}
+			for _, topic := range sub.topics {
+				if sub.add && !sub.client.topics[topic] {
+					sub.client.topics[topic] = true
+					if topic != TopicEvents {
+						h.deliver(sub.client, snapshot(topic))
+					}
+				} else if !sub.add {
+					delete(sub.client.topics, topic)
+				}
+			}
+			if payload, err := json.Marshal(subscriptionsMessage{Type: "subscriptions", Topics: sub.client.topicList()}); err == nil {
+				h.send(sub.client, payload)
+			}
+		case msg := <-h.broadcast:
+			for client := range h.clients {
+				if client.topics[msg.Topic] {
+					h.deliver(client, msg)
+				}
+			}
+		}
+		clientCount.Store(int32(len(h.clients)))
+	}
+}
+
+// deliver encodes a state message and queues it for a client.
+func (h *Hub) deliver(client *Client, msg Message) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		logger.Error("State stream: Failed to encode '%s' update: %v", msg.Topic, err)
+		return
+	}
+	h.send(client, payload)
+}
+
+// send queues a payload for a client. A client that cannot keep up is disconnected;
+// it receives fresh snapshots when it reconnects.
+func (h *Hub) send(client *Client, payload []byte) {
+	select {
+	case client.send <- payload:
+	default:
+		close(client.send)
+		delete(h.clients, client)
+	}
+}
+
+// hubBroadcast hands a message to the hub without blocking.
+// It returns false if the message had to be dropped.
+func hubBroadcast(msg Message) bool {
+	if hub == nil {
+		return true
+	}
+	select {
+	case hub.broadcast <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) topicList() []string {
+	list := []string{}
+	for _, topic := range Topics {
+		if c.topics[topic] {
+			list = append(list, topic)
+		}
+	}
+	return list
+}
+
+// parseTopics reads the comma-separated "topics" query parameter. Without it, all topics are subscribed.
+func parseTopics(r *http.Request) (map[string]bool, error) {
+	topics := make(map[string]bool)
+	param := r.URL.Query().Get("topics")
+	if param == "" {
+		for _, t := range Topics {
+			topics[t] = true
+		}
+		return topics, nil
+	}
+	for _, t := range strings.Split(param, ",") {
+		t = strings.TrimSpace(t)
+		if !IsTopic(t) {
+			return nil, fmt.Errorf("unknown topic '%s' (available: %s)", t, strings.Join(Topics, ", "))
+		}
+		topics[t] = true
+	}
+	return topics, nil
+}
+
+// ServeWs handles websocket requests from the peer.
+func ServeWs(w http.ResponseWriter, r *http.Request) {
+	if hub == nil {
+		http.Error(w, "State stream not available", http.StatusServiceUnavailable)
+		return
+	}
+	topics, err := parseTopics(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 8192,
+		CheckOrigin:     auth.IsOriginAllowed,
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("Failed to upgrade to websocket: %v", err)
+		return
+	}
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256), topics: topics}
+	client.hub.register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
+
+// ServeSSE streams the same messages as Server-Sent Events, for clients that cannot use
+// WebSockets. Each message is sent as an event named after its topic.
+func ServeSSE(w http.ResponseWriter, r *http.Request) {
+	if hub == nil {
+		http.Error(w, "State stream not available", http.StatusServiceUnavailable)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	topics, err := parseTopics(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := &Client{hub: hub, send: make(chan []byte, 256), topics: topics}
+	hub.register <- client
+	defer func() {
+		// Drain until the hub has closed the channel, so it never blocks on a gone client.
+		go func() {
+			for range client.send {
+			}
+		}()
+		hub.unregister <- client
+	}()
+
+	heartbeat := time.NewTicker(30 * time.Second)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case payload, ok := <-client.send:
+			if !ok {
+				return
+			}
+			var head struct {
+				Topic string `json:"topic"`
+			}
+			json.Unmarshal(payload, &head)
+			if head.Topic != "" {
+				fmt.Fprintf(w, "event: %s\n", head.Topic)
+			}
+			fmt.Fprintf(w, "data: %s\n\n", payload)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// readPump handles subscription requests from the websocket connection.
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+	c.conn.SetReadLimit(1024)
+	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); return nil })
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				logger.Error("websocket read error: %v", err)
+			}
+			break
+		}
+
+		var req clientRequest
+		if err := json.Unmarshal(data, &req); err != nil || (req.Action != "subscribe" && req.Action != "unsubscribe") {
+			logger.Debug("State stream: Ignoring invalid client message: %s", string(data))
+			continue
+		}
+		var topics []string
+		for _, t := range req.Topics {
+			if IsTopic(t) {
+				topics = append(topics, t)
+			}
+		}
+		c.hub.subscribe <- subscription{client: c, topics: topics, add: req.Action == "subscribe"}
+	}
+}
+
+// writePump pumps messages from the hub to the websocket connection.
+// Every message is sent as its own WebSocket message, so clients can parse each one as JSON.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(50 * time.Second)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				// The hub closed the channel.
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package statestream pushes changes of the cached device state (power status, sensor
+// conditions, connection state, switch map) and the events of the event bus to WebSocket
+// and Server-Sent Events clients, so they don't have to poll the REST endpoints.
+package statestream
+
+import (
+	"encoding/json"
+	"reflect"
+	"sv241pro-alpaca-proxy/internal/events"
+	"sync"
+	"time"
+)
+
+// Topics clients can subscribe to.
+const (
+	TopicStatus     = "status"     // Power status, same data as /api/v1/power/status
+	TopicConditions = "conditions" // Sensor values, same data as /api/v1/status
+	TopicConnection = "connection" // Serial connection state
+	TopicSwitchMap  = "switchmap"  // Alpaca switch ID -> switch key
+	TopicEvents     = "events"     // Events of the event bus (switch changes, config changes, sensor faults, ...)
+)
+
+// Topics lists all available topics.
+var Topics = []string{TopicStatus, TopicConditions, TopicConnection, TopicSwitchMap, TopicEvents}
+
+// Message types.
+const (
+	TypeSnapshot = "snapshot" // Data holds the complete state of the topic
+	TypeDiff     = "diff"     // Data holds changed and added keys, Removed the deleted keys
+	TypeEvent    = "event"    // Data holds a single event; the events topic has no snapshots
+)
+
+// Message is a state update sent to the clients.
+type Message struct {
+	Topic     string                 `json:"topic"`
+	Type      string                 `json:"type"`
+	Seq       uint64                 `json:"seq"`       // Increases with every change of the topic
+	Timestamp int64                  `json:"timestamp"` // Unix milliseconds
+	Data      map[string]interface{} `json:"data"`
+	Removed   []string               `json:"removed,omitempty"`
+}
+
+type topicState struct {
+	seq     uint64
+	data    map[string]interface{}
+	updated time.Time
+	resync  bool // A diff was dropped, so the next change is sent as a snapshot
+}
+
+var (
+	states   = make(map[string]*topicState)
+	statesMu sync.Mutex
+)
+
+// IsTopic reports whether name is a known topic.
+func IsTopic(name string) bool {
+	for _, t := range Topics {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Update sets the current state of a topic. If any value changed, the difference is
+// broadcast to all clients subscribed to the topic.
+// It never blocks, so it is safe to call from the serial command loop.
+func Update(topic string, data map[string]interface{}) {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+
+	st, ok := states[topic]
+	if !ok {
+		st = &topicState{}
+		states[topic] = st
+	}
+
+	changed := make(map[string]interface{})
+	for key, value := range data {
+		if old, found := st.data[key]; !found || !reflect.DeepEqual(old, value) {
+			changed[key] = value
+		}
+	}
+	var removed []string
+	for key := range st.data {
+		if _, found := data[key]; !found {
+			removed = append(removed, key)
+		}
+	}
+	if len(changed) == 0 && len(removed) == 0 && st.data != nil {
+		return
+	}
+
+	// Keep a copy, so later changes to the caller's map don't leak into the stored state.
+	st.data = make(map[string]interface{}, len(data))
+	for key, value := range data {
+		st.data[key] = value
+	}
+	st.seq++
+	st.updated = time.Now()
+
+	msg := Message{Topic: topic, Type: TypeDiff, Seq: st.seq, Timestamp: st.updated.UnixMilli(), Data: changed, Removed: removed}
+	if st.resync {
+		msg = snapshotLocked(topic)
+	}
+	st.resync = !hubBroadcast(msg)
+}
+
+// PublishEvent forwards an event of the event bus to the clients subscribed to the events topic.
+// The event type is sent as "event", followed by the fields of the event.
+func PublishEvent(msg events.Message) {
+	data := make(map[string]interface{})
+	if raw, err := json.Marshal(msg.Event); err == nil {
+		json.Unmarshal(raw, &data)
+	}
+	data["event"] = string(msg.Type)
+
+	statesMu.Lock()
+	st, ok := states[TopicEvents]
+	if !ok {
+		st = &topicState{}
+		states[TopicEvents] = st
+	}
+	st.seq++
+	st.updated = msg.Time
+	seq := st.seq
+	statesMu.Unlock()
+
+	hubBroadcast(Message{Topic: TopicEvents, Type: TypeEvent, Seq: seq, Timestamp: msg.Time.UnixMilli(), Data: data})
+}
+
+// snapshot returns the complete state of a topic.
+func snapshot(topic string) Message {
+	statesMu.Lock()
+	defer statesMu.Unlock()
+	return snapshotLocked(topic)
+}
+
+// snapshotLocked MUST be called with statesMu held.
+func snapshotLocked(topic string) Message {
+	msg := Message{Topic: topic, Type: TypeSnapshot, Data: map[string]interface{}{}}
+	if st, ok := states[topic]; ok {
+		msg.Seq = st.seq
+		msg.Timestamp = st.updated.UnixMilli()
+		for key, value := range st.data {
+			msg.Data[key] = value
+		}
+	}
+	return msg
+}
@@ -6,6 +6,7 @@ import (
 	"os/exec"
 	"runtime"
 	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/devicelog"
 	"sv241pro-alpaca-proxy/internal/events"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"syscall"
@@ -41,7 +42,7 @@ func OnReady(onStart func(), iconData []byte) {
 
 	// Start the main application logic in a goroutine.
 	go onStart()
-	events.StartListener(listenForComPortEvents)
+	listenForComPortEvents()
 
 	// Handle menu clicks.
 	go func() {
@@ -61,6 +62,7 @@ func OnReady(onStart func(), iconData []byte) {
 // OnExit is called when the application is requested to exit.
 func OnExit() {
 	logger.Info("Exiting application.")
+	devicelog.Close()
 	logger.Close()
 
 	// Release the single instance mutex.
@@ -143,19 +145,26 @@ func ShowNotification(title, message string) {
 	}
 }
 
-// listenForComPortEvents waits for status updates from the serial manager
+// listenForComPortEvents subscribes to connection and restart events from the serial manager
 // and shows notifications accordingly.
 func listenForComPortEvents() {
 	logger.Info("Systray is now listening for COM port connection events.")
-	go func() {
-		for status := range events.ComPortStatusChan {
-			switch status {
-			case events.Connected:
-				go ShowNotification("SV241 Reconnected", "Connection to the COM port has been restored.")
-			case events.Disconnected:
-				go ShowNotification("SV241 Connection Lost", "Connection to the COM port was interrupted. Please check the device and cable.")
+	events.Subscribe("systray", func(msg events.Message) {
+		switch msg.Type {
+		case events.TypeConnected:
+			ShowNotification("SV241 Reconnected", "Connection to the COM port has been restored.")
+		case events.TypeDisconnected:
+			ShowNotification("SV241 Connection Lost", "Connection to the COM port was interrupted. Please check the device and cable.")
+		case events.TypeOutputsReset:
+			reset, _ := msg.Event.(events.OutputsReset)
+			switch {
+			case reset.Restored:
+				ShowNotification("SV241 Outputs Restored", "The device restarted. The outputs were switched back to their last state.")
+			case reset.Error != "":
+				ShowNotification("SV241 Restore Failed", "The device restarted and the outputs could not be restored. Please check them.")
+			default:
+				ShowNotification("SV241 Restarted", "The device restarted and the outputs are back at their startup states. Please check them.")
 			}
 		}
-		logger.Info("Systray stopped listening for COM port events.")
-	}()
+	}, events.TypeConnected, events.TypeDisconnected, events.TypeOutputsReset)
 }
@@ -226,14 +226,12 @@ func HandleDownloadCSV(w http.ResponseWriter, r *http.Request) {
 
 	// Write Header with custom names
 	// Format: key (customName) if custom name exists and differs from key
-	proxyConf := config.Get()
+	switchNames := config.GetSwitchNames()
 	header := []string{"timestamp"}
 	for _, col := range selectedCols {
 		colHeader := col
-		if proxyConf.SwitchNames != nil {
-			if customName, exists := proxyConf.SwitchNames[col]; exists && customName != "" && customName != col {
-				colHeader = fmt.Sprintf("%s (%s)", col, customName)
-			}
+		if customName, exists := switchNames[col]; exists && customName != "" && customName != col {
+			colHeader = fmt.Sprintf("%s (%s)", col, customName)
 		}
 		header = append(header, colHeader)
 	}
@@ -95,43 +95,17 @@ func loggingLoop() {
 }
 
 func logTelemetry() {
-	// 1. Get current conditions (thread-safe copy)
-	serial.Conditions.RLock()
-	data := serial.Conditions.Data
-	serial.Conditions.RUnlock()
+	// 1. Get current conditions (immutable snapshot)
+	data := serial.Conditions.Load().Data
 
 	if data == nil {
 		return // No data yet
 	}
 
-	// Helper to safely get float
+	// Helper to get a value, 0 if the sensor reported none
 	getFloat := func(key string) float64 {
-		if v, ok := data[key]; ok {
-			// It might be float64 or int or string depending on JSON unmarshal, usually float64
-			switch val := v.(type) {
-			case float64:
-				return val
-			case int:
-				return float64(val)
-			default:
-				return 0
-			}
-		}
-		return 0
-	}
-
-	getInt := func(key string) int {
-		if v, ok := data[key]; ok {
-			switch val := v.(type) {
-			case float64:
-				return int(val)
-			case int:
-				return val
-			default:
-				return 0
-			}
-		}
-		return 0
+		val, _ := data.Value(key)
+		return val
 	}
 
 	record := database.TelemetryRecord{
@@ -143,34 +117,18 @@ func logTelemetry() {
 		HumAmb:    getFloat("h_amb"),
 		DewPoint:  getFloat("d"),
 		TempLens:  getFloat("t_lens"),
-		PWM1:      getInt("pwm1"),
-		PWM2:      getInt("pwm2"),
+		PWM1:      int(data.PWM1),
+		PWM2:      int(data.PWM2),
 	}
 
 	// Add switch states
-	serial.Status.RLock()
-	statusData := serial.Status.Data
-	serial.Status.RUnlock()
+	statusData := serial.Status.Load().Data
 
 	if statusData != nil {
 		// Helper for switches
 		getSwitch := func(shortKey string) int {
-			if val, ok := statusData[shortKey]; ok {
-				switch v := val.(type) {
-				case bool:
-					if v {
-						return 1
-					} else {
-						return 0
-					}
-				case float64:
-					if v >= 1.0 {
-						return 1
-					}
-					return 0
-				default:
-					return 0
-				}
+			if val, ok := statusData.Output(shortKey); ok && val.IsOn() {
+				return 1
 			}
 			return 0
 		}
@@ -181,7 +139,7 @@ func logTelemetry() {
 		// Layout: dc1..dc5, usbc12, usb345, adj_conv
 
 		// We need to resolve long names to short keys again?
-		// Actually, `serial.Status.Data` uses short keys (e.g. "S1", "S2").
+		// Actually, `serial.Status.Data` uses short keys (e.g. "d1", "u12").
 		// To be robust, we need to look up which switch corresponds to "dc1".
 		// For now, let's use the same look up logic as before strictly if we want to be correct.
 
@@ -203,8 +161,8 @@ func logTelemetry() {
 
 			if isEnabled {
 				if longKey == "adj_conv" {
-					if v, ok := statusData[shortKey]; ok {
-						if f, ok := v.(float64); ok {
+					if v, ok := statusData.Output(shortKey); ok {
+						if f, ok := v.Float(); ok {
 							record.AdjConv = f
 						}
 					}
@@ -0,0 +1,411 @@
+// Package tlscert manages the TLS certificate of the admin listener. It either loads a
+// user-supplied certificate/key pair or generates a local CA and a server certificate
+// signed by it. Certificates are checked periodically and renewed (or reloaded from disk)
+// before they expire, without restarting the listener.
+package tlscert
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/logger"
+	"sync"
+	"time"
+)
+
+const (
+	certDirName    = "tls"
+	caCertFile     = "ca.crt"
+	caKeyFile      = "ca.key"
+	serverCertFile = "server.crt"
+	serverKeyFile  = "server.key"
+
+	caValidity     = 10 * 365 * 24 * time.Hour
+	serverValidity = 397 * 24 * time.Hour // Maximum accepted by browsers
+	// renewBefore renews the server certificate this long before it expires.
+	renewBefore   = 30 * 24 * time.Hour
+	checkInterval = 12 * time.Hour
+)
+
+// caPermittedRanges are the only addresses the local CA may issue certificates for (loopback,
+// private and link-local networks). Together with the permitted names (see caPermittedDomains),
+// a leaked CA key cannot be used to impersonate public sites on the PCs that trust the CA.
+var caPermittedRanges = mustParseCIDRs(
+	"127.0.0.0/8", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16",
+	"::1/128", "fc00::/7", "fe80::/10",
+)
+
+var (
+	current   *tls.Certificate
+	certMu    sync.RWMutex
+	startOnce sync.Once
+	// userCertModTime tracks user-supplied files, so a renewed certificate is picked up.
+	userCertModTime time.Time
+)
+
+// TLSConfig returns a TLS configuration for the admin listener. The certificate is loaded
+// or generated on the first call and renewed in the background afterwards.
+func TLSConfig() (*tls.Config, error) {
+	if err := refresh(); err != nil {
+		return nil, err
+	}
+	startOnce.Do(func() { go renewLoop() })
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			certMu.RLock()
+			defer certMu.RUnlock()
+			return current, nil
+		},
+	}, nil
+}
+
+// certDir returns the directory of the generated certificates, next to proxy_config.json.
+func certDir() string {
+	return filepath.Join(config.GetConfigDir(), certDirName)
+}
+
+// usesUserCertificate reports whether a user-supplied certificate is configured.
+func usesUserCertificate() bool {
+	conf := config.Get()
+	return conf.TLSCertFile != "" && conf.TLSKeyFile != ""
+}
+
+func renewLoop() {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := refresh(); err != nil {
+			logger.Error("TLS: Certificate check failed: %v", err)
+		}
+	}
+}
+
+// refresh loads the current certificate and renews it if needed.
+func refresh() error {
+	if usesUserCertificate() {
+		return loadUserCertificate()
+	}
+	return ensureSelfSigned()
+}
+
+// loadUserCertificate (re)loads the configured certificate/key files if they changed.
+func loadUserCertificate() error {
+	conf := config.Get()
+	info, err := os.Stat(conf.TLSCertFile)
+	if err != nil {
+		return fmt.Errorf("cannot access certificate file: %w", err)
+	}
+
+	certMu.RLock()
+	loaded := current != nil && info.ModTime().Equal(userCertModTime)
+	certMu.RUnlock()
+	if !loaded {
+		cert, err := tls.LoadX509KeyPair(conf.TLSCertFile, conf.TLSKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to load certificate '%s': %w", conf.TLSCertFile, err)
+		}
+		certMu.Lock()
+		current = &cert
+		userCertModTime = info.ModTime()
+		certMu.Unlock()
+		logger.Info("TLS: Loaded certificate from '%s'.", conf.TLSCertFile)
+	}
+
+	certMu.RLock()
+	leaf := current.Leaf
+	certMu.RUnlock()
+	if leaf != nil && time.Until(leaf.NotAfter) < renewBefore {
+		logger.Warn("TLS: The certificate '%s' expires on %s. Please replace it.", conf.TLSCertFile, leaf.NotAfter.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// ensureSelfSigned loads the generated server certificate, or (re)creates it if it is missing,
+// expires soon or does not cover the admin listen address.
+func ensureSelfSigned() error {
+	dir := certDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create certificate directory: %w", err)
+	}
+
+	hosts := certificateHosts()
+	caCert, caKey, err := loadOrCreateCA(dir, hosts)
+	if err != nil {
+		return err
+	}
+
+	certPath := filepath.Join(dir, serverCertFile)
+	keyPath := filepath.Join(dir, serverKeyFile)
+
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err == nil && !needsRenewal(cert.Leaf, caCert, hosts) {
+		certMu.RLock()
+		unchanged := current != nil && current.Leaf != nil && current.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) == 0
+		certMu.RUnlock()
+		if !unchanged {
+			certMu.Lock()
+			current = &cert
+			certMu.Unlock()
+			logger.Info("TLS: Using certificate '%s' (valid until %s).", certPath, cert.Leaf.NotAfter.Format("2006-01-02"))
+		}
+		return nil
+	}
+
+	logger.Info("TLS: Creating new server certificate for %v.", hosts)
+	if err := createServerCertificate(certPath, keyPath, caCert, caKey, hosts); err != nil {
+		return err
+	}
+	cert, err = tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load new server certificate: %w", err)
+	}
+	certMu.Lock()
+	current = &cert
+	certMu.Unlock()
+	logger.Info("TLS: Server certificate valid until %s.", cert.Leaf.NotAfter.Format("2006-01-02"))
+	return nil
+}
+
+// needsRenewal reports whether the server certificate must be recreated.
+func needsRenewal(leaf, caCert *x509.Certificate, hosts []string) bool {
+	if leaf == nil || time.Until(leaf.NotAfter) < renewBefore {
+		return true
+	}
+	if leaf.CheckSignatureFrom(caCert) != nil {
+		return true // CA was replaced
+	}
+	for _, host := range hosts {
+		if leaf.VerifyHostname(host) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// certificateHosts returns the names and addresses the server certificate must cover.
+// Public addresses are left out, because the local CA may not issue certificates for them.
+func certificateHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname := localHostname(); hostname != "" {
+		hosts = append(hosts, hostname)
+	}
+	var addrs []net.IP
+	addr := config.Get().AdminListenAddress
+	if ip := net.ParseIP(addr); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		addrs = append(addrs, ip)
+	} else if ip != nil && ip.IsUnspecified() {
+		// Listening on all interfaces: include all local addresses.
+		if ifAddrs, err := net.InterfaceAddrs(); err == nil {
+			for _, a := range ifAddrs {
+				if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+					addrs = append(addrs, ipnet.IP)
+				}
+			}
+		}
+	}
+	for _, ip := range addrs {
+		if !inRanges(ip, caPermittedRanges) {
+			logger.Debug("TLS: Address %s is not a private address and is left out of the certificate.", ip)
+			continue
+		}
+		hosts = append(hosts, ip.String())
+	}
+	return hosts
+}
+
+// localHostname returns the hostname in lower case, as used in the name constraints.
+func localHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(hostname)
+}
+
+// caPermittedDomains returns the names the local CA may issue certificates for.
+func caPermittedDomains() []string {
+	domains := []string{"localhost"}
+	if hostname := localHostname(); hostname != "" {
+		domains = append(domains, hostname)
+	}
+	return domains
+}
+
+// caCovers reports whether the name constraints of a CA allow certificates for all hosts.
+// CAs created before the constraints were added have none and are replaced.
+func caCovers(ca *x509.Certificate, hosts []string) bool {
+	if !ca.PermittedDNSDomainsCritical || len(ca.PermittedIPRanges) == 0 {
+		return false
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			if !inRanges(ip, ca.PermittedIPRanges) {
+				return false
+			}
+			continue
+		}
+		covered := false
+		for _, domain := range ca.PermittedDNSDomains {
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
+
+func inRanges(ip net.IP, ranges []*net.IPNet) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	ranges := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, r, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// loadOrCreateCA loads the local CA, or creates a new one if it is missing, expires soon or
+// its name constraints do not cover the hosts. The CA key stays in the certificate directory;
+// it is not part of configuration backups.
+func loadOrCreateCA(dir string, hosts []string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certPath := filepath.Join(dir, caCertFile)
+	keyPath := filepath.Join(dir, caKeyFile)
+
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && time.Until(pair.Leaf.NotAfter) > serverValidity {
+		if key, ok := pair.PrivateKey.(*ecdsa.PrivateKey); ok {
+			if caCovers(pair.Leaf, hosts) {
+				return pair.Leaf, key, nil
+			}
+			logger.Warn("TLS: The local certificate authority is replaced, because it is not limited to this PC's names and addresses. Install the new CA certificate (/api/v1/tls/ca.crt) in place of the old one.")
+		}
+	}
+
+	logger.Info("TLS: Creating new local certificate authority in '%s'.", dir)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to generate CA key: %w", err)
+	}
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber:          newSerialNumber(),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("SV241 Alpaca Proxy Local CA (%s)", hostname), Organization: []string{"SV241 Alpaca Proxy"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+		// Limit the CA to this PC, so it cannot be misused for other sites.
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         caPermittedDomains(),
+		PermittedIPRanges:           caPermittedRanges,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create CA certificate: %w", err)
+	}
+	if err := writePEM(certPath, keyPath, der, key); err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func createServerCertificate(certPath, keyPath string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey, hosts []string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("failed to generate server key: %w", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: newSerialNumber(),
+		Subject:      pkix.Name{CommonName: "SV241 Alpaca Proxy", Organization: []string{"SV241 Alpaca Proxy"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(serverValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return fmt.Errorf("failed to create server certificate: %w", err)
+	}
+	return writePEM(certPath, keyPath, der, key)
+}
+
+func writePEM(certPath, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to write '%s': %w", keyPath, err)
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("failed to write '%s': %w", certPath, err)
+	}
+	return nil
+}
+
+func newSerialNumber() *big.Int {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		// crypto/rand never fails on supported platforms.
+		panic(err)
+	}
+	return serial
+}
+
+// HandleDownloadCA serves the local CA certificate, so it can be installed as trusted
+// in the browser or operating system.
+func HandleDownloadCA(w http.ResponseWriter, r *http.Request) {
+	if usesUserCertificate() {
+		http.Error(w, "A user-supplied certificate is configured", http.StatusNotFound)
+		return
+	}
+	path := filepath.Join(certDir(), caCertFile)
+	if _, err := os.Stat(path); err != nil {
+		http.Error(w, "No local CA certificate has been created yet", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"sv241-proxy-ca.crt\"")
+	http.ServeFile(w, r, path)
+}
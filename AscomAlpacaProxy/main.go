@@ -4,12 +4,18 @@ import (
 	"embed"
 	"io/fs"
 	"sv241pro-alpaca-proxy/internal/alpaca"
+	"sv241pro-alpaca-proxy/internal/auth"
 	"sv241pro-alpaca-proxy/internal/config"
+	"sv241pro-alpaca-proxy/internal/console"
+	"sv241pro-alpaca-proxy/internal/devicelog"
 	"sv241pro-alpaca-proxy/internal/events"
+	"sv241pro-alpaca-proxy/internal/indi"
 	"sv241pro-alpaca-proxy/internal/logger"
 	"sv241pro-alpaca-proxy/internal/logstream"
+	"sv241pro-alpaca-proxy/internal/modbus"
 	"sv241pro-alpaca-proxy/internal/serial"
 	"sv241pro-alpaca-proxy/internal/server"
+	"sv241pro-alpaca-proxy/internal/statestream"
 	"sv241pro-alpaca-proxy/internal/systray"
 )
 
@@ -45,6 +51,19 @@ func startApp() {
 	logStreamHub := logstream.NewHub()
 	go logStreamHub.Run()
 
+	// Start the hub that streams device state changes to the web UI and scripts.
+	stateStreamHub := statestream.NewHub()
+	go stateStreamHub.Run()
+
+	// Start the hub that streams the output the SV241 prints on its own.
+	deviceLogHub := devicelog.NewHub()
+	go deviceLogHub.Run()
+
+	// Start the hub of the debug console, which also shows the device output.
+	consoleHub := console.NewHub()
+	go consoleHub.Run()
+	devicelog.AddListener(console.DeviceOutput)
+
 	// 2. Initialize the logger to use the hub as a writer.
 	if err := logger.Setup(&logstream.Broadcaster{}); err != nil {
 		// If logger fails, we can't do much else.
@@ -58,18 +77,37 @@ func startApp() {
 		logger.Fatal("Failed to load proxy configuration: %v", err)
 	}
 
+	// Load the optional authentication settings (stored separately from the proxy config).
+	if err := auth.Load(); err != nil {
+		logger.Fatal("Failed to load authentication settings: %v", err)
+	}
+	go auth.FlushLastUsed()
+
+	// Log all events and forward them to the state stream. This is done before the serial
+	// manager starts, so the events of the initial connection are not missed.
+	events.Subscribe("log", func(msg events.Message) {
+		logger.Debug("Event: %s", msg)
+	})
+	events.Subscribe("statestream", statestream.PublishEvent)
+
 	// 4. Start background tasks for serial communication and cache updates.
 	// This will perform the initial connection attempt.
 	// 4. Start background tasks for serial communication and cache updates.
 	// This will perform the initial connection attempt.
 	serial.StartManager()
 
-	// Ensure the systray listener is ready. This call is safe to make here.
-	events.StartListener(func() {}) // This just ensures the 'once.Do' is triggered if it hasn't been already.
-
 	// 5. Start the Alpaca discovery responder.
 	go alpaca.RespondToDiscovery()
 
+	// Log when the SafetyMonitor conditions change between safe and unsafe.
+	go alpaca.MonitorSafety()
+
+	// Start the optional INDI server for KStars/Ekos.
+	go indi.Start(AppVersion)
+
+	// Start the optional Modbus TCP server for PLCs.
+	go modbus.Start()
+
 	// Fetch firmware version in the background after initialization is complete.
 	go serial.FetchFirmwareVersion()
 